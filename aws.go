@@ -0,0 +1,396 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	awsprovider "github.com/cloudquery/cloudquery/providers/aws"
+	"github.com/cloudquery/cloudquery/providers/aws/autoscaling"
+	"github.com/cloudquery/cloudquery/providers/aws/cloudtrail"
+	"github.com/cloudquery/cloudquery/providers/aws/directconnect"
+	"github.com/cloudquery/cloudquery/providers/aws/ec2"
+	"github.com/cloudquery/cloudquery/providers/aws/ecr"
+	"github.com/cloudquery/cloudquery/providers/aws/ecs"
+	"github.com/cloudquery/cloudquery/providers/aws/efs"
+	"github.com/cloudquery/cloudquery/providers/aws/elasticbeanstalk"
+	"github.com/cloudquery/cloudquery/providers/aws/elbv2"
+	"github.com/cloudquery/cloudquery/providers/aws/emr"
+	"github.com/cloudquery/cloudquery/providers/aws/fsx"
+	"github.com/cloudquery/cloudquery/providers/aws/iam"
+	"github.com/cloudquery/cloudquery/providers/aws/kms"
+	"github.com/cloudquery/cloudquery/providers/aws/rds"
+	"github.com/cloudquery/cloudquery/providers/aws/redshift"
+	"github.com/cloudquery/cloudquery/providers/aws/s3"
+	"github.com/cloudquery/cloudquery/providers/provider"
+	"github.com/mitchellh/mapstructure"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gorm.io/gorm"
+)
+
+// Messages the vendored aws provider logs when it skips a resource or a region
+const (
+	awsAccessDeniedMessage   = "Skipping resource. Access denied"
+	awsRegionDisabledMessage = "Region is disabled"
+)
+
+// awsProvider runs the vendored aws provider one account, region and resource at a time, so it
+// can report an outcome and checkpoint each of them. The vendored provider only logs skipped
+// resources and regions, which awsProvider observes, and calls log.Fatal for any other error,
+// which fatalWriter turns into an error of the unit, see fatal.go.
+type awsProvider struct {
+	db       *gorm.DB
+	log      *zap.Logger
+	run      *fetchRun
+	lock     sync.Mutex
+	outcomes []ResourceOutcome
+	// what the vendored provider logged about the unit it runs
+	observed awsObservation
+}
+
+type awsObservation struct {
+	accountID      string
+	accessDenied   error
+	regionDisabled bool
+}
+
+// awsService is a service of the vendored aws provider with the function that creates the tables
+// of each of its resources
+type awsService struct {
+	// fetched once per account rather than per region
+	global    bool
+	resources map[string]func(*gorm.DB) error
+}
+
+// Every supported aws service. awsProvider dispatches on it, and the catalog, the validator and
+// the shards are derived from it. catalog_test.go checks it against the vendored provider.
+var awsServices = map[string]awsService{
+	"autoscaling": {resources: map[string]func(*gorm.DB) error{
+		"launch_configurations": autoscaling.MigrateLaunchConfigurations,
+	}},
+	"cloudtrail": {resources: map[string]func(*gorm.DB) error{
+		"trails": cloudtrail.MigrateTrails,
+	}},
+	"directconnect": {resources: map[string]func(*gorm.DB) error{
+		"gateways": directconnect.MigrateGateways,
+	}},
+	"ec2": {resources: map[string]func(*gorm.DB) error{
+		"byoip_cidrs":             ec2.MigrateByoipCidrs,
+		"customer_gateways":       ec2.MigrateCustomerGateways,
+		"flow_logs":               ec2.MigrateFlowLogs,
+		"images":                  ec2.MigrateImages,
+		"instances":               ec2.MigrateInstances,
+		"internet_gateways":       ec2.MigrateInternetGateways,
+		"nat_gateways":            ec2.MigrateNatGateways,
+		"network_acls":            ec2.MigrateNetworkAcls,
+		"route_tables":            ec2.MigrateRouteTables,
+		"security_groups":         ec2.MigrateSecurityGroups,
+		"subnets":                 ec2.MigrateSubnets,
+		"vpc_peering_connections": ec2.MigrateVPCPeeringConnections,
+		"vpcs":                    ec2.MigrateVPCs,
+	}},
+	"ecr": {resources: map[string]func(*gorm.DB) error{
+		"images": ecr.MigrateImage,
+	}},
+	"ecs": {resources: map[string]func(*gorm.DB) error{
+		"clusters": ecs.MigrateClusters,
+	}},
+	"efs": {resources: map[string]func(*gorm.DB) error{
+		"filesystems": efs.MigrateFileSystems,
+	}},
+	"elasticbeanstalk": {resources: map[string]func(*gorm.DB) error{
+		"environments": elasticbeanstalk.MigrateEnvironments,
+	}},
+	"elbv2": {resources: map[string]func(*gorm.DB) error{
+		"load_balancers": elbv2.MigrateLoadBalancers,
+		"target_groups":  elbv2.MigrateTargetGroup,
+	}},
+	"emr": {resources: map[string]func(*gorm.DB) error{
+		"clusters": emr.MigrateClusters,
+	}},
+	"fsx": {resources: map[string]func(*gorm.DB) error{
+		"backups": fsx.MigrateBackups,
+	}},
+	"iam": {global: true, resources: map[string]func(*gorm.DB) error{
+		"groups":            iam.MigrateGroups,
+		"password_policies": iam.MigratePasswordPolicies,
+		"policies":          iam.MigratePolicies,
+		"roles":             iam.MigrateRoles,
+		"users":             iam.MigrateUsers,
+	}},
+	"kms": {resources: map[string]func(*gorm.DB) error{
+		"keys": kms.MigrateKeys,
+	}},
+	"rds": {resources: map[string]func(*gorm.DB) error{
+		"certificates":     rds.MigrateCertificates,
+		"clusters":         rds.MigrateClusters,
+		"db_subnet_groups": rds.MigrateDBSubnetGroups,
+	}},
+	"redshift": {resources: map[string]func(*gorm.DB) error{
+		"cluster_subnet_groups": redshift.MigrateClusterSubnetGroups,
+		"clusters":              redshift.MigrateClusters,
+	}},
+	"s3": {global: true, resources: map[string]func(*gorm.DB) error{
+		"buckets": s3.MigrateBuckets,
+	}},
+}
+
+// Returns the service of an aws resource named {service}.{resource}
+func awsResourceService(name string) (awsService, bool) {
+	parts := strings.SplitN(name, ".", 2)
+	service, ok := awsServices[parts[0]]
+	if !ok || len(parts) < 2 || service.resources[parts[1]] == nil {
+		return awsService{}, false
+	}
+	return service, true
+}
+
+// Returns every aws resource named {service}.{resource} with the function that creates its tables
+func awsResourceMigrations() map[string]func(*gorm.DB) error {
+	migrations := map[string]func(*gorm.DB) error{}
+	for serviceName, service := range awsServices {
+		for name, migrate := range service.resources {
+			migrations[serviceName+"."+name] = migrate
+		}
+	}
+	return migrations
+}
+
+// The log_level values the vendored provider accepts, it exits on any other
+var awsLogLevels = map[string]bool{
+	"debug":                        true,
+	"debug_with_signing":           true,
+	"debug_with_http_body":         true,
+	"debug_with_request_retries":   true,
+	"debug_with_request_error":     true,
+	"debug_with_event_stream_body": true,
+}
+
+func newAWSProvider(db *gorm.DB, log *zap.Logger) (provider.Interface, error) {
+	return &awsProvider{db: db, log: log}, nil
+}
+
+func (p *awsProvider) setRun(run *fetchRun) {
+	p.run = run
+}
+
+func (p *awsProvider) resourceOutcomes() []ResourceOutcome {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.outcomes
+}
+
+// The tables are migrated by fetchProvider
+func (p *awsProvider) Run(config interface{}) error {
+	rest, ok := config.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("invalid aws config")
+	}
+	var awsConfig awsprovider.Config
+	err := mapstructure.Decode(rest, &awsConfig)
+	if err != nil {
+		return err
+	}
+	if len(awsConfig.Resources) == 0 {
+		return fmt.Errorf("please specify at least 1 resource in config.yml. see: https://docs.cloudquery.io/aws/tables-reference")
+	}
+	regions := awsConfig.Regions
+	if len(regions) == 0 {
+		regions = awsRegions()
+		p.log.Info(fmt.Sprintf("No regions specified in config.yml. Assuming all %d regions", len(regions)))
+	}
+	accounts := awsConfig.Accounts
+	if len(accounts) == 0 {
+		accounts = []awsprovider.Account{{ID: "default", RoleARN: "default"}}
+	}
+
+	var errs error
+	var resources []string
+	for _, resource := range awsConfig.Resources {
+		if _, ok := awsResourceService(resource.Name); !ok {
+			err := fmt.Errorf("unsupported aws resource %s", resource.Name)
+			p.record(fetchUnit{Provider: "aws", Resource: resource.Name}, "", resourceOutcome(err), err)
+			errs = multierr.Append(errs, err)
+			continue
+		}
+		resources = append(resources, resource.Name)
+	}
+	for _, account := range accounts {
+		// global resources are attempted once per account, in the first enabled region
+		collected := map[string]bool{}
+		for _, region := range regions {
+			disabled := false
+			for _, name := range resources {
+				unit := fetchUnit{Provider: "aws", Account: account.ID, Region: region, Resource: name}
+				service, _ := awsResourceService(name)
+				global := service.global
+				if global {
+					unit.Region = ""
+				}
+				switch {
+				case global && collected[name], p.run.isCompleted(unit):
+					continue
+				case disabled:
+					if !global {
+						p.record(unit, account.ID, OutcomeRegionDisabled, nil)
+						p.run.complete(unit)
+					}
+					continue
+				case p.run.shouldStop():
+					collected[name] = global
+					p.record(unit, account.ID, StatusDeferred, nil)
+					continue
+				}
+				observed, err := p.collect(rest, account, region, name)
+				if observed.regionDisabled {
+					disabled = true
+					p.run.discardScopes(unit)
+					if !global {
+						p.record(unit, account.ID, OutcomeRegionDisabled, nil)
+						p.run.complete(unit)
+					}
+					continue
+				}
+				if global {
+					collected[name] = true
+				}
+				accountID := account.ID
+				if observed.accountID != "" {
+					accountID = observed.accountID
+				}
+				if err == nil && observed.accessDenied != nil {
+					err = observed.accessDenied
+				}
+				if err != nil {
+					err = fmt.Errorf("account %s region %s resource %s: %w", accountID, region, name, err)
+				}
+				status := resourceOutcome(err)
+				p.record(unit, accountID, status, err)
+				if outcomeSucceeded(status) {
+					p.run.complete(unit)
+				} else {
+					p.run.discardScopes(unit)
+					errs = multierr.Append(errs, err)
+				}
+			}
+		}
+		// a global resource that no region answered for fails rather than dropping out of the
+		// outcomes, it isn't checkpointed so a resumed or later run tries again
+		for _, name := range resources {
+			unit := fetchUnit{Provider: "aws", Account: account.ID, Resource: name}
+			if service, _ := awsResourceService(name); !service.global || collected[name] || p.run.isCompleted(unit) {
+				continue
+			}
+			err := fmt.Errorf("account %s resource %s: global resource not fetched, regions %s are disabled",
+				account.ID, name, strings.Join(regions, ","))
+			p.record(unit, account.ID, OutcomeError, err)
+			errs = multierr.Append(errs, err)
+		}
+	}
+	return errs
+}
+
+// Runs the vendored provider for a single resource of an account and region. The vendored
+// provider keeps the config of its last run, so every unit gets a new one.
+func (p *awsProvider) collect(rest map[string]interface{}, account awsprovider.Account, region, resource string) (awsObservation, error) {
+	p.lock.Lock()
+	p.observed = awsObservation{}
+	p.lock.Unlock()
+	logger := p.log.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return &awsLogObserver{Core: core, provider: p}
+	}))
+	// p.db doesn't migrate, see newProvider
+	vendored, err := awsprovider.NewProvider(p.db.Session(&gorm.Session{}), logger)
+	if err == nil {
+		unitConfig := make(map[string]interface{}, len(rest))
+		for k, v := range rest {
+			unitConfig[k] = v
+		}
+		unitConfig["regions"] = []interface{}{region}
+		unitConfig["accounts"] = []interface{}{map[string]interface{}{"id": account.ID, "role_arn": account.RoleARN}}
+		unitConfig["resources"] = filterResources(rest, []string{resource})
+		err = vendored.Run(unitConfig)
+	}
+	if fatalErr := takeProviderFatals(); err == nil {
+		err = fatalErr
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.observed, err
+}
+
+// Records the outcome of a unit. Global resources are recorded without a region.
+func (p *awsProvider) record(unit fetchUnit, account, status string, err error) {
+	outcome := ResourceOutcome{Provider: "aws", Account: account, Region: unit.Region, Resource: unit.Resource, Status: status}
+	if err != nil {
+		outcome.Error = err.Error()
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.outcomes = append(p.outcomes, outcome)
+}
+
+// awsLogObserver passes the log entries of the vendored provider on, noting the ones about the
+// account, skipped resources and disabled regions
+type awsLogObserver struct {
+	zapcore.Core
+	provider *awsProvider
+}
+
+func (c *awsLogObserver) With(fields []zapcore.Field) zapcore.Core {
+	for _, field := range fields {
+		if field.Key == "account_id" && field.Type == zapcore.StringType && field.String != "" {
+			c.provider.lock.Lock()
+			c.provider.observed.accountID = field.String
+			c.provider.lock.Unlock()
+		}
+	}
+	return &awsLogObserver{Core: c.Core.With(fields), provider: c.provider}
+}
+
+// Observes the entries about skipped resources and regions even below the log level
+func (c *awsLogObserver) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if entry.Message == awsAccessDeniedMessage || strings.HasPrefix(entry.Message, awsRegionDisabledMessage) {
+		return checked.AddCore(entry, c)
+	}
+	return c.Core.Check(entry, checked)
+}
+
+func (c *awsLogObserver) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	c.provider.lock.Lock()
+	switch {
+	case entry.Message == awsAccessDeniedMessage:
+		c.provider.observed.accessDenied = fmt.Errorf("access denied")
+		for _, field := range fields {
+			if err, ok := field.Interface.(error); ok && field.Type == zapcore.ErrorType {
+				c.provider.observed.accessDenied = err
+			}
+		}
+	case strings.HasPrefix(entry.Message, awsRegionDisabledMessage):
+		c.provider.observed.regionDisabled = true
+	}
+	c.provider.lock.Unlock()
+	if !c.Core.Enabled(entry.Level) {
+		return nil
+	}
+	return c.Core.Write(entry, fields)
+}
+
+// Returns every region of the standard aws partition, the regions the vendored provider fetches
+// when none are configured
+func awsRegions() []string {
+	var regions []string
+	resolver := endpoints.DefaultResolver()
+	partitions := resolver.(endpoints.EnumPartitions).Partitions()
+	for _, p := range partitions {
+		if p.ID() == "aws" {
+			for id := range p.Regions() {
+				regions = append(regions, id)
+			}
+		}
+	}
+	return regions
+}
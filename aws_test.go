@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// Unsets an environment variable for the duration of the test
+func unsetenv(t *testing.T, key string) {
+	previous, ok := os.LookupEnv(key)
+	os.Unsetenv(key)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, previous)
+		}
+	})
+}
+
+// disabledRegionTransport answers every request of the aws sdk like an opt-in region that isn't
+// enabled in the account, which rejects the credentials
+type disabledRegionTransport struct{}
+
+func (disabledRegionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := `<ErrorResponse><Error><Type>Sender</Type><Code>InvalidClientTokenId</Code>` +
+		`<Message>The security token included in the request is invalid.</Message></Error>` +
+		`<RequestId>stub</RequestId></ErrorResponse>`
+	return &http.Response{
+		StatusCode: http.StatusForbidden,
+		Header:     http.Header{"Content-Type": []string{"text/xml"}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+// A global resource is fetched in the first enabled region. When every region is disabled it fails
+// rather than dropping out of the outcomes, and it isn't checkpointed.
+func TestAWSProviderGlobalResourceInDisabledRegion(t *testing.T) {
+	setenv(t, "AWS_ACCESS_KEY_ID", "test")
+	setenv(t, "AWS_SECRET_ACCESS_KEY", "test")
+	// the sdk sends every request with http.DefaultClient, a CA bundle would replace its transport
+	unsetenv(t, "AWS_CA_BUNDLE")
+	transport := http.DefaultClient.Transport
+	http.DefaultClient.Transport = disabledRegionTransport{}
+	t.Cleanup(func() { http.DefaultClient.Transport = transport })
+
+	db := openTestDB(t)
+	run, err := newFetchRun(context.Background(), db, zap.NewNop(), "run-1", "", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &awsProvider{db: db, log: zap.NewNop()}
+	p.setRun(run)
+	err = p.Run(map[string]interface{}{
+		"regions":   []interface{}{"af-south-1"},
+		"resources": resourceList("iam.users", "ec2.instances"),
+	})
+	if err == nil || !strings.Contains(err.Error(), "iam.users") {
+		t.Errorf("Run() error = %v, want the error of iam.users", err)
+	}
+
+	outcomes := p.resourceOutcomes()
+	if len(outcomes) != 2 {
+		t.Fatalf("Run() outcomes = %+v, want one for each resource", outcomes)
+	}
+	regional, global := outcomes[0], outcomes[1]
+	if regional.Resource != "ec2.instances" || regional.Region != "af-south-1" || regional.Status != OutcomeRegionDisabled {
+		t.Errorf("regional outcome = %+v, want ec2.instances %s in af-south-1", regional, OutcomeRegionDisabled)
+	}
+	if global.Resource != "iam.users" || global.Region != "" || global.Status != OutcomeError ||
+		!strings.Contains(global.Error, "af-south-1") {
+		t.Errorf("global outcome = %+v, want an iam.users %s naming the disabled region", global, OutcomeError)
+	}
+	if status := providerOutcome("aws", outcomes, nil).Status; status != StatusPartial {
+		t.Errorf("provider status = %q, want %q", status, StatusPartial)
+	}
+	if run.isCompleted(fetchUnit{Provider: "aws", Account: "default", Resource: "iam.users"}) {
+		t.Error("iam.users was checkpointed, want it fetched again by a resumed run")
+	}
+	if !run.isCompleted(fetchUnit{Provider: "aws", Account: "default", Region: "af-south-1", Resource: "ec2.instances"}) {
+		t.Error("ec2.instances in the disabled region wasn't checkpointed")
+	}
+}
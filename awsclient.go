@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+var (
+	awsSession     *session.Session
+	awsSessionErr  error
+	awsSessionOnce sync.Once
+)
+
+// Returns the session shared by the aws clients this function uses itself, as opposed to
+// the ones the providers create for fetching.
+func sharedAWSSession() (*session.Session, error) {
+	awsSessionOnce.Do(func() {
+		awsSession, awsSessionErr = session.NewSession()
+	})
+	return awsSession, awsSessionErr
+}
+
+// Returns the client config for an aws service. CLOUDQUERY_<SERVICE>_ENDPOINT overrides the
+// endpoint so a local HTTP stand-in can be used in tests.
+func awsServiceConfig(service string) *aws.Config {
+	config := aws.NewConfig()
+	endpoint := os.Getenv(fmt.Sprintf("CLOUDQUERY_%s_ENDPOINT", strings.ToUpper(service)))
+	if endpoint != "" {
+		config = config.WithEndpoint(endpoint)
+		if service == "s3" {
+			config = config.WithS3ForcePathStyle(true)
+		}
+	}
+	return config
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	azcompute "github.com/cloudquery/cloudquery/providers/azure/compute"
+	"github.com/cloudquery/cloudquery/providers/azure/keyvault"
+	"github.com/cloudquery/cloudquery/providers/azure/mysql"
+	"github.com/cloudquery/cloudquery/providers/azure/postgresql"
+	azresources "github.com/cloudquery/cloudquery/providers/azure/resources"
+	azsql "github.com/cloudquery/cloudquery/providers/azure/sql"
+	gcpcompute "github.com/cloudquery/cloudquery/providers/gcp/compute"
+	gcpiam "github.com/cloudquery/cloudquery/providers/gcp/iam"
+	gcpstorage "github.com/cloudquery/cloudquery/providers/gcp/storage"
+	k8s "github.com/cloudquery/cloudquery/providers/k8s"
+	okta "github.com/cloudquery/cloudquery/providers/okta"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+)
+
+func init() {
+	RegisterTask("list-resources", Task{
+		Description: "Lists every supported resource of every provider with the tables and columns it writes to",
+		NewRequest:  func() interface{} { return &ListResourcesRequest{} },
+		Run: func(ctx context.Context, req interface{}, resp *Response) error {
+			return ListResources(req.(*ListResourcesRequest), resp)
+		},
+	})
+}
+
+// Every resource of every provider with the function that creates its tables. The catalog, the
+// validator and fetchProvider use it, and catalog_test.go checks it against the resources the
+// vendored providers collect. aws and azure use the migrations of the providers. gcp, okta and
+// k8s only migrate from unexported functions, so their entries list the same models.
+var resourceRegistry = map[string]map[string]func(*gorm.DB) error{
+	"aws": awsResourceMigrations(),
+	"gcp": {
+		"compute.addresses": gcpMigration("compute", &gcpcompute.Address{}, &gcpcompute.AddressUser{}),
+		"compute.autoscalers": gcpMigration("compute", &gcpcompute.Autoscaler{},
+			&gcpcompute.AutoscalerPolicyCustomMetricUtilization{}, &gcpcompute.AutoscalerStatusDetails{}),
+		"compute.disk_types": gcpMigration("compute", &gcpcompute.DiskType{}),
+		"compute.images": gcpMigration("compute", &gcpcompute.Image{}, &gcpcompute.ImageGuestOsFeature{},
+			&gcpcompute.ImageLicenseCode{}, &gcpcompute.ImageLicense{}, &gcpcompute.ImageStorageLocation{}),
+		"compute.instances": gcpMigration("compute", &gcpcompute.Instance{}, &gcpcompute.InstanceAttachedDisk{},
+			&gcpcompute.InstanceAttachedDiskLicense{}, &gcpcompute.InstanceGuestOsFeature{},
+			&gcpcompute.InstanceAcceleratorConfig{}, &gcpcompute.InstanceMetadataItem{},
+			&gcpcompute.InstanceNetworkInterface{}, &gcpcompute.InstanceAccessConfig{},
+			&gcpcompute.InstanceAliasIpRange{}, &gcpcompute.InstanceSchedulingNodeAffinity{},
+			&gcpcompute.InstanceServiceAccount{}, &gcpcompute.InstanceTag{}),
+		"compute.interconnects": gcpMigration("compute", &gcpcompute.Interconnect{},
+			&gcpcompute.InterconnectCircuitInfo{}, &gcpcompute.InterconnectOutageNotification{},
+			&gcpcompute.InterconnectOutageNotificationAffectedCircuit{}, &gcpcompute.InterconnectAttachment{}),
+		"compute.ssl_certificates": gcpMigration("compute", &gcpcompute.SSLCertificate{},
+			&gcpcompute.SSLCertificateManagedDomain{}, &gcpcompute.SSLCertificateSubjectAlternativeName{}),
+		"compute.vpn_gateways": gcpMigration("compute", &gcpcompute.VpnGateway{},
+			&gcpcompute.VpnGatewayVpnGatewayInterface{}, &gcpcompute.VpnGatewayLabel{}),
+		"iam.project_roles":    gcpMigration("iam", &gcpiam.Role{}, &gcpiam.RolePermission{}),
+		"iam.service_accounts": gcpMigration("iam", &gcpiam.ServiceAccount{}),
+		"storage.buckets": gcpMigration("storage", &gcpstorage.Bucket{}, &gcpstorage.BucketAccessControl{},
+			&gcpstorage.BucketCors{}, &gcpstorage.BucketObjectAccessControl{}, &gcpstorage.BucketLifecycleRule{},
+			&gcpstorage.BucketCorsMethod{}, &gcpstorage.BucketCorsOrigin{}, &gcpstorage.BucketCorsResponseHeader{},
+			&gcpstorage.BucketZoneAffinity{}, &gcpstorage.BucketLabel{}, &gcpstorage.BucketPolicyBinding{},
+			&gcpstorage.BucketPolicyBindingsMember{}),
+	},
+	"azure": {
+		"compute.disks":      azcompute.MigrateDisk,
+		"keyvault.vaults":    keyvault.MigrateVault,
+		"mysql.servers":      mysql.MigrateServer,
+		"postgresql.servers": postgresql.MigrateServer,
+		"resources.groups":   azresources.MigrateGroup,
+		"sql.databases":      azsql.MigrateDatabase,
+		"sql.servers":        azsql.MigrateServer,
+	},
+	"okta": {
+		"applications": prefixedMigration("okta_", &okta.Application{}, &okta.ApplicationFeatures{}),
+		"users":        prefixedMigration("okta_", &okta.User{}, &okta.UserGroup{}),
+	},
+	"k8s": {
+		"pods": migration(&k8s.Pod{}, &k8s.PodVolume{}, &k8s.PodContainer{}, &k8s.PodContainerCommand{},
+			&k8s.PodContainerArgs{}, &k8s.PodContainerPort{}, &k8s.PodEnvFromSource{}, &k8s.PodEnvVar{},
+			&k8s.PodVolumeMount{}, &k8s.PodVolumeDevice{}, &k8s.PodExecActionCommand{}, &k8s.PodHTTPHeader{},
+			&k8s.PodCapabilitiesAdd{}, &k8s.PodCapabilitiesDrop{}, &k8s.PodEphemeralContainer{},
+			&k8s.PodSysctl{}, &k8s.PodAffinityTermNamespaces{}, &k8s.PodToleration{}, &k8s.PodHostAlias{},
+			&k8s.PodHostAliasHostnames{}, &k8s.PodDNSConfigNameservers{}, &k8s.PodDNSConfigSearches{},
+			&k8s.PodDNSConfigOption{}, &k8s.PodReadinessGate{}, &k8s.PodCondition{}, &k8s.PodIP{},
+			&k8s.PodContainerStatus{}),
+		"services": migration(&k8s.Service{}, &k8s.ServicePort{}, &k8s.ServiceSpecSelector{},
+			&k8s.ServiceSpecExternalIPs{}, &k8s.ServiceSpecLoadBalancerSourceRanges{},
+			&k8s.ServiceSpecTopologyKeys{}, &k8s.ServiceLoadBalancerIngress{}),
+	},
+}
+
+func migration(models ...interface{}) func(*gorm.DB) error {
+	return func(db *gorm.DB) error {
+		return db.AutoMigrate(models...)
+	}
+}
+
+// Migrates the models with a table prefix. Like the providers themselves this changes the
+// naming strategy of db, so it is only used on a scratch database.
+func prefixedMigration(prefix string, models ...interface{}) func(*gorm.DB) error {
+	return func(db *gorm.DB) error {
+		db.NamingStrategy = schema.NamingStrategy{TablePrefix: prefix}
+		return db.AutoMigrate(models...)
+	}
+}
+
+// gcp tables are prefixed with the service, see gcp.Provider.collectResource
+func gcpMigration(service string, models ...interface{}) func(*gorm.DB) error {
+	return prefixedMigration(fmt.Sprintf("gcp_%s_", service), models...)
+}
+
+// Returns the names of the supported providers in alphabetical order
+func providerNames() []string {
+	names := make([]string, 0, len(providerMap))
+	for name := range providerMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns the resources of a provider in alphabetical order. aws, gcp and azure resources are
+// named {service}.{resource}, okta and k8s resources have no service.
+func supportedResources(provider string) []string {
+	names := make([]string, 0, len(resourceRegistry[provider]))
+	for name := range resourceRegistry[provider] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Reports whether a provider supports a resource
+func isSupportedResource(provider, name string) bool {
+	_, ok := resourceRegistry[provider][name]
+	return ok
+}
+
+// Returns the supported resource of a provider closest to name, or an empty string when
+// none is close enough to be a typo
+func suggestResource(provider, name string) string {
+	best, bestDistance := "", 3
+	for _, supported := range supportedResources(provider) {
+		if d := editDistance(name, supported); d < bestDistance {
+			best, bestDistance = supported, d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+type ListResourcesRequest struct {
+	// json, the default, or markdown
+	Format string `json:"format,omitempty"`
+	// Only lists the resources of this provider
+	Provider string `json:"provider,omitempty"`
+}
+
+type CatalogProvider struct {
+	Name     string           `json:"name"`
+	Services []CatalogService `json:"services"`
+}
+
+// CatalogService groups the resources of a service. okta and k8s have a single service without a name.
+type CatalogService struct {
+	Name      string            `json:"name,omitempty"`
+	Resources []CatalogResource `json:"resources"`
+}
+
+type CatalogResource struct {
+	// Name of the resource as used in config.yml
+	Name   string         `json:"name"`
+	Tables []CatalogTable `json:"tables"`
+}
+
+type CatalogTable struct {
+	Name        string              `json:"name"`
+	Columns     []CatalogColumn     `json:"columns"`
+	ForeignKeys []CatalogForeignKey `json:"foreignKeys,omitempty"`
+}
+
+// CatalogForeignKey is a column that references a row of another table of the resource
+type CatalogForeignKey struct {
+	Column           string `json:"column"`
+	References       string `json:"references"`
+	ReferencedColumn string `json:"referencedColumn"`
+}
+
+// CatalogColumn is a column as created in sqlite. Other databases use the equivalent types.
+type CatalogColumn struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	PrimaryKey bool   `json:"primaryKey,omitempty"`
+}
+
+// Lists the resources in resp.Catalog, or as a Markdown document in resp.Markdown
+func ListResources(req *ListResourcesRequest, resp *Response) error {
+	providers := providerNames()
+	if req.Provider != "" {
+		if resourceRegistry[req.Provider] == nil {
+			return newTaskError(ErrorTypeInvalidRequest, fmt.Errorf("unknown provider %s. valid providers are: %s", req.Provider, strings.Join(providers, ", ")))
+		}
+		providers = []string{req.Provider}
+	}
+	if req.Format != "" && req.Format != "json" && req.Format != "markdown" {
+		return newTaskError(ErrorTypeInvalidRequest, fmt.Errorf("unknown format %s. valid formats are: json, markdown", req.Format))
+	}
+	catalog, err := buildCatalog(providers)
+	if err != nil {
+		return newTaskError(ErrorTypeInternal, err)
+	}
+	if req.Format == "markdown" {
+		resp.Markdown = catalogMarkdown(catalog)
+	} else {
+		resp.Catalog = catalog
+	}
+	return nil
+}
+
+// Builds the catalog by running the migrations of every resource in its own in-memory database
+func buildCatalog(providers []string) ([]CatalogProvider, error) {
+	var catalog []CatalogProvider
+	for _, providerName := range providers {
+		provider := CatalogProvider{Name: providerName}
+		for _, name := range supportedResources(providerName) {
+			tables, err := resourceTables(resourceRegistry[providerName][name])
+			if err != nil {
+				return nil, fmt.Errorf("%s resource %s: %w", providerName, name, err)
+			}
+			service := ""
+			if i := strings.Index(name, "."); i >= 0 {
+				service = name[:i]
+			}
+			if len(provider.Services) == 0 || provider.Services[len(provider.Services)-1].Name != service {
+				provider.Services = append(provider.Services, CatalogService{Name: service})
+			}
+			last := &provider.Services[len(provider.Services)-1]
+			last.Resources = append(last.Resources, CatalogResource{Name: name, Tables: tables})
+		}
+		catalog = append(catalog, provider)
+	}
+	return catalog, nil
+}
+
+// catalogDialector creates booleans as boolean instead of numeric, so the catalog tells them apart
+// from decimals. sqlite gives both the same affinity.
+type catalogDialector struct {
+	sqlite.Dialector
+}
+
+func (d catalogDialector) DataTypeOf(field *schema.Field) string {
+	if field.DataType == schema.Bool {
+		return "boolean"
+	}
+	return d.Dialector.DataTypeOf(field)
+}
+
+func (d catalogDialector) Migrator(db *gorm.DB) gorm.Migrator {
+	m := d.Dialector.Migrator(db).(sqlite.Migrator)
+	m.Dialector = d
+	return m
+}
+
+func resourceTables(migrate func(*gorm.DB) error) ([]CatalogTable, error) {
+	db, err := gorm.Open(catalogDialector{sqlite.Dialector{DSN: ":memory:"}}, &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Warn),
+	})
+	if err != nil {
+		return nil, err
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	defer sqlDB.Close()
+	// every connection has its own in-memory database
+	sqlDB.SetMaxOpenConns(1)
+	err = migrate(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	err = db.Raw("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name").
+		Scan(&names).Error
+	if err != nil {
+		return nil, err
+	}
+	tables := make([]CatalogTable, 0, len(names))
+	for _, name := range names {
+		var columns []struct {
+			Name string
+			Type string
+			Pk   int
+		}
+		err = db.Raw(fmt.Sprintf("PRAGMA table_info(%q)", name)).Scan(&columns).Error
+		if err != nil {
+			return nil, err
+		}
+		table := CatalogTable{Name: name, Columns: make([]CatalogColumn, 0, len(columns)+3)}
+		versioned := false
+		for _, column := range columns {
+			table.Columns = append(table.Columns, CatalogColumn{Name: column.Name, Type: column.Type, PrimaryKey: column.Pk > 0})
+			versioned = versioned || column.Pk > 0
+		}
+		if versioned {
+			// added by migrateSnapshotTables
+			table.Columns = append(table.Columns, CatalogColumn{Name: "fetch_id", Type: "text"},
+				CatalogColumn{Name: "fetched_at", Type: "datetime"}, CatalogColumn{Name: "superseded_by", Type: "text"})
+		}
+		var foreignKeys []struct {
+			Table string
+			From  string
+			To    string
+		}
+		err = db.Raw(fmt.Sprintf("PRAGMA foreign_key_list(%q)", name)).Scan(&foreignKeys).Error
+		if err != nil {
+			return nil, err
+		}
+		for _, foreignKey := range foreignKeys {
+			table.ForeignKeys = append(table.ForeignKeys, CatalogForeignKey{
+				Column:           foreignKey.From,
+				References:       foreignKey.Table,
+				ReferencedColumn: foreignKey.To,
+			})
+		}
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
+func catalogMarkdown(catalog []CatalogProvider) string {
+	var b strings.Builder
+	b.WriteString("# Resources\n")
+	for _, provider := range catalog {
+		fmt.Fprintf(&b, "\n## %s\n", provider.Name)
+		for _, service := range provider.Services {
+			if service.Name != "" {
+				fmt.Fprintf(&b, "\n### %s\n", service.Name)
+			}
+			for _, resource := range service.Resources {
+				fmt.Fprintf(&b, "\n#### %s\n\n| Table | Columns |\n| --- | --- |\n", resource.Name)
+				for _, table := range resource.Tables {
+					columns := make([]string, 0, len(table.Columns))
+					for _, column := range table.Columns {
+						columns = append(columns, fmt.Sprintf("%s (%s)", column.Name, column.Type))
+					}
+					fmt.Fprintf(&b, "| %s | %s |\n", table.Name, strings.Join(columns, ", "))
+				}
+			}
+		}
+	}
+	return b.String()
+}
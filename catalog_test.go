@@ -0,0 +1,202 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+const vendoredProviders = "vendor/github.com/cloudquery/cloudquery/providers"
+
+// The registry is kept by hand, so it is checked against what the vendored providers collect
+func TestResourceRegistry(t *testing.T) {
+	tests := []struct {
+		provider  string
+		collected func(t *testing.T) []string
+	}{
+		{provider: "aws", collected: func(t *testing.T) []string {
+			file := parseVendored(t, "aws/provider.go")
+			return serviceResources(t, "aws", append(literalKeys(t, file, "globalServices"), literalKeys(t, file, "regionalServices")...))
+		}},
+		{provider: "gcp", collected: func(t *testing.T) []string {
+			return serviceResources(t, "gcp", literalKeys(t, parseVendored(t, "gcp/provider.go"), "resourceFactory"))
+		}},
+		{provider: "azure", collected: func(t *testing.T) []string {
+			return literalKeys(t, parseVendored(t, "azure/provider.go"), "resourceFuncs")
+		}},
+		{provider: "okta", collected: func(t *testing.T) []string {
+			return switchCases(t, parseVendored(t, "okta/provider.go"), "Run")
+		}},
+		{provider: "k8s", collected: func(t *testing.T) []string {
+			return switchCases(t, parseVendored(t, "k8s/provider.go"), "Run")
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.provider, func(t *testing.T) {
+			collected := tt.collected(t)
+			sort.Strings(collected)
+			if supported := supportedResources(tt.provider); !reflect.DeepEqual(supported, collected) {
+				t.Errorf("resourceRegistry[%q] = %v, the provider collects %v", tt.provider, supported, collected)
+			}
+		})
+	}
+	var registered []string
+	for name := range resourceRegistry {
+		registered = append(registered, name)
+	}
+	sort.Strings(registered)
+	if names := providerNames(); !reflect.DeepEqual(registered, names) {
+		t.Errorf("resourceRegistry has providers %v, want %v", registered, names)
+	}
+}
+
+// aws and azure resources are migrated with the functions of the providers
+func TestResourceRegistryMigrations(t *testing.T) {
+	for _, provider := range []string{"aws", "azure"} {
+		t.Run(provider, func(t *testing.T) {
+			var registered []string
+			for _, migrate := range resourceRegistry[provider] {
+				registered = append(registered, runtime.FuncForPC(reflect.ValueOf(migrate).Pointer()).Name())
+			}
+			sort.Strings(registered)
+			migrations := literalFuncs(t, parseVendored(t, provider+"/provider.go"), "migrateFunctions")
+			sort.Strings(migrations)
+			if !reflect.DeepEqual(registered, migrations) {
+				t.Errorf("resourceRegistry[%q] migrates with %v, the provider with %v", provider, registered, migrations)
+			}
+		})
+	}
+}
+
+func TestAWSGlobalServices(t *testing.T) {
+	var global []string
+	for name, service := range awsServices {
+		if service.global {
+			global = append(global, name)
+		}
+	}
+	sort.Strings(global)
+	vendored := literalKeys(t, parseVendored(t, "aws/provider.go"), "globalServices")
+	sort.Strings(vendored)
+	if !reflect.DeepEqual(global, vendored) {
+		t.Errorf("awsServices has global services %v, the provider %v", global, vendored)
+	}
+}
+
+func parseVendored(t *testing.T, name string) *ast.File {
+	t.Helper()
+	file, err := parser.ParseFile(token.NewFileSet(), filepath.Join(vendoredProviders, name), nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// Returns {service}.{resource} for the cases of the CollectResource switch of every service
+func serviceResources(t *testing.T, provider string, services []string) []string {
+	var names []string
+	for _, service := range services {
+		for _, resource := range switchCases(t, parseVendored(t, path.Join(provider, service, "client.go")), "CollectResource") {
+			names = append(names, service+"."+resource)
+		}
+	}
+	return names
+}
+
+// Returns the composite literal assigned to a variable or field
+func literal(t *testing.T, file *ast.File, name string) *ast.CompositeLit {
+	t.Helper()
+	var found *ast.CompositeLit
+	ast.Inspect(file, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.ValueSpec:
+			if len(node.Names) == 1 && node.Names[0].Name == name && len(node.Values) == 1 {
+				found, _ = node.Values[0].(*ast.CompositeLit)
+			}
+		case *ast.AssignStmt:
+			if selector, ok := node.Lhs[0].(*ast.SelectorExpr); ok && selector.Sel.Name == name && len(node.Rhs) == 1 {
+				found, _ = node.Rhs[0].(*ast.CompositeLit)
+			}
+		}
+		return found == nil
+	})
+	if found == nil {
+		t.Fatalf("unable to find the literal of %s", name)
+	}
+	return found
+}
+
+// Returns the string keys of a map literal
+func literalKeys(t *testing.T, file *ast.File, name string) []string {
+	t.Helper()
+	var keys []string
+	for _, element := range literal(t, file, name).Elts {
+		keys = append(keys, stringLiteral(t, element.(*ast.KeyValueExpr).Key))
+	}
+	return keys
+}
+
+// Returns the qualified names of the functions of a slice literal, e.g.
+// github.com/cloudquery/cloudquery/providers/aws/ec2.MigrateVPCs
+func literalFuncs(t *testing.T, file *ast.File, name string) []string {
+	t.Helper()
+	imports := map[string]string{}
+	for _, spec := range file.Imports {
+		importPath, _ := strconv.Unquote(spec.Path.Value)
+		name := path.Base(importPath)
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+		imports[name] = importPath
+	}
+	var funcs []string
+	for _, element := range literal(t, file, name).Elts {
+		selector := element.(*ast.SelectorExpr)
+		funcs = append(funcs, imports[selector.X.(*ast.Ident).Name]+"."+selector.Sel.Name)
+	}
+	return funcs
+}
+
+// Returns the string cases of the switch statements of a function
+func switchCases(t *testing.T, file *ast.File, funcName string) []string {
+	t.Helper()
+	var cases []string
+	for _, decl := range file.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Name.Name != funcName {
+			continue
+		}
+		ast.Inspect(fn.Body, func(node ast.Node) bool {
+			if clause, ok := node.(*ast.CaseClause); ok {
+				for _, expr := range clause.List {
+					cases = append(cases, stringLiteral(t, expr))
+				}
+			}
+			return true
+		})
+	}
+	if len(cases) == 0 {
+		t.Fatalf("unable to find the switch of %s", funcName)
+	}
+	return cases
+}
+
+func stringLiteral(t *testing.T, expr ast.Expr) string {
+	t.Helper()
+	literal, ok := expr.(*ast.BasicLit)
+	if !ok || literal.Kind != token.STRING {
+		t.Fatalf("%T is not a string literal", expr)
+	}
+	value, err := strconv.Unquote(literal.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
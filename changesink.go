@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+const (
+	// SNS messages and EventBridge entries are limited to 256 KB
+	maxChangeEventSize = 256 * 1024
+	// Entries of a PutEvents call
+	eventBridgeBatchSize = 10
+	// Source and detail type of the change events put on an event bus
+	changeEventSource     = "cloudquery"
+	changeEventDetailType = "CloudQuery Resource Change"
+)
+
+// changeSink publishes the change events of the diff task
+type changeSink interface {
+	publish(events []ChangeEvent) error
+	close() error
+	String() string
+}
+
+// Returns the sink of the target: stdout (the default), file://<path>, which appends to the
+// file, sns:<topic arn> or eventbridge:<event bus name or arn>. Events are JSON, one per line
+// in a file. CLOUDQUERY_SNS_ENDPOINT and CLOUDQUERY_EVENTBRIDGE_ENDPOINT point the clients at
+// compatible endpoints.
+func newChangeSink(target string) (changeSink, error) {
+	switch {
+	case target == "" || target == "stdout":
+		return &writerSink{name: "stdout", w: bufio.NewWriter(os.Stdout)}, nil
+	case strings.HasPrefix(target, "file://"):
+		f, err := os.OpenFile(strings.TrimPrefix(target, "file://"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return &writerSink{name: target, w: bufio.NewWriter(f), file: f}, nil
+	case strings.HasPrefix(target, "sns:"):
+		sess, err := sharedAWSSession()
+		if err != nil {
+			return nil, err
+		}
+		return &snsSink{topic: strings.TrimPrefix(target, "sns:"), client: sns.New(sess, awsServiceConfig("sns"))}, nil
+	case strings.HasPrefix(target, "eventbridge:"):
+		sess, err := sharedAWSSession()
+		if err != nil {
+			return nil, err
+		}
+		return &eventBridgeSink{bus: strings.TrimPrefix(target, "eventbridge:"), client: eventbridge.New(sess, awsServiceConfig("eventbridge"))}, nil
+	}
+	return nil, fmt.Errorf("the diff sink should be stdout, file://<path>, sns:<topic arn> or eventbridge:<event bus>, not %q", target)
+}
+
+type writerSink struct {
+	name string
+	w    *bufio.Writer
+	file io.Closer
+}
+
+func (s *writerSink) publish(events []ChangeEvent) error {
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		_, err = s.w.Write(append(data, '\n'))
+		if err != nil {
+			return err
+		}
+	}
+	return s.w.Flush()
+}
+
+func (s *writerSink) close() error {
+	err := s.w.Flush()
+	if s.file != nil {
+		if closeErr := s.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (s *writerSink) String() string {
+	return s.name
+}
+
+// snsSink publishes every event as a message with the type and table as message attributes,
+// so subscriptions can filter on them
+type snsSink struct {
+	topic  string
+	client *sns.SNS
+}
+
+func (s *snsSink) publish(events []ChangeEvent) error {
+	for _, event := range events {
+		data, err := encodeChangeEvent(event)
+		if err != nil {
+			return err
+		}
+		_, err = s.client.Publish(&sns.PublishInput{
+			TopicArn: aws.String(s.topic),
+			Message:  aws.String(string(data)),
+			MessageAttributes: map[string]*sns.MessageAttributeValue{
+				"type":  {DataType: aws.String("String"), StringValue: aws.String(event.Type)},
+				"table": {DataType: aws.String("String"), StringValue: aws.String(event.Table)},
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *snsSink) close() error {
+	return nil
+}
+
+func (s *snsSink) String() string {
+	return "sns:" + s.topic
+}
+
+// eventBridgeSink puts the events on an event bus with the event as the detail
+type eventBridgeSink struct {
+	bus    string
+	client *eventbridge.EventBridge
+}
+
+func (s *eventBridgeSink) publish(events []ChangeEvent) error {
+	for start := 0; start < len(events); start += eventBridgeBatchSize {
+		end := start + eventBridgeBatchSize
+		if end > len(events) {
+			end = len(events)
+		}
+		var entries []*eventbridge.PutEventsRequestEntry
+		for _, event := range events[start:end] {
+			data, err := encodeChangeEvent(event)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, &eventbridge.PutEventsRequestEntry{
+				EventBusName: aws.String(s.bus),
+				Source:       aws.String(changeEventSource),
+				DetailType:   aws.String(changeEventDetailType),
+				Detail:       aws.String(string(data)),
+			})
+		}
+		output, err := s.client.PutEvents(&eventbridge.PutEventsInput{Entries: entries})
+		if err != nil {
+			return err
+		}
+		if aws.Int64Value(output.FailedEntryCount) > 0 {
+			for _, entry := range output.Entries {
+				if entry.ErrorCode != nil {
+					return fmt.Errorf("%d events weren't put on the bus: %s: %s", aws.Int64Value(output.FailedEntryCount),
+						aws.StringValue(entry.ErrorCode), aws.StringValue(entry.ErrorMessage))
+				}
+			}
+			return fmt.Errorf("%d events weren't put on the bus", aws.Int64Value(output.FailedEntryCount))
+		}
+	}
+	return nil
+}
+
+func (s *eventBridgeSink) close() error {
+	return nil
+}
+
+func (s *eventBridgeSink) String() string {
+	return "eventbridge:" + s.bus
+}
+
+// Encodes an event for a size limited message, leaving out the resource when it doesn't fit
+func encodeChangeEvent(event ChangeEvent) ([]byte, error) {
+	data, err := json.Marshal(event)
+	if err != nil || len(data) <= maxChangeEventSize {
+		return data, err
+	}
+	event.Resource, event.Truncated = nil, true
+	return json.Marshal(event)
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Points the AWS clients of the sinks at a local endpoint for the duration of the test
+func useSinkEndpoint(t *testing.T, service, url string) {
+	setenv(t, "CLOUDQUERY_"+strings.ToUpper(service)+"_ENDPOINT", url)
+	setenv(t, "AWS_REGION", "us-east-1")
+	setenv(t, "AWS_ACCESS_KEY_ID", "test")
+	setenv(t, "AWS_SECRET_ACCESS_KEY", "test")
+}
+
+func testChangeEvents(n int) []ChangeEvent {
+	events := make([]ChangeEvent, n)
+	for i := range events {
+		events[i] = ChangeEvent{
+			ID:       fmt.Sprintf("event-%d", i),
+			Type:     ChangeAdded,
+			Table:    "aws_ec2_instances",
+			FetchID:  "fetch-1",
+			Resource: map[string]interface{}{"instance_id": fmt.Sprintf("i-%d", i)},
+		}
+	}
+	return events
+}
+
+func TestNewChangeSink(t *testing.T) {
+	setenv(t, "AWS_REGION", "us-east-1")
+	setenv(t, "AWS_ACCESS_KEY_ID", "test")
+	setenv(t, "AWS_SECRET_ACCESS_KEY", "test")
+	dir, err := ioutil.TempDir("", "sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := "file://" + filepath.Join(dir, "changes.json")
+	tests := []struct {
+		target  string
+		want    string
+		wantErr bool
+	}{
+		{target: "", want: "stdout"},
+		{target: "stdout", want: "stdout"},
+		{target: file, want: file},
+		{target: "sns:arn:aws:sns:us-east-1:123456789012:changes", want: "sns:arn:aws:sns:us-east-1:123456789012:changes"},
+		{target: "eventbridge:default", want: "eventbridge:default"},
+		{target: "file://" + filepath.Join(dir, "missing", "changes.json"), wantErr: true},
+		{target: "sqs:changes", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			sink, err := newChangeSink(tt.target)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newChangeSink() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer sink.close()
+			if sink.String() != tt.want {
+				t.Errorf("newChangeSink() = %s, want %s", sink, tt.want)
+			}
+		})
+	}
+}
+
+// The file sink appends the events as JSON lines
+func TestWriterSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "changes.json")
+	for i := 0; i < 2; i++ {
+		sink, err := newChangeSink("file://" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = sink.publish(testChangeEvents(2))
+		if err == nil {
+			err = sink.close()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	events := readChangeEvents(t, path)
+	if len(events) != 4 || events[1].ID != "event-1" || events[2].ID != "event-0" {
+		t.Errorf("file sink wrote %+v, want the two events twice", events)
+	}
+}
+
+func TestEncodeChangeEvent(t *testing.T) {
+	event := testChangeEvents(1)[0]
+	data, err := encodeChangeEvent(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded ChangeEvent
+	if err = json.Unmarshal(data, &decoded); err != nil || decoded.Truncated || decoded.Resource["instance_id"] != "i-0" {
+		t.Errorf("encodeChangeEvent() = %s, want the whole event", data)
+	}
+
+	event.Resource = map[string]interface{}{"user_data": strings.Repeat("a", maxChangeEventSize)}
+	data, err = encodeChangeEvent(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded = ChangeEvent{}
+	if err = json.Unmarshal(data, &decoded); err != nil || !decoded.Truncated || decoded.Resource != nil || decoded.ID != "event-0" {
+		t.Errorf("encodeChangeEvent() of a large event = %.200s, want it without the resource", data)
+	}
+	if len(data) > maxChangeEventSize {
+		t.Errorf("encodeChangeEvent() of a large event = %d bytes, want at most %d", len(data), maxChangeEventSize)
+	}
+}
+
+// snsStub answers Publish calls of the SNS query API and records their messages
+type snsStub struct {
+	lock       sync.Mutex
+	messages   []string
+	attributes []map[string]string
+	fail       bool
+}
+
+func (s *snsStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	err := r.ParseForm()
+	if err != nil || r.Form.Get("Action") != "Publish" || r.Form.Get("TopicArn") != "arn:aws:sns:us-east-1:123456789012:changes" {
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+	if s.fail {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`<ErrorResponse><Error><Type>Sender</Type><Code>NotFound</Code><Message>Topic does not exist</Message></Error></ErrorResponse>`))
+		return
+	}
+	attributes := map[string]string{}
+	for i := 1; r.Form.Get(fmt.Sprintf("MessageAttributes.entry.%d.Name", i)) != ""; i++ {
+		name := r.Form.Get(fmt.Sprintf("MessageAttributes.entry.%d.Name", i))
+		attributes[name] = r.Form.Get(fmt.Sprintf("MessageAttributes.entry.%d.Value.StringValue", i))
+	}
+	s.messages = append(s.messages, r.Form.Get("Message"))
+	s.attributes = append(s.attributes, attributes)
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprintf(w, `<PublishResponse><PublishResult><MessageId>%d</MessageId></PublishResult></PublishResponse>`, len(s.messages))
+}
+
+func TestSNSSink(t *testing.T) {
+	stub := &snsStub{}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	useSinkEndpoint(t, "sns", server.URL)
+	sink, err := newChangeSink("sns:arn:aws:sns:us-east-1:123456789012:changes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := testChangeEvents(3)
+	events[2].Type = ChangeRemoved
+	events[2].Resource = map[string]interface{}{"user_data": strings.Repeat("a", maxChangeEventSize)}
+	err = sink.publish(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stub.messages) != 3 {
+		t.Fatalf("SNS got %d messages, want one per event", len(stub.messages))
+	}
+	wantAttributes := map[string]string{"type": ChangeRemoved, "table": "aws_ec2_instances"}
+	if !reflect.DeepEqual(stub.attributes[2], wantAttributes) {
+		t.Errorf("message attributes = %v, want %v", stub.attributes[2], wantAttributes)
+	}
+	var event ChangeEvent
+	if err = json.Unmarshal([]byte(stub.messages[0]), &event); err != nil || event.ID != "event-0" || event.Resource["instance_id"] != "i-0" {
+		t.Errorf("first message = %s, want event-0", stub.messages[0])
+	}
+	if err = json.Unmarshal([]byte(stub.messages[2]), &event); err != nil || !event.Truncated {
+		t.Errorf("message of a large event = %.200s, want it truncated", stub.messages[2])
+	}
+
+	stub.fail = true
+	err = sink.publish(events)
+	if err == nil || !strings.Contains(err.Error(), "NotFound") {
+		t.Errorf("publish() to a missing topic error = %v, want NotFound", err)
+	}
+}
+
+// eventBridgeStub answers PutEvents calls and records the size of every batch. The entries of
+// the events listed in failed are reported as failed.
+type eventBridgeStub struct {
+	lock    sync.Mutex
+	batches []int
+	details []string
+	failed  map[string]bool
+}
+
+func (s *eventBridgeStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var input struct {
+		Entries []struct {
+			EventBusName string
+			Source       string
+			DetailType   string
+			Detail       string
+		}
+	}
+	err := json.NewDecoder(r.Body).Decode(&input)
+	if err != nil || r.Header.Get("X-Amz-Target") != "AWSEvents.PutEvents" {
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+	s.batches = append(s.batches, len(input.Entries))
+	type resultEntry struct {
+		EventId      string `json:",omitempty"`
+		ErrorCode    string `json:",omitempty"`
+		ErrorMessage string `json:",omitempty"`
+	}
+	output := struct {
+		FailedEntryCount int
+		Entries          []resultEntry
+	}{}
+	for _, entry := range input.Entries {
+		var event ChangeEvent
+		_ = json.Unmarshal([]byte(entry.Detail), &event)
+		if entry.EventBusName != "changes" || entry.Source != changeEventSource || entry.DetailType != changeEventDetailType {
+			http.Error(w, "unexpected entry", http.StatusBadRequest)
+			return
+		}
+		if s.failed[event.ID] {
+			output.FailedEntryCount++
+			output.Entries = append(output.Entries, resultEntry{ErrorCode: "InternalFailure", ErrorMessage: "try again"})
+			continue
+		}
+		s.details = append(s.details, entry.Detail)
+		output.Entries = append(output.Entries, resultEntry{EventId: event.ID})
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	json.NewEncoder(w).Encode(output)
+}
+
+func TestEventBridgeSink(t *testing.T) {
+	stub := &eventBridgeStub{}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	useSinkEndpoint(t, "eventbridge", server.URL)
+	sink, err := newChangeSink("eventbridge:changes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sink.publish(testChangeEvents(23))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{10, 10, 3}; !reflect.DeepEqual(stub.batches, want) {
+		t.Errorf("PutEvents batches = %v, want %v", stub.batches, want)
+	}
+	var event ChangeEvent
+	if err = json.Unmarshal([]byte(stub.details[22]), &event); err != nil || event.ID != "event-22" {
+		t.Errorf("last detail = %s, want event-22", stub.details[22])
+	}
+
+	stub.batches = nil
+	stub.failed = map[string]bool{"event-12": true}
+	err = sink.publish(testChangeEvents(23))
+	if err == nil || !strings.Contains(err.Error(), "1 events weren't put on the bus: InternalFailure") {
+		t.Errorf("publish() with a failed entry error = %v, want the failed entry", err)
+	}
+	if want := []int{10, 10}; !reflect.DeepEqual(stub.batches, want) {
+		t.Errorf("PutEvents batches = %v, want it to stop after the failed batch %v", stub.batches, want)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const defaultDeadlineReserve = time.Minute
+
+// Checkpoints older than this are removed when a run completes
+const checkpointRetention = 7 * 24 * time.Hour
+
+// Checkpoint records a unit of a run that finished, so a resumed run can skip it
+type Checkpoint struct {
+	ID          uint   `gorm:"primarykey"`
+	RunID       string `gorm:"index"`
+	Provider    string
+	Account     string
+	Region      string
+	Resource    string
+	CompletedAt time.Time
+}
+
+func (Checkpoint) TableName() string {
+	return "cloudquery_checkpoints"
+}
+
+// fetchUnit is the granularity of checkpoints. Providers other than aws are checkpointed per
+// resource with an empty account and region. Global aws resources have an empty region.
+type fetchUnit struct {
+	Provider string
+	Account  string
+	Region   string
+	Resource string
+}
+
+// continuationToken is handed out when a fetch stops before its deadline
+type continuationToken struct {
+	RunID string `json:"runId"`
+}
+
+func encodeContinuationToken(runID string) string {
+	data, _ := json.Marshal(continuationToken{RunID: runID})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeContinuationToken(token string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", fmt.Errorf("invalid continuation token: %w", err)
+	}
+	var t continuationToken
+	err = json.Unmarshal(data, &t)
+	if err != nil || t.RunID == "" {
+		return "", fmt.Errorf("invalid continuation token")
+	}
+	return t.RunID, nil
+}
+
+func newRunID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// fetchRun tracks the deadline and checkpoints of a single fetch invocation
+type fetchRun struct {
+	ctx       context.Context
+	id        string
+	db        *gorm.DB
+	log       *zap.Logger
+	reserve   time.Duration
+	lock      sync.Mutex
+	completed map[fetchUnit]bool
+	stopped   bool
+	// the schema was migrated by the migrate task, see checkSchema
+	skipMigrations bool
+	// the versioned tables of the providers of the run, and the scopes of the units that
+	// haven't finished yet by table, see snapshot.go
+	tables map[string]bool
+	scopes map[string][]FetchScope
+	// set when the finished units are exported, see export.go, along with the primary keys of the
+	// rows the units that haven't finished yet wrote by table
+	export  *exporter
+	written map[string][]interface{}
+}
+
+// Starts a new run with the given ID, or a generated one, or resumes the run of the continuation token
+func newFetchRun(ctx context.Context, db *gorm.DB, log *zap.Logger, runID, token string, shard *Shard, skipMigrations bool) (*fetchRun, error) {
+	if !skipMigrations {
+		err := db.AutoMigrate(&Checkpoint{}, &FetchRecord{}, &FetchScope{})
+		if err != nil {
+			return nil, err
+		}
+	}
+	run := fetchRun{
+		ctx:            ctx,
+		id:             newRunID(),
+		db:             db,
+		log:            log,
+		reserve:        deadlineReserve(),
+		completed:      map[fetchUnit]bool{},
+		skipMigrations: skipMigrations,
+		tables:         map[string]bool{},
+		scopes:         map[string][]FetchScope{},
+		written:        map[string][]interface{}{},
+	}
+	if token == "" {
+		if runID != "" {
+			run.id = runID
+		}
+		return &run, nil
+	}
+	var err error
+	run.id, err = decodeContinuationToken(token)
+	if err != nil {
+		return nil, newTaskError(ErrorTypeInvalidRequest, err)
+	}
+	err = checkResumable(db, run.id, shard)
+	if err != nil {
+		return nil, err
+	}
+	var checkpoints []Checkpoint
+	err = db.Where("run_id = ?", run.id).Find(&checkpoints).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range checkpoints {
+		run.completed[fetchUnit{Provider: c.Provider, Account: c.Account, Region: c.Region, Resource: c.Resource}] = true
+	}
+	log.Info("Resuming run", zap.String("run_id", run.id), zap.Int("completed", len(checkpoints)))
+	return &run, nil
+}
+
+// Only a run of the same shard that stopped at its deadline can be resumed. The token of an
+// unknown run, e.g. one of another database, of a finished run or of a run whose checkpoints and
+// rows were already removed as abandoned would fetch everything again under its ID.
+func checkResumable(db *gorm.DB, runID string, shard *Shard) error {
+	var records []FetchRecord
+	err := db.Where("id = ?", runID).Limit(1).Find(&records).Error
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return newTaskError(ErrorTypeInvalidRequest, fmt.Errorf("continuation token of unknown run %s", runID))
+	}
+	record := records[0]
+	if record.Status != StatusRunning {
+		return newTaskError(ErrorTypeInvalidRequest, fmt.Errorf("run %s already finished as %s", runID, record.Status))
+	}
+	if record.StartedAt.Before(time.Now().UTC().Add(-checkpointRetention)) {
+		return newTaskError(ErrorTypeInvalidRequest, fmt.Errorf("run %s was abandoned, it started at %s", runID,
+			record.StartedAt.Format(time.RFC3339)))
+	}
+	var want string
+	if shard != nil {
+		want = shard.String()
+	}
+	if record.Shard != want {
+		return newTaskError(ErrorTypeInvalidRequest, fmt.Errorf("continuation token of run %s is for shard %q, not %q",
+			runID, record.Shard, want))
+	}
+	return nil
+}
+
+// Time kept free before the Lambda deadline. Set by CLOUDQUERY_DEADLINE_RESERVE, e.g. 90s
+func deadlineReserve() time.Duration {
+	if env := os.Getenv("CLOUDQUERY_DEADLINE_RESERVE"); env != "" {
+		if d, err := time.ParseDuration(env); err == nil {
+			return d
+		}
+	}
+	return defaultDeadlineReserve
+}
+
+// Reports whether new units should no longer be started because the deadline is close
+func (r *fetchRun) shouldStop() bool {
+	if r == nil {
+		return false
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.stopped {
+		return true
+	}
+	if r.ctx.Err() != nil {
+		r.stopped = true
+	} else if deadline, ok := r.ctx.Deadline(); ok && time.Until(deadline) < r.reserve {
+		r.stopped = true
+	}
+	if r.stopped {
+		r.log.Warn("Deadline is close. Not starting any more resources", zap.String("run_id", r.id))
+	}
+	return r.stopped
+}
+
+func (r *fetchRun) skipsMigrations() bool {
+	return r != nil && r.skipMigrations
+}
+
+func (r *fetchRun) isStopped() bool {
+	if r == nil {
+		return false
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.stopped
+}
+
+func (r *fetchRun) isCompleted(unit fetchUnit) bool {
+	if r == nil {
+		return false
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.completed[unit]
+}
+
+// Records a finished unit in the checkpoint table along with the scopes it fetched
+func (r *fetchRun) complete(unit fetchUnit) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	r.completed[unit] = true
+	r.lock.Unlock()
+	r.commitScopes(unit)
+	err := r.db.Create(&Checkpoint{
+		RunID:       r.id,
+		Provider:    unit.Provider,
+		Account:     unit.Account,
+		Region:      unit.Region,
+		Resource:    unit.Resource,
+		CompletedAt: time.Now().UTC(),
+	}).Error
+	if err != nil {
+		r.log.Error("Unable to record checkpoint", zap.String("run_id", r.id), zap.Error(err))
+	}
+}
+
+// Removes the checkpoints of a finished run and any stale ones left by abandoned runs
+func (r *fetchRun) cleanup() {
+	err := r.db.Where("run_id = ? OR completed_at < ?", r.id, time.Now().UTC().Add(-checkpointRetention)).
+		Delete(&Checkpoint{}).Error
+	if err != nil {
+		r.log.Error("Unable to remove checkpoints", zap.String("run_id", r.id), zap.Error(err))
+	}
+}
+
+// Providers that implement runAware are handed the run before Run is called, so they can
+// checkpoint individual units and stop at the deadline.
+type runAware interface {
+	setRun(run *fetchRun)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// Returns the path of a sqlite database in a temporary directory that is removed with the test
+func testSQLiteDSN(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "cloudquery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsn := filepath.Join(dir, "test.db")
+	t.Cleanup(func() {
+		forgetDB("sqlite", dsn)
+		os.RemoveAll(dir)
+	})
+	return dsn
+}
+
+// Opens a sqlite database that is removed with the test
+func openTestDB(t *testing.T) *gorm.DB {
+	db, err := openDB("sqlite", testSQLiteDSN(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestContinuationToken(t *testing.T) {
+	runID, err := decodeContinuationToken(encodeContinuationToken("run-1"))
+	if err != nil || runID != "run-1" {
+		t.Errorf("decodeContinuationToken() = %q, %v, want run-1", runID, err)
+	}
+	for _, token := range []string{"not base64!", "bm90IGpzb24", "e30"} {
+		if _, err := decodeContinuationToken(token); err == nil {
+			t.Errorf("decodeContinuationToken(%q) succeeded, want an error", token)
+		}
+	}
+}
+
+// A run that stopped at its deadline is resumed with its checkpoints, so only the units it didn't
+// finish are fetched again
+func TestResumeFetchRun(t *testing.T) {
+	db := openTestDB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	shard := &Shard{Provider: "aws", Account: "111111111111", Region: "us-east-1", Resources: []string{"ec2.instances", "ec2.vpcs"}}
+	run, err := newFetchRun(ctx, db, zap.NewNop(), "run-1", "", shard, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = run.start(shard, []string{"aws"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	instances := fetchUnit{Provider: "aws", Account: "111111111111", Region: "us-east-1", Resource: "ec2.instances"}
+	vpcs := fetchUnit{Provider: "aws", Account: "111111111111", Region: "us-east-1", Resource: "ec2.vpcs"}
+	run.complete(instances)
+	cancel()
+	if !run.shouldStop() {
+		t.Fatal("shouldStop() = false after the context was canceled, want true")
+	}
+	token := encodeContinuationToken(run.id)
+
+	resumed, err := newFetchRun(context.Background(), db, zap.NewNop(), "", token, shard, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.id != "run-1" {
+		t.Errorf("resumed run ID = %q, want run-1", resumed.id)
+	}
+	if !resumed.isCompleted(instances) || resumed.isCompleted(vpcs) {
+		t.Errorf("resumed run completed %v, want only %+v", resumed.completed, instances)
+	}
+	if resumed.shouldStop() {
+		t.Error("resumed run shouldStop() = true, want false")
+	}
+
+	// the checkpoints of the run are removed when it finishes, its token can't be used again
+	resumed.complete(vpcs)
+	err = resumed.finish(StatusSucceeded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumed.cleanup()
+	var checkpoints int64
+	db.Model(&Checkpoint{}).Where("run_id = ?", "run-1").Count(&checkpoints)
+	if checkpoints != 0 {
+		t.Errorf("%d checkpoints left after cleanup, want none", checkpoints)
+	}
+	_, err = newFetchRun(context.Background(), db, zap.NewNop(), "", token, shard, false)
+	if errorType(err) != ErrorTypeInvalidRequest {
+		t.Errorf("newFetchRun() with the token of a finished run error = %v, want an %s error", err, ErrorTypeInvalidRequest)
+	}
+}
+
+func TestResumeFetchRunRejectsTokens(t *testing.T) {
+	db := openTestDB(t)
+	shard := &Shard{Provider: "aws", Account: "111111111111", Region: "us-east-1"}
+	err := db.AutoMigrate(&Checkpoint{}, &FetchRecord{}, &FetchScope{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := []FetchRecord{
+		{ID: "running", Shard: shard.String(), Status: StatusRunning, StartedAt: time.Now().UTC()},
+		{ID: "finished", Shard: shard.String(), Status: StatusPartial, StartedAt: time.Now().UTC()},
+		{ID: "abandoned", Shard: shard.String(), Status: StatusRunning, StartedAt: time.Now().UTC().Add(-checkpointRetention - time.Hour)},
+	}
+	err = db.Create(&records).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		shard   *Shard
+		wantErr bool
+	}{
+		{name: "stopped run", token: encodeContinuationToken("running"), shard: shard},
+		{name: "malformed", token: "not a token", shard: shard, wantErr: true},
+		{name: "unknown run", token: encodeContinuationToken("other-database"), shard: shard, wantErr: true},
+		{name: "finished run", token: encodeContinuationToken("finished"), shard: shard, wantErr: true},
+		{name: "abandoned run", token: encodeContinuationToken("abandoned"), shard: shard, wantErr: true},
+		{
+			name:    "other shard",
+			token:   encodeContinuationToken("running"),
+			shard:   &Shard{Provider: "aws", Account: "111111111111", Region: "eu-west-1"},
+			wantErr: true,
+		},
+		{name: "whole config", token: encodeContinuationToken("running"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newFetchRun(context.Background(), db, zap.NewNop(), "", tt.token, tt.shard, true)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newFetchRun() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && errorType(err) != ErrorTypeInvalidRequest {
+				t.Errorf("newFetchRun() error type = %s, want %s", errorType(err), ErrorTypeInvalidRequest)
+			}
+		})
+	}
+}
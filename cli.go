@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// Runs a task from the command line and returns the exit code. The flags are turned into the
+// same payload the Lambda handler receives, so local runs take the production code path.
+func runCLI(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		printUsage(stderr)
+		return 2
+	}
+	taskName := args[0]
+	if taskName == "serve" {
+		return runServe(args[1:], stderr)
+	}
+	if _, ok := taskRegistry[taskName]; !ok {
+		fmt.Fprintf(stderr, "unknown task %q\n\n", taskName)
+		printUsage(stderr)
+		return 2
+	}
+
+	flags := newCLIFlags(taskName, stderr)
+	err := parseFlags(flags, args[1:], stderr)
+	if err != nil {
+		return 2
+	}
+	payload, err := cliPayload(taskName, flags)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	DRIVER, _ = flags.GetString("driver")
+	DSN, _ = flags.GetString("dsn")
+	VERBOSE, _ = flags.GetBool("verbose")
+
+	resp, err := handle(context.Background(), payload)
+	output, _ := flags.GetString("output")
+	if resp != nil {
+		switch {
+		case output == "markdown" && resp.Markdown != "":
+			fmt.Fprint(stdout, resp.Markdown)
+		case output == "json":
+			out, encodeErr := json.MarshalIndent(resp, "", "  ")
+			if encodeErr != nil {
+				fmt.Fprintf(stderr, "unable to encode response: %s\n", encodeErr)
+				return 1
+			}
+			fmt.Fprintln(stdout, string(out))
+		default:
+			printText(stdout, resp)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "task %s failed: %s\n", taskName, err)
+		return 1
+	}
+	if resp.Validation != nil && !resp.Validation.Valid {
+		return 1
+	}
+	return 0
+}
+
+func newCLIFlags(taskName string, stderr io.Writer) *pflag.FlagSet {
+	flags := pflag.NewFlagSet(taskName, pflag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.String("config", "", "location of the config: a path, file://, s3://, ssm: or http(s) URL. defaults to CLOUDQUERY_CONFIG or config.yml")
+	flags.String("policy", "", "path of the policy file. defaults to policy.yml")
+	flags.String("driver", DRIVER, "database driver: sqlite, postgresql, mysql, sqlserver or rds-data-api. defaults to CLOUDQUERY_DRIVER")
+	flags.String("dsn", DSN, "database connection string. defaults to CLOUDQUERY_DATABASE_STRING")
+	flags.BoolP("verbose", "v", VERBOSE, "log debug messages")
+	flags.StringP("output", "o", "json", "output format: json, text or markdown (list-resources)")
+	flags.String("sink", "", "where the diff task publishes change events: stdout, file://<path>, sns:<topic arn> or eventbridge:<event bus>. defaults to CLOUDQUERY_DIFF_SINK")
+	flags.String("export", "", "also write the fetched rows as JSON lines to s3://bucket/prefix or file:///path. defaults to CLOUDQUERY_EXPORT")
+	flags.String("shard", "", "only fetch a single shard, e.g. aws/123456789012/us-east-1[ec2.instances]")
+	flags.String("payload", "", "JSON payload with any other request fields, e.g. '{\"continuationToken\": \"...\"}'")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: ./main %s [flags] [config]\n\n%s\n\nFlags:\n%s", taskName,
+			taskRegistry[taskName].Description, flags.FlagUsages())
+	}
+	return flags
+}
+
+// Parses the arguments and prints the error along with the usage. A flag set that continues on
+// errors only prints the usage of --help itself.
+func parseFlags(flags *pflag.FlagSet, args []string, stderr io.Writer) error {
+	err := flags.Parse(args)
+	if err != nil && err != pflag.ErrHelp {
+		fmt.Fprintf(stderr, "%s\n\n", err)
+		flags.Usage()
+	}
+	return err
+}
+
+// Builds the invocation payload from the flags. A positional argument is the config location.
+func cliPayload(taskName string, flags *pflag.FlagSet) ([]byte, error) {
+	fields := map[string]interface{}{}
+	if raw, _ := flags.GetString("payload"); raw != "" {
+		err := json.Unmarshal([]byte(raw), &fields)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --payload: %w", err)
+		}
+	}
+	fields["taskName"] = taskName
+	config, _ := flags.GetString("config")
+	if config == "" && flags.NArg() > 0 {
+		config = flags.Arg(0)
+	}
+	if config != "" {
+		fields["config"] = config
+	}
+	if policy, _ := flags.GetString("policy"); policy != "" {
+		fields["policy"] = policy
+	}
+	if sink, _ := flags.GetString("sink"); sink != "" {
+		fields["sink"] = sink
+	}
+	if export, _ := flags.GetString("export"); export != "" {
+		fields["export"] = export
+	}
+	if value, _ := flags.GetString("shard"); value != "" {
+		shard, err := parseShard(value)
+		if err != nil {
+			return nil, err
+		}
+		fields["shard"] = shard
+	}
+	switch output, _ := flags.GetString("output"); output {
+	case "markdown":
+		fields["format"] = "markdown"
+	case "json", "text":
+	default:
+		return nil, fmt.Errorf("unknown output %s. valid outputs are: json, text, markdown", output)
+	}
+	return json.Marshal(fields)
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: ./main [TASK] [flags]\n\nTasks:\n")
+	for _, name := range taskNames() {
+		fmt.Fprintf(w, "  %-16s %s\n", name, taskRegistry[name].Description)
+	}
+	fmt.Fprintf(w, "  %-16s %s\n", "serve", "Emulates the Lambda invoke API locally, see ./main serve --help")
+	fmt.Fprintf(w, "\nRun ./main [TASK] --help for the flags of a task\n")
+}
+
+// Prints a short human readable summary of a response
+func printText(w io.Writer, resp *Response) {
+	fmt.Fprintf(w, "%s %s in %dms\n", resp.TaskName, resp.Status, resp.DurationMs)
+	if resp.Error != nil {
+		fmt.Fprintf(w, "error: %s: %s\n", resp.Error.Type, resp.Error.Message)
+	}
+	for _, provider := range resp.Providers {
+		fmt.Fprintf(w, "provider %s: %s%s\n", provider.Name, provider.Status, textDetail(provider.Error))
+	}
+	for _, resource := range resp.Resources {
+		location := strings.Trim(strings.Join([]string{resource.Account, resource.Region}, "/"), "/")
+		if location != "" {
+			location = " " + location
+		}
+		fmt.Fprintf(w, "resource %s%s %s: %s%s\n", resource.Provider, location, resource.Resource,
+			resource.Status, textDetail(resource.Error))
+	}
+	for _, shard := range resp.Shards {
+		name := "unknown"
+		if shard.Shard != nil {
+			name = shard.Shard.String()
+		}
+		fmt.Fprintf(w, "shard %s: %s%s\n", name, shard.Status, textDetail(shard.Error))
+	}
+	for _, req := range resp.Plan {
+		if req.Shard != nil {
+			fmt.Fprintf(w, "plan %s\n", req.Shard)
+		}
+	}
+	if resp.Policy != nil {
+		for _, query := range resp.Policy.Queries {
+			result := "PASS"
+			if !query.Passed {
+				result = "FAIL"
+			}
+			fmt.Fprintf(w, "%s %s (%d rows)%s\n", result, query.Name, query.Count, textDetail(query.Error))
+		}
+	}
+	if resp.Validation != nil {
+		for _, problem := range resp.Validation.Problems {
+			fmt.Fprintf(w, "%s:%d:%d: %s\n", resp.Validation.Path, problem.Line, problem.Column, problem.Message)
+		}
+	}
+	if resp.Export != nil {
+		fmt.Fprintf(w, "export %s: %d objects, %d rows%s\n", resp.Export.Destination, resp.Export.Objects, resp.Export.Rows,
+			textDetail(resp.Export.Error))
+	}
+	if resp.SQLiteSnapshot != "" {
+		fmt.Fprintf(w, "sqlite snapshot: %s\n", resp.SQLiteSnapshot)
+	}
+	if resp.Diff != nil {
+		for _, fetch := range resp.Diff.Fetches {
+			switch {
+			case fetch.Error != "":
+				fmt.Fprintf(w, "fetch %s: failed (%s)\n", fetch.FetchID, fetch.Error)
+			case fetch.Baseline:
+				fmt.Fprintf(w, "fetch %s: baseline\n", fetch.FetchID)
+			default:
+				fmt.Fprintf(w, "fetch %s: %d tables\n", fetch.FetchID, len(fetch.Tables))
+			}
+			for _, table := range fetch.Tables {
+				if table.Added+table.Removed+table.Modified > 0 {
+					fmt.Fprintf(w, "  %s: %d added, %d removed, %d modified\n", table.Table, table.Added, table.Removed, table.Modified)
+				}
+			}
+		}
+	}
+	for _, provider := range resp.Catalog {
+		for _, service := range provider.Services {
+			for _, resource := range service.Resources {
+				tables := make([]string, 0, len(resource.Tables))
+				for _, table := range resource.Tables {
+					tables = append(tables, table.Name)
+				}
+				fmt.Fprintf(w, "%s %s: %s\n", provider.Name, resource.Name, strings.Join(tables, ", "))
+			}
+		}
+	}
+	if resp.ContinuationToken != "" {
+		fmt.Fprintf(w, "continuation token: %s\n", resp.ContinuationToken)
+	}
+}
+
+func textDetail(message string) string {
+	if message == "" {
+		return ""
+	}
+	return " (" + message + ")"
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCLIPayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		task    string
+		args    []string
+		want    map[string]interface{}
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			task: "fetch",
+			want: map[string]interface{}{"taskName": "fetch"},
+		},
+		{
+			name: "positional config",
+			task: "fetch",
+			args: []string{"s3://bucket/config.yml"},
+			want: map[string]interface{}{"taskName": "fetch", "config": "s3://bucket/config.yml"},
+		},
+		{
+			name: "config flag wins over the positional argument",
+			task: "fetch",
+			args: []string{"--config", "ssm:/cloudquery/config", "config.yml"},
+			want: map[string]interface{}{"taskName": "fetch", "config": "ssm:/cloudquery/config"},
+		},
+		{
+			name: "request fields",
+			task: "diff",
+			args: []string{"--policy=policy.yml", "--sink", "file:///tmp/changes", "--export", "s3://bucket/export", "-v"},
+			want: map[string]interface{}{
+				"taskName": "diff",
+				"policy":   "policy.yml",
+				"sink":     "file:///tmp/changes",
+				"export":   "s3://bucket/export",
+			},
+		},
+		{
+			name: "shard",
+			task: "fetch",
+			args: []string{"--shard", "aws/123456789012/us-east-1[ec2.instances]"},
+			want: map[string]interface{}{
+				"taskName": "fetch",
+				"shard": map[string]interface{}{
+					"provider":  "aws",
+					"account":   "123456789012",
+					"region":    "us-east-1",
+					"resources": []interface{}{"ec2.instances"},
+				},
+			},
+		},
+		{
+			name: "payload fields are kept, flags and the task name win",
+			task: "fetch",
+			args: []string{"--payload", `{"taskName": "policy", "continuationToken": "abc", "config": "other.yml"}`, "--config", "config.yml"},
+			want: map[string]interface{}{"taskName": "fetch", "continuationToken": "abc", "config": "config.yml"},
+		},
+		{
+			name: "markdown output",
+			task: "list-resources",
+			args: []string{"-o", "markdown"},
+			want: map[string]interface{}{"taskName": "list-resources", "format": "markdown"},
+		},
+		{
+			name: "text output",
+			task: "fetch",
+			args: []string{"--output", "text"},
+			want: map[string]interface{}{"taskName": "fetch"},
+		},
+		{name: "unknown flag", task: "fetch", args: []string{"--regions", "us-east-1"}, wantErr: "unknown flag: --regions"},
+		{name: "missing flag value", task: "fetch", args: []string{"--dsn"}, wantErr: "flag needs an argument"},
+		{name: "invalid payload", task: "fetch", args: []string{"--payload", "{"}, wantErr: "invalid --payload"},
+		{name: "invalid shard", task: "fetch", args: []string{"--shard", "aws[ec2.instances"}, wantErr: "aws[ec2.instances"},
+		{name: "unknown output", task: "fetch", args: []string{"-o", "yaml"}, wantErr: "unknown output yaml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stderr bytes.Buffer
+			flags := newCLIFlags(tt.task, &stderr)
+			err := flags.Parse(tt.args)
+			var payload []byte
+			if err == nil {
+				payload, err = cliPayload(tt.task, flags)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("cliPayload() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got map[string]interface{}
+			err = json.Unmarshal(payload, &got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("cliPayload() = %v, want %v", got, tt.want)
+			}
+			var req Request
+			err = json.Unmarshal(payload, &req)
+			if err != nil {
+				t.Errorf("cliPayload() isn't a valid request: %s", err)
+			}
+		})
+	}
+}
+
+func TestRunCLIUsage(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		wantStderr string
+	}{
+		{name: "no task", wantStderr: "Usage: ./main [TASK]"},
+		{name: "help", args: []string{"help"}, wantStderr: "Usage: ./main [TASK]"},
+		{name: "unknown task", args: []string{"fetchall"}, wantStderr: `unknown task "fetchall"`},
+		{name: "task help", args: []string{"fetch", "--help"}, wantStderr: "Usage: ./main fetch [flags] [config]"},
+		{name: "unknown flag", args: []string{"fetch", "--regions"}, wantStderr: "unknown flag: --regions"},
+		{name: "unknown output", args: []string{"fetch", "-o", "yaml"}, wantStderr: "unknown output yaml"},
+		{name: "unknown serve flag", args: []string{"serve", "--port", "8080"}, wantStderr: "unknown flag: --port"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if code := runCLI(tt.args, &stdout, &stderr); code != 2 {
+				t.Errorf("runCLI() = %d, want 2", code)
+			}
+			if !strings.Contains(stderr.String(), tt.wantStderr) {
+				t.Errorf("runCLI() stderr = %q, want %q", stderr.String(), tt.wantStderr)
+			}
+			if stdout.Len() > 0 {
+				t.Errorf("runCLI() stdout = %q, want nothing", stdout.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+const defaultConfigPath = "config.yml"
+
+const (
+	// Inline providers replace config.yml entirely
+	ProvidersModeOverride = "override"
+	// Inline providers are merged key by key onto the config.yml provider with the same name
+	ProvidersModeMerge = "merge"
+)
+
+// Config has the same shape as cloudqueryclient.Config
+type Config struct {
+	Providers []ProviderConfig `json:"providers"`
+}
+
+// ProviderConfig is a single entry of the providers list. Every key except name is kept in Rest
+// and decoded by the provider itself.
+type ProviderConfig struct {
+	Name string
+	Rest map[string]interface{} `yaml:",inline"`
+}
+
+func (p *ProviderConfig) UnmarshalJSON(data []byte) error {
+	var rest map[string]interface{}
+	err := json.Unmarshal(data, &rest)
+	if err != nil {
+		return err
+	}
+	name, ok := rest["name"].(string)
+	if !ok {
+		return fmt.Errorf("provider must contain key: name")
+	}
+	delete(rest, "name")
+	p.Name = name
+	p.Rest = rest
+	return nil
+}
+
+func (p ProviderConfig) MarshalJSON() ([]byte, error) {
+	flat := make(map[string]interface{}, len(p.Rest)+1)
+	for k, v := range p.Rest {
+		flat[k] = v
+	}
+	flat["name"] = p.Name
+	return json.Marshal(flat)
+}
+
+// Loads a config in the cloudqueryclient.Config format from any location supported by readSource
+func loadConfig(location string) (*Config, error) {
+	data, err := readSource(location)
+	if err != nil {
+		return nil, err
+	}
+
+	config := Config{}
+	err = yaml.Unmarshal(data, &config)
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Builds the config for a fetch from config.yml and the providers passed in the request
+func resolveConfig(req *Request) (*Config, error) {
+	mode := req.ProvidersMode
+	if mode == "" {
+		mode = ProvidersModeOverride
+	}
+	switch mode {
+	case ProvidersModeOverride:
+		if len(req.Providers) > 0 {
+			return &Config{Providers: req.Providers}, nil
+		}
+		return loadConfig(configLocation(req))
+	case ProvidersModeMerge:
+		config, err := loadConfig(configLocation(req))
+		if err != nil {
+			return nil, err
+		}
+		return mergeProviders(config, req.Providers), nil
+	default:
+		return nil, fmt.Errorf("unknown providersMode %s. valid modes are: %s, %s", mode, ProvidersModeOverride, ProvidersModeMerge)
+	}
+}
+
+// Merges the overrides onto the providers of the base config. Keys of an override replace the
+// same keys of the base provider with the same name, providers missing from the base are appended.
+func mergeProviders(base *Config, overrides []ProviderConfig) *Config {
+	merged := Config{Providers: make([]ProviderConfig, len(base.Providers))}
+	index := map[string]int{}
+	for i, provider := range base.Providers {
+		merged.Providers[i] = ProviderConfig{Name: provider.Name, Rest: map[string]interface{}{}}
+		for k, v := range provider.Rest {
+			merged.Providers[i].Rest[k] = v
+		}
+		index[provider.Name] = i
+	}
+	for _, override := range overrides {
+		i, ok := index[override.Name]
+		if !ok {
+			merged.Providers = append(merged.Providers, override)
+			index[override.Name] = len(merged.Providers) - 1
+			continue
+		}
+		for k, v := range override.Rest {
+			merged.Providers[i].Rest[k] = v
+		}
+	}
+	return &merged
+}
+
+// Returns the resource names listed under a provider's resources key
+func configuredResources(rest map[string]interface{}) []string {
+	list, ok := rest["resources"].([]interface{})
+	if !ok {
+		return nil
+	}
+	var names []string
+	for _, item := range list {
+		resource, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if name, ok := resource["name"].(string); ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
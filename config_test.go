@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeProviders(t *testing.T) {
+	base := &Config{Providers: []ProviderConfig{
+		{Name: "aws", Rest: map[string]interface{}{"regions": []interface{}{"us-east-1"}, "max_retries": 5}},
+		{Name: "gcp", Rest: map[string]interface{}{"project_ids": []interface{}{"p"}}},
+	}}
+	tests := []struct {
+		name      string
+		overrides []ProviderConfig
+		want      []ProviderConfig
+	}{
+		{
+			name: "no overrides",
+			want: base.Providers,
+		},
+		{
+			name: "override replaces keys of the same provider",
+			overrides: []ProviderConfig{
+				{Name: "aws", Rest: map[string]interface{}{"regions": []interface{}{"eu-west-1"}}},
+			},
+			want: []ProviderConfig{
+				{Name: "aws", Rest: map[string]interface{}{"regions": []interface{}{"eu-west-1"}, "max_retries": 5}},
+				base.Providers[1],
+			},
+		},
+		{
+			name: "unknown provider is appended",
+			overrides: []ProviderConfig{
+				{Name: "okta", Rest: map[string]interface{}{"domain": "https://example.okta.com"}},
+			},
+			want: []ProviderConfig{
+				base.Providers[0],
+				base.Providers[1],
+				{Name: "okta", Rest: map[string]interface{}{"domain": "https://example.okta.com"}},
+			},
+		},
+		{
+			name: "later override of an appended provider",
+			overrides: []ProviderConfig{
+				{Name: "okta", Rest: map[string]interface{}{"domain": "a"}},
+				{Name: "okta", Rest: map[string]interface{}{"domain": "b"}},
+			},
+			want: []ProviderConfig{
+				base.Providers[0],
+				base.Providers[1],
+				{Name: "okta", Rest: map[string]interface{}{"domain": "b"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeProviders(base, tt.overrides)
+			if !reflect.DeepEqual(got.Providers, tt.want) {
+				t.Errorf("mergeProviders() = %v, want %v", got.Providers, tt.want)
+			}
+		})
+	}
+	if base.Providers[0].Rest["regions"].([]interface{})[0] != "us-east-1" {
+		t.Errorf("mergeProviders() modified the base config")
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// Config sources are cached for the lifetime of the process and only downloaded again when
+// their ETag or version changes.
+type cachedSource struct {
+	version string
+	data    []byte
+}
+
+var sourceCache = struct {
+	sync.Mutex
+	entries map[string]cachedSource
+}{entries: map[string]cachedSource{}}
+
+func getCachedSource(location string) (cachedSource, bool) {
+	sourceCache.Lock()
+	defer sourceCache.Unlock()
+	entry, ok := sourceCache.entries[location]
+	return entry, ok
+}
+
+func putCachedSource(location, version string, data []byte) {
+	sourceCache.Lock()
+	defer sourceCache.Unlock()
+	sourceCache.entries[location] = cachedSource{version: version, data: data}
+}
+
+// Returns the config location from the request, CLOUDQUERY_CONFIG or the default config.yml
+func configLocation(req *Request) string {
+	if req.ConfigPath != "" {
+		return req.ConfigPath
+	}
+	if env := os.Getenv("CLOUDQUERY_CONFIG"); env != "" {
+		return env
+	}
+	return defaultConfigPath
+}
+
+// Reads a config from s3://bucket/key, ssm:/path/param, an http(s) URL, a file:// URL or a plain path
+func readSource(location string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(location, "s3://"):
+		return readS3Source(location)
+	case strings.HasPrefix(location, "ssm:"):
+		return readSSMSource(location)
+	case strings.HasPrefix(location, "https://"), strings.HasPrefix(location, "http://"):
+		return readHTTPSource(location)
+	case strings.HasPrefix(location, "file://"):
+		return readFileSource(strings.TrimPrefix(location, "file://"))
+	default:
+		return readFileSource(location)
+	}
+}
+
+// Reports whether a config location is read over the network
+func isRemoteSource(location string) bool {
+	for _, prefix := range []string{"s3://", "ssm:", "https://", "http://"} {
+		if strings.HasPrefix(location, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func readFileSource(path string) ([]byte, error) {
+	_, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("config %s doesn't exist. set the config field of the request or CLOUDQUERY_CONFIG to a file, s3://, ssm: or https:// location", path)
+		}
+		return nil, err
+	}
+	return ioutil.ReadFile(path)
+}
+
+func readS3Source(location string) ([]byte, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return nil, fmt.Errorf("config location %s should be in format s3://bucket/key", location)
+	}
+	sess, err := sharedAWSSession()
+	if err != nil {
+		return nil, err
+	}
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	cached, ok := getCachedSource(location)
+	if ok {
+		input.IfNoneMatch = aws.String(cached.version)
+	}
+	output, err := s3.New(sess, awsServiceConfig("s3")).GetObject(input)
+	if err != nil {
+		if reqErr, isReqErr := err.(awserr.RequestFailure); ok && isReqErr && reqErr.StatusCode() == http.StatusNotModified {
+			return cached.data, nil
+		}
+		return nil, fmt.Errorf("unable to read config from %s: %w", location, err)
+	}
+	defer output.Body.Close()
+	data, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return nil, err
+	}
+	putCachedSource(location, aws.StringValue(output.ETag), data)
+	return data, nil
+}
+
+func readSSMSource(location string) ([]byte, error) {
+	name := strings.TrimPrefix(location, "ssm:")
+	if name == "" {
+		return nil, fmt.Errorf("config location %s should be in format ssm:/path/param", location)
+	}
+	sess, err := sharedAWSSession()
+	if err != nil {
+		return nil, err
+	}
+	// SSM has no conditional get, the cache only saves the decode when the version is unchanged
+	output, err := ssm.New(sess, awsServiceConfig("ssm")).GetParameter(&ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config from %s: %w", location, err)
+	}
+	version := fmt.Sprintf("%d", aws.Int64Value(output.Parameter.Version))
+	if cached, ok := getCachedSource(location); ok && cached.version == version {
+		return cached.data, nil
+	}
+	data := []byte(aws.StringValue(output.Parameter.Value))
+	putCachedSource(location, version, data)
+	return data, nil
+}
+
+func readHTTPSource(location string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	cached, ok := getCachedSource(location)
+	if ok {
+		req.Header.Set("If-None-Match", cached.version)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config from %s: %w", location, err)
+	}
+	defer res.Body.Close()
+	if ok && res.StatusCode == http.StatusNotModified {
+		return cached.data, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to read config from %s: %s", location, res.Status)
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if etag := res.Header.Get("ETag"); etag != "" {
+		putCachedSource(location, etag, data)
+	}
+	return data, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadSourceHTTP(t *testing.T) {
+	body := "providers: []\n"
+	etag := `"v1"`
+	var requests, notModified int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/missing.yml":
+			http.NotFound(w, r)
+			return
+		case "/untagged.yml":
+			w.Write([]byte(body))
+			return
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name            string
+		path            string
+		wantErr         bool
+		wantNotModified int
+	}{
+		{name: "first read downloads", path: "/config.yml"},
+		{name: "unchanged etag uses the cache", path: "/config.yml", wantNotModified: 1},
+		{name: "cached again", path: "/config.yml", wantNotModified: 2},
+		{name: "missing config", path: "/missing.yml", wantErr: true, wantNotModified: 2},
+		{name: "no etag", path: "/untagged.yml", wantNotModified: 2},
+		{name: "no etag isn't cached", path: "/untagged.yml", wantNotModified: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := readSource(server.URL + tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readSource() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(data) != body {
+				t.Errorf("readSource() = %q, want %q", data, body)
+			}
+			if notModified != tt.wantNotModified {
+				t.Errorf("%d not modified responses, want %d", notModified, tt.wantNotModified)
+			}
+		})
+	}
+	if requests != len(tests) {
+		t.Errorf("%d requests, want %d", requests, len(tests))
+	}
+	if _, ok := getCachedSource(server.URL + "/untagged.yml"); ok {
+		t.Errorf("config without an ETag was cached")
+	}
+}
+
+func TestReadSourceFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configsource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yml")
+	err = ioutil.WriteFile(path, []byte("providers: []\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		location string
+		wantErr  string
+	}{
+		{name: "plain path", location: path},
+		{name: "file url", location: "file://" + path},
+		{name: "missing file", location: filepath.Join(dir, "missing.yml"), wantErr: "doesn't exist"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := readSource(tt.location)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("readSource() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "providers: []\n" {
+				t.Errorf("readSource() = %q", data)
+			}
+		})
+	}
+}
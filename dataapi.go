@@ -0,0 +1,622 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/rdsdataservice"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+const (
+	// Rows sent per BatchExecuteStatement call
+	dataAPIBatchSize = 500
+	// Calls made while an auto-paused Aurora Serverless cluster resumes
+	dataAPIResumeAttempts = 6
+	dataAPIResumeDelay    = 5 * time.Second
+	dataAPITimeLayout     = "2006-01-02 15:04:05.999999"
+)
+
+// dataAPIConfig is the database string of the rds-data-api driver:
+// cluster=<cluster arn>&secret=<secret arn>&database=<name>&engine=mysql|postgresql
+type dataAPIConfig struct {
+	cluster  string
+	secret   string
+	database string
+	schema   string
+	// SQL dialect of the cluster
+	engine string
+}
+
+// Dialectors of engines the tests add on top of the Data API driver, by engine. It is empty in
+// the function, whose clusters are mysql or postgresql.
+var dataAPITestDialectors = map[string]func(conn *sql.DB) gorm.Dialector{}
+
+func parseDataAPIConfig(dsn string) (*dataAPIConfig, error) {
+	values, err := url.ParseQuery(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rds-data-api database string: %w", err)
+	}
+	config := dataAPIConfig{
+		cluster:  values.Get("cluster"),
+		secret:   values.Get("secret"),
+		database: values.Get("database"),
+		schema:   values.Get("schema"),
+		engine:   values.Get("engine"),
+	}
+	if config.cluster == "" || config.secret == "" {
+		return nil, fmt.Errorf("rds-data-api database string should look like cluster=<cluster arn>&secret=<secret arn>&database=<name>")
+	}
+	if config.engine == "" {
+		config.engine = "mysql"
+	}
+	if _, ok := dataAPITestDialectors[config.engine]; !ok && config.engine != "mysql" && config.engine != "postgresql" {
+		return nil, fmt.Errorf("rds-data-api engine should be mysql or postgresql")
+	}
+	return &config, nil
+}
+
+// Returns the gorm dialector of the cluster's engine on top of the Data API driver
+func dataAPIDialector(dsn string) (gorm.Dialector, error) {
+	config, err := parseDataAPIConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := sharedAWSSession()
+	if err != nil {
+		return nil, err
+	}
+	awsConfig := awsServiceConfig("rdsdata")
+	if clusterARN, err := arn.Parse(config.cluster); err == nil {
+		awsConfig = awsConfig.WithRegion(clusterARN.Region)
+	}
+	conn := sql.OpenDB(&dataAPIConnector{config: config, client: rdsdataservice.New(sess, awsConfig)})
+	if dialector, ok := dataAPITestDialectors[config.engine]; ok {
+		return dialector(conn), nil
+	}
+	if config.engine == "postgresql" {
+		return postgres.New(postgres.Config{Conn: conn}), nil
+	}
+	return mysql.New(mysql.Config{Conn: conn}), nil
+}
+
+// Reports whether a database is reached through the Data API
+func isDataAPI(db *gorm.DB) bool {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return false
+	}
+	_, ok := sqlDB.Driver().(dataAPIDriver)
+	return ok
+}
+
+// dataAPIConnector hands out connections that send every statement over HTTPS. They hold no
+// network connection, only the transaction they are in.
+type dataAPIConnector struct {
+	config *dataAPIConfig
+	client *rdsdataservice.RDSDataService
+}
+
+func (c *dataAPIConnector) Connect(context.Context) (driver.Conn, error) {
+	return &dataAPIConn{config: c.config, client: c.client}, nil
+}
+
+func (c *dataAPIConnector) Driver() driver.Driver {
+	return dataAPIDriver{}
+}
+
+type dataAPIDriver struct{}
+
+func (dataAPIDriver) Open(string) (driver.Conn, error) {
+	return nil, errors.New("the rds-data-api driver is only used through its connector")
+}
+
+type dataAPIConn struct {
+	config        *dataAPIConfig
+	client        *rdsdataservice.RDSDataService
+	transactionID string
+}
+
+func (c *dataAPIConn) Prepare(query string) (driver.Stmt, error) {
+	return &dataAPIStmt{conn: c, query: query}, nil
+}
+
+func (c *dataAPIConn) Close() error {
+	if c.transactionID != "" {
+		return c.Rollback()
+	}
+	return nil
+}
+
+func (c *dataAPIConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// Begins a transaction with the default isolation level of the cluster. BeginTransaction takes no
+// options, so the ones it can't honor are an error instead of silently ignored.
+func (c *dataAPIConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if c.transactionID != "" {
+		return nil, errors.New("a transaction is already in progress")
+	}
+	if sql.IsolationLevel(opts.Isolation) != sql.LevelDefault || opts.ReadOnly {
+		return nil, errors.New("the rds-data-api driver doesn't support transaction isolation levels or read-only transactions")
+	}
+	input := &rdsdataservice.BeginTransactionInput{ResourceArn: &c.config.cluster, SecretArn: &c.config.secret}
+	if c.config.database != "" {
+		input.Database = &c.config.database
+	}
+	if c.config.schema != "" {
+		input.Schema = &c.config.schema
+	}
+	var output *rdsdataservice.BeginTransactionOutput
+	err := retryResuming(ctx, func() (err error) {
+		output, err = c.client.BeginTransactionWithContext(ctx, input)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.transactionID = aws.StringValue(output.TransactionId)
+	return c, nil
+}
+
+func (c *dataAPIConn) Commit() error {
+	id := c.transactionID
+	c.transactionID = ""
+	_, err := c.client.CommitTransaction(&rdsdataservice.CommitTransactionInput{
+		ResourceArn: &c.config.cluster, SecretArn: &c.config.secret, TransactionId: &id,
+	})
+	return err
+}
+
+func (c *dataAPIConn) Rollback() error {
+	id := c.transactionID
+	c.transactionID = ""
+	_, err := c.client.RollbackTransaction(&rdsdataservice.RollbackTransactionInput{
+		ResourceArn: &c.config.cluster, SecretArn: &c.config.secret, TransactionId: &id,
+	})
+	return err
+}
+
+func (c *dataAPIConn) Ping(ctx context.Context) error {
+	_, err := c.QueryContext(ctx, "SELECT 1", nil)
+	return err
+}
+
+// Runs a statement. Multi-row INSERTs, as gorm creates batches, are sent through
+// BatchExecuteStatement with one parameter set per row. On postgresql gorm adds RETURNING to the
+// INSERTs of tables with generated ids and reads them through QueryContext, since the ids link the
+// child rows to their parents. The Data API doesn't return generated values from a batch on
+// postgresql, so those INSERTs are sent whole and only mysql batches them.
+func (c *dataAPIConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if batch, ok := splitInsert(query, c.placeholderStyle(), len(args)); ok {
+		return c.batchExecute(ctx, batch, args)
+	}
+	output, err := c.execute(ctx, query, args, false)
+	if err != nil {
+		return nil, err
+	}
+	result := dataAPIResult{rowsAffected: aws.Int64Value(output.NumberOfRecordsUpdated)}
+	if len(output.GeneratedFields) > 0 {
+		result.lastInsertID = aws.Int64Value(output.GeneratedFields[0].LongValue)
+	}
+	return result, nil
+}
+
+func (c *dataAPIConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	output, err := c.execute(ctx, query, args, true)
+	if err != nil {
+		return nil, err
+	}
+	return &dataAPIRows{columns: output.ColumnMetadata, records: output.Records}, nil
+}
+
+func (c *dataAPIConn) placeholderStyle() byte {
+	if c.config.engine == "postgresql" {
+		return '$'
+	}
+	return '?'
+}
+
+func (c *dataAPIConn) execute(ctx context.Context, query string, args []driver.NamedValue, metadata bool) (*rdsdataservice.ExecuteStatementOutput, error) {
+	statement, names := namePlaceholders(query, c.placeholderStyle())
+	parameters, err := sqlParameters(names, args)
+	if err != nil {
+		return nil, err
+	}
+	input := &rdsdataservice.ExecuteStatementInput{
+		ResourceArn:           &c.config.cluster,
+		SecretArn:             &c.config.secret,
+		Sql:                   &statement,
+		Parameters:            parameters,
+		IncludeResultMetadata: aws.Bool(metadata),
+	}
+	c.scope(&input.Database, &input.Schema, &input.TransactionId)
+	var output *rdsdataservice.ExecuteStatementOutput
+	err = retryResuming(ctx, func() (err error) {
+		output, err = c.client.ExecuteStatementWithContext(ctx, input)
+		return err
+	})
+	return output, err
+}
+
+func (c *dataAPIConn) batchExecute(ctx context.Context, batch *insertBatch, args []driver.NamedValue) (driver.Result, error) {
+	statement, names := namePlaceholders(batch.statement, c.placeholderStyle())
+	var ids []int64
+	for start := 0; start < batch.rows; start += dataAPIBatchSize {
+		end := start + dataAPIBatchSize
+		if end > batch.rows {
+			end = batch.rows
+		}
+		input := &rdsdataservice.BatchExecuteStatementInput{
+			ResourceArn: &c.config.cluster,
+			SecretArn:   &c.config.secret,
+			Sql:         &statement,
+		}
+		c.scope(&input.Database, &input.Schema, &input.TransactionId)
+		for row := start; row < end; row++ {
+			parameters, err := sqlParameters(names, args[row*batch.columns:(row+1)*batch.columns])
+			if err != nil {
+				return nil, err
+			}
+			input.ParameterSets = append(input.ParameterSets, parameters)
+		}
+		var output *rdsdataservice.BatchExecuteStatementOutput
+		err := retryResuming(ctx, func() (err error) {
+			output, err = c.client.BatchExecuteStatementWithContext(ctx, input)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, update := range output.UpdateResults {
+			if len(update.GeneratedFields) > 0 {
+				ids = append(ids, aws.Int64Value(update.GeneratedFields[0].LongValue))
+			}
+		}
+	}
+	result := dataAPIResult{rowsAffected: int64(batch.rows)}
+	if len(ids) > 0 {
+		// gorm derives the IDs of a batch from the last insert ID, so they have to be consecutive
+		for i := 1; i < len(ids); i++ {
+			if ids[i] != ids[i-1]+1 {
+				return nil, errors.New("the rows of a batch insert got non-consecutive ids")
+			}
+		}
+		// like mysql, the ID of the first row of the batch is reported
+		result.lastInsertID = ids[0]
+	}
+	return result, nil
+}
+
+// Sets the database, schema and transaction of a request
+func (c *dataAPIConn) scope(database, schema, transactionID **string) {
+	if c.config.database != "" {
+		*database = aws.String(c.config.database)
+	}
+	if c.config.schema != "" {
+		*schema = aws.String(c.config.schema)
+	}
+	if c.transactionID != "" {
+		*transactionID = aws.String(c.transactionID)
+	}
+}
+
+// Retries the calls that fail while an auto-paused Aurora Serverless cluster resumes
+func retryResuming(ctx context.Context, call func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := call()
+		var awsErr awserr.Error
+		if err == nil || attempt == dataAPIResumeAttempts || !errors.As(err, &awsErr) ||
+			awsErr.Code() != rdsdataservice.ErrCodeBadRequestException ||
+			!strings.Contains(awsErr.Message(), "Communications link failure") {
+			return err
+		}
+		log.Printf("Waiting for the Aurora cluster to resume: %s", awsErr.Message())
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(dataAPIResumeDelay):
+		}
+	}
+}
+
+type dataAPIStmt struct {
+	conn  *dataAPIConn
+	query string
+}
+
+func (s *dataAPIStmt) Close() error  { return nil }
+func (s *dataAPIStmt) NumInput() int { return -1 }
+
+func (s *dataAPIStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.conn.ExecContext(context.Background(), s.query, namedValues(args))
+}
+
+func (s *dataAPIStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.QueryContext(context.Background(), s.query, namedValues(args))
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return named
+}
+
+type dataAPIResult struct {
+	lastInsertID int64
+	rowsAffected int64
+}
+
+func (r dataAPIResult) LastInsertId() (int64, error) { return r.lastInsertID, nil }
+func (r dataAPIResult) RowsAffected() (int64, error) { return r.rowsAffected, nil }
+
+type dataAPIRows struct {
+	columns []*rdsdataservice.ColumnMetadata
+	records [][]*rdsdataservice.Field
+	next    int
+}
+
+func (r *dataAPIRows) Columns() []string {
+	names := make([]string, len(r.columns))
+	for i, column := range r.columns {
+		names[i] = aws.StringValue(column.Name)
+	}
+	return names
+}
+
+func (r *dataAPIRows) Close() error {
+	return nil
+}
+
+func (r *dataAPIRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.records) {
+		return io.EOF
+	}
+	record := r.records[r.next]
+	r.next++
+	for i := range dest {
+		typeName := ""
+		if i < len(r.columns) {
+			typeName = aws.StringValue(r.columns[i].TypeName)
+		}
+		value, err := fieldValue(record[i], typeName)
+		if err != nil {
+			return err
+		}
+		dest[i] = value
+	}
+	return nil
+}
+
+// Converts a Data API field to a driver value. Dates and times arrive as strings and are parsed
+// by the type name of their column.
+func fieldValue(field *rdsdataservice.Field, typeName string) (driver.Value, error) {
+	switch {
+	case field == nil || aws.BoolValue(field.IsNull):
+		return nil, nil
+	case field.BooleanValue != nil:
+		return *field.BooleanValue, nil
+	case field.LongValue != nil:
+		return *field.LongValue, nil
+	case field.DoubleValue != nil:
+		return *field.DoubleValue, nil
+	case field.BlobValue != nil:
+		return field.BlobValue, nil
+	case field.ArrayValue != nil:
+		data, err := json.Marshal(field.ArrayValue)
+		return string(data), err
+	case field.StringValue != nil:
+		value := *field.StringValue
+		typeName = strings.ToUpper(typeName)
+		if strings.HasPrefix(typeName, "DATE") || strings.HasPrefix(typeName, "TIMESTAMP") {
+			for _, layout := range []string{"2006-01-02 15:04:05.999999999", time.RFC3339Nano, "2006-01-02"} {
+				if parsed, err := time.Parse(layout, value); err == nil {
+					return parsed, nil
+				}
+			}
+		}
+		return value, nil
+	}
+	return nil, nil
+}
+
+// Builds the named parameters of a statement from its arguments in order
+func sqlParameters(names []string, args []driver.NamedValue) ([]*rdsdataservice.SqlParameter, error) {
+	if len(names) != len(args) {
+		return nil, fmt.Errorf("statement has %d placeholders but %d arguments", len(names), len(args))
+	}
+	parameters := make([]*rdsdataservice.SqlParameter, 0, len(args))
+	for i, arg := range args {
+		field := &rdsdataservice.Field{}
+		parameter := &rdsdataservice.SqlParameter{Name: aws.String(names[i]), Value: field}
+		switch value := arg.Value.(type) {
+		case nil:
+			field.IsNull = aws.Bool(true)
+		case int64:
+			field.LongValue = aws.Int64(value)
+		case float64:
+			field.DoubleValue = aws.Float64(value)
+		case bool:
+			field.BooleanValue = aws.Bool(value)
+		case []byte:
+			field.BlobValue = value
+		case string:
+			field.StringValue = aws.String(value)
+		case time.Time:
+			field.StringValue = aws.String(value.UTC().Format(dataAPITimeLayout))
+			parameter.TypeHint = aws.String(rdsdataservice.TypeHintTimestamp)
+		default:
+			return nil, fmt.Errorf("unsupported argument type %T", value)
+		}
+		parameters = append(parameters, parameter)
+	}
+	return parameters, nil
+}
+
+// Replaces the ? or $n placeholders of a statement with the :name parameters of the Data API.
+// Returns the statement and the parameter name of every placeholder in order.
+func namePlaceholders(query string, style byte) (string, []string) {
+	var names []string
+	statement := rewritePlaceholders(query, style, func(placeholder string) string {
+		name := fmt.Sprintf("p%d", len(names)+1)
+		if style == '$' {
+			name = "p" + placeholder
+		}
+		names = append(names, name)
+		return ":" + name
+	})
+	return statement, names
+}
+
+// Calls replace for every placeholder outside quoted strings, quoted identifiers and comments,
+// and substitutes what it returns. Placeholders are ? when style is '?', $n when style is '$'
+// with n passed to replace, and :name when style is ':' with the name passed to replace.
+func rewritePlaceholders(query string, style byte, replace func(string) string) string {
+	var out strings.Builder
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			end := i + 1
+			for end < len(query) {
+				if query[end] == '\\' && c != '`' {
+					end += 2
+					continue
+				}
+				if query[end] == c {
+					if end+1 < len(query) && query[end+1] == c {
+						end += 2
+						continue
+					}
+					break
+				}
+				end++
+			}
+			if end >= len(query) {
+				end = len(query) - 1
+			}
+			out.WriteString(query[i : end+1])
+			i = end
+		case c == '-' && strings.HasPrefix(query[i:], "--"), c == '/' && strings.HasPrefix(query[i:], "/*"):
+			terminator := "\n"
+			if c == '/' {
+				terminator = "*/"
+			}
+			end := strings.Index(query[i:], terminator)
+			if end < 0 {
+				end = len(query) - i
+			} else {
+				end += len(terminator)
+			}
+			out.WriteString(query[i : i+end])
+			i += end - 1
+		case style == '?' && c == '?':
+			out.WriteString(replace(""))
+		case style == '$' && c == '$' && i+1 < len(query) && isDigit(query[i+1]):
+			end := i + 1
+			for end < len(query) && isDigit(query[end]) {
+				end++
+			}
+			out.WriteString(replace(query[i+1 : end]))
+			i = end - 1
+		case style == ':' && c == ':' && i+1 < len(query) && isNameStart(query[i+1]) && (i == 0 || query[i-1] != ':'):
+			end := i + 1
+			for end < len(query) && (isNameStart(query[end]) || isDigit(query[end])) {
+				end++
+			}
+			out.WriteString(replace(query[i+1 : end]))
+			i = end - 1
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return out.String()
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// insertBatch is a multi-row INSERT rewritten to the statement of a single row
+type insertBatch struct {
+	statement string
+	rows      int
+	columns   int
+}
+
+// Splits INSERT ... VALUES (?,?),(?,?) ... into the statement of one row. Statements with
+// placeholders after the rows, or RETURNING, whose values a batch can't return, are run as they are.
+func splitInsert(query string, style byte, args int) (*insertBatch, bool) {
+	upper := strings.ToUpper(query)
+	if !strings.HasPrefix(strings.TrimSpace(upper), "INSERT") || strings.Contains(upper, "RETURNING") {
+		return nil, false
+	}
+	valuesAt := strings.Index(upper, " VALUES ")
+	if valuesAt < 0 {
+		return nil, false
+	}
+	rest := query[valuesAt+len(" VALUES "):]
+	var tuples []string
+	for strings.HasPrefix(rest, "(") {
+		end := strings.Index(rest, ")")
+		if end < 0 {
+			return nil, false
+		}
+		tuples = append(tuples, rest[:end+1])
+		rest = rest[end+1:]
+		if !strings.HasPrefix(rest, ",") {
+			break
+		}
+		rest = rest[1:]
+	}
+	if len(tuples) < 2 {
+		return nil, false
+	}
+	placeholders := 0
+	rewritePlaceholders(tuples[0], style, func(string) string { placeholders++; return "" })
+	trailing := 0
+	rewritePlaceholders(rest, style, func(string) string { trailing++; return "" })
+	if placeholders == 0 || trailing > 0 || placeholders*len(tuples) != args {
+		return nil, false
+	}
+	for _, tuple := range tuples[1:] {
+		// postgres numbers its placeholders, so only the shape of the rows is compared
+		if style == '?' && tuple != tuples[0] {
+			return nil, false
+		}
+		if strings.Count(tuple, ",") != strings.Count(tuples[0], ",") {
+			return nil, false
+		}
+	}
+	first := tuples[0]
+	if style == '$' {
+		n := 0
+		first = rewritePlaceholders(first, style, func(string) string { n++; return fmt.Sprintf("$%d", n) })
+	}
+	return &insertBatch{
+		statement: query[:valuesAt+len(" VALUES ")] + first + rest,
+		rows:      len(tuples),
+		columns:   placeholders,
+	}, true
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/rdsdataservice"
+)
+
+func TestParseDataAPIConfig(t *testing.T) {
+	const arns = "cluster=arn:aws:rds:us-east-1:123456789012:cluster:cq&secret=arn:aws:secretsmanager:us-east-1:123456789012:secret:cq"
+	tests := []struct {
+		name       string
+		dsn        string
+		wantEngine string
+		wantErr    bool
+	}{
+		{name: "default engine", dsn: arns + "&database=cloudquery", wantEngine: "mysql"},
+		{name: "postgresql", dsn: arns + "&engine=postgresql", wantEngine: "postgresql"},
+		{name: "engine of the tests", dsn: arns + "&engine=sqlite", wantEngine: "sqlite"},
+		{name: "unknown engine", dsn: arns + "&engine=oracle", wantErr: true},
+		{name: "without a secret", dsn: "cluster=arn:aws:rds:us-east-1:123456789012:cluster:cq", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := parseDataAPIConfig(tt.dsn)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseDataAPIConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && config.engine != tt.wantEngine {
+				t.Errorf("parseDataAPIConfig() engine = %s, want %s", config.engine, tt.wantEngine)
+			}
+		})
+	}
+
+	// sqlite is only an engine while the stub of the tests adds it
+	dialector := dataAPITestDialectors["sqlite"]
+	delete(dataAPITestDialectors, "sqlite")
+	defer func() { dataAPITestDialectors["sqlite"] = dialector }()
+	if _, err := parseDataAPIConfig(arns + "&engine=sqlite"); err == nil {
+		t.Error("parseDataAPIConfig() accepted sqlite without the stub, want an error")
+	}
+}
+
+func TestSplitInsert(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		style byte
+		args  int
+		want  *insertBatch
+	}{
+		{
+			name:  "mysql rows",
+			query: "INSERT INTO `t` (`a`,`b`) VALUES (?,?),(?,?),(?,?)",
+			style: '?',
+			args:  6,
+			want:  &insertBatch{statement: "INSERT INTO `t` (`a`,`b`) VALUES (?,?)", rows: 3, columns: 2},
+		},
+		{
+			name:  "postgres rows are renumbered",
+			query: `INSERT INTO "t" ("a","b") VALUES ($1,$2),($3,$4)`,
+			style: '$',
+			args:  4,
+			want:  &insertBatch{statement: `INSERT INTO "t" ("a","b") VALUES ($1,$2)`, rows: 2, columns: 2},
+		},
+		{
+			name:  "conflict clause without placeholders",
+			query: `INSERT INTO "t" ("a") VALUES ($1),($2) ON CONFLICT DO NOTHING`,
+			style: '$',
+			args:  2,
+			want:  &insertBatch{statement: `INSERT INTO "t" ("a") VALUES ($1) ON CONFLICT DO NOTHING`, rows: 2, columns: 1},
+		},
+		{
+			name:  "single row",
+			query: "INSERT INTO `t` (`a`) VALUES (?)",
+			style: '?',
+			args:  1,
+		},
+		{
+			name:  "returning",
+			query: `INSERT INTO "t" ("a") VALUES ($1),($2) RETURNING "id"`,
+			style: '$',
+			args:  2,
+		},
+		{
+			name:  "placeholders after the rows",
+			query: "INSERT INTO `t` (`a`) VALUES (?),(?) ON DUPLICATE KEY UPDATE `a`=?",
+			style: '?',
+			args:  3,
+		},
+		{
+			name:  "rows of different shapes",
+			query: "INSERT INTO `t` (`a`,`b`) VALUES (?,?),(?,NULL)",
+			style: '?',
+			args:  3,
+		},
+		{
+			name:  "arguments don't match the rows",
+			query: "INSERT INTO `t` (`a`) VALUES (?),(?)",
+			style: '?',
+			args:  3,
+		},
+		{
+			name:  "not an insert",
+			query: "UPDATE `t` SET `a`=? WHERE `b` IN (?,?)",
+			style: '?',
+			args:  3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := splitInsert(tt.query, tt.style, tt.args)
+			if ok != (tt.want != nil) || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitInsert() = %+v, %v, want %+v", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestNamePlaceholders(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		style     byte
+		statement string
+		names     []string
+	}{
+		{
+			name:      "question marks",
+			query:     "SELECT * FROM t WHERE a = ? AND b = ?",
+			style:     '?',
+			statement: "SELECT * FROM t WHERE a = :p1 AND b = :p2",
+			names:     []string{"p1", "p2"},
+		},
+		{
+			name:      "numbered",
+			query:     "UPDATE t SET a = $2 WHERE b = $1",
+			style:     '$',
+			statement: "UPDATE t SET a = :p2 WHERE b = :p1",
+			names:     []string{"p2", "p1"},
+		},
+		{
+			name:      "quotes and comments",
+			query:     "SELECT '?', \"?\", `?`, 'it''s ?' -- ?\n/* ? */ FROM t WHERE a = ?",
+			style:     '?',
+			statement: "SELECT '?', \"?\", `?`, 'it''s ?' -- ?\n/* ? */ FROM t WHERE a = :p1",
+			names:     []string{"p1"},
+		},
+		{
+			name:      "dollar quotes aren't placeholders",
+			query:     "SELECT $a, $1",
+			style:     '$',
+			statement: "SELECT $a, :p1",
+			names:     []string{"p1"},
+		},
+		{
+			name:      "no placeholders",
+			query:     "SELECT 1",
+			style:     '?',
+			statement: "SELECT 1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statement, names := namePlaceholders(tt.query, tt.style)
+			if statement != tt.statement || !reflect.DeepEqual(names, tt.names) {
+				t.Errorf("namePlaceholders() = %q, %v, want %q, %v", statement, names, tt.statement, tt.names)
+			}
+		})
+	}
+}
+
+func TestSQLParameters(t *testing.T) {
+	at := time.Date(2026, 10, 18, 7, 24, 23, 500000000, time.FixedZone("CEST", 2*60*60))
+	tests := []struct {
+		name    string
+		value   driver.Value
+		want    *rdsdataservice.SqlParameter
+		wantErr bool
+	}{
+		{name: "null", value: nil, want: &rdsdataservice.SqlParameter{Value: &rdsdataservice.Field{IsNull: aws.Bool(true)}}},
+		{name: "integer", value: int64(7), want: &rdsdataservice.SqlParameter{Value: &rdsdataservice.Field{LongValue: aws.Int64(7)}}},
+		{name: "float", value: 1.5, want: &rdsdataservice.SqlParameter{Value: &rdsdataservice.Field{DoubleValue: aws.Float64(1.5)}}},
+		{name: "bool", value: true, want: &rdsdataservice.SqlParameter{Value: &rdsdataservice.Field{BooleanValue: aws.Bool(true)}}},
+		{name: "bytes", value: []byte("ab"), want: &rdsdataservice.SqlParameter{Value: &rdsdataservice.Field{BlobValue: []byte("ab")}}},
+		{name: "string", value: "ab", want: &rdsdataservice.SqlParameter{Value: &rdsdataservice.Field{StringValue: aws.String("ab")}}},
+		{
+			name:  "time in UTC",
+			value: at,
+			want: &rdsdataservice.SqlParameter{
+				Value:    &rdsdataservice.Field{StringValue: aws.String("2026-10-18 05:24:23.5")},
+				TypeHint: aws.String(rdsdataservice.TypeHintTimestamp),
+			},
+		},
+		{name: "unsupported", value: int32(1), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sqlParameters([]string{"p1"}, []driver.NamedValue{{Ordinal: 1, Value: tt.value}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sqlParameters() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			tt.want.Name = aws.String("p1")
+			if len(got) != 1 || !reflect.DeepEqual(got[0], tt.want) {
+				t.Errorf("sqlParameters() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	_, err := sqlParameters([]string{"p1", "p2"}, []driver.NamedValue{{Ordinal: 1, Value: "a"}})
+	if err == nil {
+		t.Errorf("sqlParameters() accepted fewer arguments than placeholders")
+	}
+}
+
+type dataAPIParent struct {
+	ID       uint `gorm:"primarykey"`
+	Name     string
+	Children []dataAPIChild `gorm:"foreignKey:ParentID"`
+}
+
+type dataAPIChild struct {
+	ID       uint `gorm:"primarykey"`
+	ParentID uint
+	Name     string
+}
+
+// Runs the driver against the stub: batches keep the ids gorm links the child rows with, and
+// transaction options the Data API can't honor fail
+func TestDataAPIDriver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dataapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	local := filepath.Join(dir, "local.db")
+	defer forgetDB("sqlite", local)
+	stub, err := newDataAPIStub("sqlite", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	setenv(t, "CLOUDQUERY_RDSDATA_ENDPOINT", server.URL)
+	setenv(t, "AWS_REGION", "us-east-1")
+	setenv(t, "AWS_ACCESS_KEY_ID", "test")
+	setenv(t, "AWS_SECRET_ACCESS_KEY", "test")
+
+	dsn := "cluster=arn:aws:rds:us-east-1:123456789012:cluster:cq&secret=arn:aws:secretsmanager:us-east-1:123456789012:secret:cq&engine=sqlite"
+	db, err := openDB("rds-data-api", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forgetDB("rds-data-api", dsn)
+	if !isDataAPI(db) {
+		t.Errorf("isDataAPI() = false for the rds-data-api driver")
+	}
+	err = db.AutoMigrate(&dataAPIParent{}, &dataAPIChild{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parents := []dataAPIParent{
+		{Name: "a", Children: []dataAPIChild{{Name: "a1"}, {Name: "a2"}}},
+		{Name: "b", Children: []dataAPIChild{{Name: "b1"}}},
+		{Name: "c"},
+	}
+	err = db.Create(&parents).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, parent := range parents {
+		if parent.ID != uint(i+1) {
+			t.Errorf("parent %s got id %d, want %d", parent.Name, parent.ID, i+1)
+		}
+	}
+	var children []dataAPIChild
+	err = db.Order("id").Find(&children).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]uint{"a1": 1, "a2": 1, "b1": 2}
+	if len(children) != len(want) {
+		t.Fatalf("found %d children, want %d", len(children), len(want))
+	}
+	for _, child := range children {
+		if child.ParentID != want[child.Name] {
+			t.Errorf("child %s has parent %d, want %d", child.Name, child.ParentID, want[child.Name])
+		}
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range []*sql.TxOptions{{ReadOnly: true}, {Isolation: sql.LevelSerializable}} {
+		tx, err := sqlDB.BeginTx(context.Background(), opts)
+		if err == nil {
+			tx.Rollback()
+			t.Errorf("BeginTx(%+v) succeeded, want an error", opts)
+		}
+	}
+	tx, err := sqlDB.BeginTx(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tx.Exec("DELETE FROM data_api_children")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	db.Model(&dataAPIChild{}).Count(&count)
+	if count != 3 {
+		t.Errorf("%d children after the rollback, want 3", count)
+	}
+}
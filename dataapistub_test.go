@@ -0,0 +1,273 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/private/protocol/json/jsonutil"
+	"github.com/aws/aws-sdk-go/service/rdsdataservice"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/callbacks"
+)
+
+// The stub runs on sqlite, so the tests add it as an engine of the Data API driver
+func init() {
+	dataAPITestDialectors["sqlite"] = func(conn *sql.DB) gorm.Dialector {
+		return &dataAPISQLiteDialector{conn: conn}
+	}
+}
+
+// dataAPISQLiteDialector is the sqlite dialect over a Data API connection. The sqlite dialector
+// opens its own connection, and expects the ID of the last row of an INSERT where the Data API
+// driver reports the first, as mysql does.
+type dataAPISQLiteDialector struct {
+	sqlite.Dialector
+	conn *sql.DB
+}
+
+func (d *dataAPISQLiteDialector) Initialize(db *gorm.DB) error {
+	callbacks.RegisterDefaultCallbacks(db, &callbacks.Config{})
+	db.ConnPool = d.conn
+	for name, builder := range d.ClauseBuilders() {
+		db.ClauseBuilders[name] = builder
+	}
+	return nil
+}
+
+// dataAPIStub emulates the RDS Data API on top of a local database, so the rds-data-api driver
+// can be tested without an Aurora cluster. Cluster and secret ARNs aren't checked.
+type dataAPIStub struct {
+	db     *sql.DB
+	driver string
+	lock   sync.Mutex
+	txs    map[string]*sql.Tx
+}
+
+func newDataAPIStub(driver, dsn string) (*dataAPIStub, error) {
+	if driver == "rds-data-api" {
+		return nil, fmt.Errorf("the Data API stub needs a local database driver")
+	}
+	db, err := openDB(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	return &dataAPIStub{db: sqlDB, driver: driver, txs: map[string]*sql.Tx{}}, nil
+}
+
+// The fields of the Data API requests the stub reads. encoding/json matches the SDK's field
+// names case-insensitively.
+type dataAPIStubRequest struct {
+	SQL           string                           `json:"sql"`
+	Parameters    []*rdsdataservice.SqlParameter   `json:"parameters"`
+	ParameterSets [][]*rdsdataservice.SqlParameter `json:"parameterSets"`
+	TransactionID string                           `json:"transactionId"`
+}
+
+func (s *dataAPIStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req dataAPIStubRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		dataAPIStubError(w, err)
+		return
+	}
+	var out interface{}
+	switch r.URL.Path {
+	case "/BeginTransaction":
+		out, err = s.begin()
+	case "/CommitTransaction", "/RollbackTransaction":
+		out, err = s.finish(req.TransactionID, r.URL.Path == "/CommitTransaction")
+	case "/Execute":
+		out, err = s.execute(req.TransactionID, req.SQL, req.Parameters)
+	case "/BatchExecute":
+		results := []*rdsdataservice.UpdateResult{}
+		for _, parameters := range req.ParameterSets {
+			var output *rdsdataservice.ExecuteStatementOutput
+			output, err = s.execute(req.TransactionID, req.SQL, parameters)
+			if err != nil {
+				break
+			}
+			results = append(results, &rdsdataservice.UpdateResult{GeneratedFields: output.GeneratedFields})
+		}
+		out = &rdsdataservice.BatchExecuteStatementOutput{UpdateResults: results}
+	}
+	if err != nil {
+		dataAPIStubError(w, err)
+		return
+	}
+	// the SDK types are tagged with the wire names for jsonutil, not encoding/json
+	data, err := jsonutil.BuildJSON(out)
+	if err != nil {
+		dataAPIStubError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
+
+// The errors are shaped like the BadRequestException of the Data API
+func dataAPIStubError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Amzn-Errortype", rdsdataservice.ErrCodeBadRequestException)
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+}
+
+func (s *dataAPIStub) begin() (interface{}, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	id := newRunID()
+	s.lock.Lock()
+	s.txs[id] = tx
+	s.lock.Unlock()
+	return &rdsdataservice.BeginTransactionOutput{TransactionId: aws.String(id)}, nil
+}
+
+func (s *dataAPIStub) finish(id string, commit bool) (interface{}, error) {
+	s.lock.Lock()
+	tx := s.txs[id]
+	delete(s.txs, id)
+	s.lock.Unlock()
+	if tx == nil {
+		return nil, fmt.Errorf("transaction %s is not found", id)
+	}
+	if commit {
+		return &rdsdataservice.CommitTransactionOutput{TransactionStatus: aws.String("Transaction Committed")}, tx.Commit()
+	}
+	return &rdsdataservice.RollbackTransactionOutput{TransactionStatus: aws.String("Rollback Complete")}, tx.Rollback()
+}
+
+type sqlRunner interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func (s *dataAPIStub) execute(transactionID, query string, parameters []*rdsdataservice.SqlParameter) (*rdsdataservice.ExecuteStatementOutput, error) {
+	var runner sqlRunner = s.db
+	if transactionID != "" {
+		s.lock.Lock()
+		tx := s.txs[transactionID]
+		s.lock.Unlock()
+		if tx == nil {
+			return nil, fmt.Errorf("transaction %s is not found", transactionID)
+		}
+		runner = tx
+	}
+	values := map[string]interface{}{}
+	for _, parameter := range parameters {
+		values[aws.StringValue(parameter.Name)] = stubParameterValue(parameter.Value)
+	}
+	var args []interface{}
+	statement := rewritePlaceholders(query, ':', func(name string) string {
+		args = append(args, values[name])
+		if s.driver == "postgresql" {
+			return fmt.Sprintf("$%d", len(args))
+		}
+		return "?"
+	})
+
+	keyword := strings.ToUpper(strings.TrimSpace(statement))
+	if strings.HasPrefix(keyword, "SELECT") || strings.HasPrefix(keyword, "WITH") || strings.HasPrefix(keyword, "PRAGMA") ||
+		strings.HasPrefix(keyword, "SHOW") || strings.Contains(keyword, "RETURNING") {
+		rows, err := runner.Query(statement, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		return stubRecords(rows)
+	}
+	result, err := runner.Exec(statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	output := &rdsdataservice.ExecuteStatementOutput{}
+	if affected, err := result.RowsAffected(); err == nil {
+		output.NumberOfRecordsUpdated = aws.Int64(affected)
+	}
+	if id, err := result.LastInsertId(); err == nil && id > 0 && strings.HasPrefix(keyword, "INSERT") {
+		output.GeneratedFields = []*rdsdataservice.Field{{LongValue: aws.Int64(id)}}
+	}
+	return output, nil
+}
+
+func stubParameterValue(field *rdsdataservice.Field) interface{} {
+	switch {
+	case field == nil || aws.BoolValue(field.IsNull):
+		return nil
+	case field.BooleanValue != nil:
+		return *field.BooleanValue
+	case field.LongValue != nil:
+		return *field.LongValue
+	case field.DoubleValue != nil:
+		return *field.DoubleValue
+	case field.BlobValue != nil:
+		return field.BlobValue
+	}
+	return aws.StringValue(field.StringValue)
+}
+
+// Encodes the rows like the Data API: every value a typed field and times as strings
+func stubRecords(rows *sql.Rows) (*rdsdataservice.ExecuteStatementOutput, error) {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	output := &rdsdataservice.ExecuteStatementOutput{Records: [][]*rdsdataservice.Field{}}
+	for _, column := range types {
+		output.ColumnMetadata = append(output.ColumnMetadata, &rdsdataservice.ColumnMetadata{
+			Name:     aws.String(column.Name()),
+			TypeName: aws.String(column.DatabaseTypeName()),
+		})
+	}
+	values := make([]interface{}, len(types))
+	pointers := make([]interface{}, len(types))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for rows.Next() {
+		err := rows.Scan(pointers...)
+		if err != nil {
+			return nil, err
+		}
+		record := make([]*rdsdataservice.Field, len(values))
+		for i, value := range values {
+			field := &rdsdataservice.Field{}
+			switch v := value.(type) {
+			case nil:
+				field.IsNull = aws.Bool(true)
+			case bool:
+				field.BooleanValue = aws.Bool(v)
+			case int64:
+				field.LongValue = aws.Int64(v)
+			case float64:
+				field.DoubleValue = aws.Float64(v)
+			case time.Time:
+				field.StringValue = aws.String(v.UTC().Format(dataAPITimeLayout))
+			case []byte:
+				if utf8.Valid(v) && !strings.Contains(strings.ToUpper(types[i].DatabaseTypeName()), "BLOB") {
+					field.StringValue = aws.String(string(v))
+				} else {
+					field.BlobValue = v
+				}
+			default:
+				field.StringValue = aws.String(fmt.Sprint(v))
+			}
+			record[i] = field
+		}
+		output.Records = append(output.Records, record)
+	}
+	return output, rows.Err()
+}
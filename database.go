@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/driver/sqlserver"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Pool limits suited to a Lambda instance, which runs one invocation at a time and is frozen
+// in between. Overridden by CLOUDQUERY_DB_MAX_OPEN_CONNS, CLOUDQUERY_DB_MAX_IDLE_CONNS,
+// CLOUDQUERY_DB_CONN_MAX_LIFETIME and CLOUDQUERY_DB_CONN_MAX_IDLE_TIME.
+const (
+	defaultMaxOpenConns    = 10
+	defaultMaxIdleConns    = 2
+	defaultConnMaxLifetime = 5 * time.Minute
+	defaultConnMaxIdleTime = time.Minute
+	pingTimeout            = 5 * time.Second
+	// Database of the fetch and policy tasks without CLOUDQUERY_DRIVER set, see export.go and sqlitesnapshot.go
+	scratchDSN = "/tmp/cloudquery.db"
+)
+
+type cachedDB struct {
+	db     *gorm.DB
+	source *databaseSource
+}
+
+var (
+	dbCache     = map[string]*cachedDB{}
+	dbCacheLock sync.Mutex
+)
+
+// Returns the connection pool for the driver and database string, see resolveDSN. Pools are kept
+// for the life of the process, so warm invocations reuse their connections, and pinged before
+// they are handed out again. A pool is replaced when its secret was rotated. The secret is
+// resolved and the database pinged without holding the lock, which only guards the cache.
+func openDB(driver, dsn string) (*gorm.DB, error) {
+	key := driver + "\x00" + dsn
+	source, err := resolveDSN(driver, dsn, false)
+	if err != nil {
+		return nil, err
+	}
+	if cached := cachedPool(key); cached != nil {
+		if cached.source.dsn == source.dsn {
+			err = pingDB(cached.db)
+			if err == nil {
+				return cached.db, nil
+			}
+			log.Printf("Reconnecting to the %s database: %s", driver, err)
+			// the password may have been rotated since the secret was cached
+			if isSecretDSN(dsn) {
+				source, err = resolveDSN(driver, dsn, true)
+				if err != nil {
+					return nil, err
+				}
+			}
+		} else {
+			log.Printf("Database secret changed to version %s. Reconnecting to the %s database", source.version, driver)
+		}
+		dropPool(key, cached)
+	}
+	db, err := newDB(driver, source)
+	if err != nil {
+		return nil, err
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	sqlDB.SetMaxOpenConns(envInt("CLOUDQUERY_DB_MAX_OPEN_CONNS", defaultMaxOpenConns))
+	sqlDB.SetMaxIdleConns(envInt("CLOUDQUERY_DB_MAX_IDLE_CONNS", defaultMaxIdleConns))
+	sqlDB.SetConnMaxLifetime(envDuration("CLOUDQUERY_DB_CONN_MAX_LIFETIME", defaultConnMaxLifetime))
+	sqlDB.SetConnMaxIdleTime(envDuration("CLOUDQUERY_DB_CONN_MAX_IDLE_TIME", defaultConnMaxIdleTime))
+	return storePool(key, &cachedDB{db: db, source: source}), nil
+}
+
+func cachedPool(key string) *cachedDB {
+	dbCacheLock.Lock()
+	defer dbCacheLock.Unlock()
+	return dbCache[key]
+}
+
+// Closes and drops a cached pool unless another caller replaced it in the meantime
+func dropPool(key string, cached *cachedDB) {
+	dbCacheLock.Lock()
+	defer dbCacheLock.Unlock()
+	if dbCache[key] == cached {
+		closeDB(cached.db)
+		delete(dbCache, key)
+	}
+}
+
+// Caches a new pool and returns it. When another caller cached a pool for the same database in
+// the meantime, the new one is closed and that one is returned instead.
+func storePool(key string, pool *cachedDB) *gorm.DB {
+	dbCacheLock.Lock()
+	defer dbCacheLock.Unlock()
+	if cached, ok := dbCache[key]; ok && cached.source.dsn == pool.source.dsn {
+		closeDB(pool.db)
+		return cached.db
+	}
+	if cached, ok := dbCache[key]; ok {
+		closeDB(cached.db)
+	}
+	dbCache[key] = pool
+	return pool.db
+}
+
+// Opens a database connection with the same drivers and settings as cloudqueryclient.New. Unlike
+// openDB the pool is not shared, so the caller closes it.
+func newDB(driver string, source *databaseSource) (*gorm.DB, error) {
+	gormConfig := &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Warn),
+	}
+	dsn := source.dsn
+	var dialector gorm.Dialector
+	switch {
+	case source.connector != nil && driver == "postgresql":
+		dialector = postgres.New(postgres.Config{Conn: sql.OpenDB(source.connector)})
+	case source.connector != nil && driver == "mysql":
+		dialector = mysql.New(mysql.Config{Conn: sql.OpenDB(source.connector)})
+	case driver == "sqlite":
+		dialector = sqlite.Open(dsn)
+	case driver == "postgresql":
+		dialector = postgres.Open(dsn)
+	case driver == "mysql":
+		dialector = mysql.Open(dsn)
+	case driver == "sqlserver":
+		dialector = sqlserver.Open(dsn)
+	case driver == "rds-data-api":
+		var err error
+		dialector, err = dataAPIDialector(dsn)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("database driver only supports one of sqlite,postgresql,mysql,sqlserver,rds-data-api")
+	}
+	db, err := gorm.Open(dialector, gormConfig)
+	if err != nil {
+		return nil, err
+	}
+	if driver == "sqlite" {
+		db.Exec("PRAGMA foreign_keys = ON")
+	}
+	err = registerSnapshotCallbacks(db)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func pingDB(db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	return sqlDB.PingContext(ctx)
+}
+
+func closeDB(db *gorm.DB) {
+	if sqlDB, err := db.DB(); err == nil {
+		_ = sqlDB.Close()
+	}
+}
+
+// Closes and drops the cached pool of the driver and database string, e.g. before its file is replaced
+func forgetDB(driver, dsn string) {
+	dbCacheLock.Lock()
+	defer dbCacheLock.Unlock()
+	key := driver + "\x00" + dsn
+	if cached, ok := dbCache[key]; ok {
+		closeDB(cached.db)
+		delete(dbCache, key)
+	}
+}
+
+// Closes every cached pool. Called when the Lambda runtime shuts the process down.
+func closeDatabases() {
+	dbCacheLock.Lock()
+	defer dbCacheLock.Unlock()
+	for key, cached := range dbCache {
+		closeDB(cached.db)
+		delete(dbCache, key)
+	}
+}
+
+func envInt(name string, fallback int) int {
+	if value, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return value
+	}
+	return fallback
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(name)); err == nil {
+		return value
+	}
+	return fallback
+}
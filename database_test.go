@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestOpenDBSharesPools(t *testing.T) {
+	dir, err := ioutil.TempDir("", "database")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dsn := filepath.Join(dir, "shared.db")
+	defer forgetDB("sqlite", dsn)
+
+	pools := make([]*gorm.DB, 8)
+	var wg sync.WaitGroup
+	for i := range pools {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			pools[i], _ = openDB("sqlite", dsn)
+		}(i)
+	}
+	wg.Wait()
+	for i, pool := range pools {
+		if pool == nil || pool != pools[0] {
+			t.Fatalf("openDB() returned pool %d = %p, want %p", i, pool, pools[0])
+		}
+	}
+	err = pingDB(pools[0])
+	if err != nil {
+		t.Errorf("the cached pool was closed: %s", err)
+	}
+}
+
+// A slow secret lookup of one database doesn't hold up opening another
+func TestOpenDBResolvesOutsideTheLock(t *testing.T) {
+	requested := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case requested <- struct{}{}:
+		default:
+		}
+		<-release
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.Write([]byte(`{"SecretString": "{\"host\": \"localhost\", \"username\": \"cq\", \"password\": \"pw\", \"dbname\": \"cq\"}", "VersionId": "v1"}`))
+	}))
+	defer server.Close()
+	setenv(t, "CLOUDQUERY_SECRETSMANAGER_ENDPOINT", server.URL)
+	setenv(t, "AWS_REGION", "us-east-1")
+	setenv(t, "AWS_ACCESS_KEY_ID", "test")
+	setenv(t, "AWS_SECRET_ACCESS_KEY", "test")
+
+	// the secret is looked up again by every run of the test
+	t.Cleanup(func() {
+		secretCacheLock.Lock()
+		delete(secretCache, "slow")
+		secretCacheLock.Unlock()
+	})
+	slow := make(chan struct{})
+	go func() {
+		defer close(slow)
+		// the driver can't connect to the secret's host, only the lookup matters
+		_, _ = openDB("sqlite", secretsManagerPrefix+"slow")
+	}()
+	// the first openDB is resolving its secret until release is closed
+	select {
+	case <-requested:
+	case <-slow:
+		t.Fatal("openDB() didn't look up the secret")
+	}
+
+	opened := make(chan error, 1)
+	go func() {
+		_, err := openDB("sqlite", ":memory:")
+		opened <- err
+	}()
+	select {
+	case err := <-opened:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("openDB() waited for the secret of another database")
+	}
+	close(release)
+	<-slow
+	forgetDB("sqlite", ":memory:")
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+func init() {
+	RegisterTask("diff", Task{
+		Description: "Compares the snapshots of finished fetches with the rows they superseded and publishes an event for every added, removed or modified resource",
+		NewRequest:  func() interface{} { return &Request{} },
+		Run: func(ctx context.Context, req interface{}, resp *Response) error {
+			return Diff(ctx, DRIVER, DSN, req.(*Request), resp)
+		},
+	})
+}
+
+const (
+	ChangeAdded    = "added"
+	ChangeRemoved  = "removed"
+	ChangeModified = "modified"
+)
+
+// Columns that differ between snapshots of the same resource
+var diffIgnoredColumns = map[string]bool{"id": true, "fetch_id": true, "fetched_at": true, "superseded_by": true}
+
+// Columns that tell where a resource was fetched from. The ones a table has lead its natural key.
+var diffScopeColumns = []string{"account_id", "region", "project_id", "subscription_id", "cluster_name", "domain"}
+
+// ChangeEvent is published for every resource a fetch added, removed or modified. Key holds the
+// natural key of the resource, e.g. account_id, region and instance_id.
+type ChangeEvent struct {
+	// Derived from the fetch, table and key, so an event published again when a diff is retried
+	// has the same ID and consumers can drop the duplicate
+	ID              string                 `json:"id"`
+	Type            string                 `json:"type"`
+	Table           string                 `json:"table"`
+	Key             map[string]interface{} `json:"key,omitempty"`
+	FetchID         string                 `json:"fetchId"`
+	PreviousFetchID string                 `json:"previousFetchId,omitempty"`
+	DetectedAt      time.Time              `json:"detectedAt"`
+	// The changed columns of a modified resource. Child tables, like the tags of an instance, are
+	// compared as a whole and reported as one field named after the table.
+	Changes []FieldChange `json:"changes,omitempty"`
+	// The added resource, or the last fetched version of the removed one
+	Resource map[string]interface{} `json:"resource,omitempty"`
+	// Set when Resource was left out to fit the message size of the sink
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+type FieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+type DiffResult struct {
+	Sink    string      `json:"sink"`
+	Fetches []FetchDiff `json:"fetches"`
+}
+
+// FetchDiff counts the changes of a fetch by table
+type FetchDiff struct {
+	FetchID string `json:"fetchId"`
+	Shard   string `json:"shard,omitempty"`
+	// The first fetch of a shard has nothing to compare with, so it publishes no events
+	Baseline bool        `json:"baseline,omitempty"`
+	Tables   []TableDiff `json:"tables,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+type TableDiff struct {
+	Table string `json:"table"`
+	// The natural key the rows were matched by. Without one every change is an add and a remove.
+	Key      []string `json:"key,omitempty"`
+	Added    int      `json:"added"`
+	Removed  int      `json:"removed"`
+	Modified int      `json:"modified"`
+}
+
+// diffTable is a table of a resource with the tables whose rows reference its rows
+type diffTable struct {
+	name    string
+	columns []string
+	// the column of a child table referencing the parent column
+	foreignKey string
+	parent     string
+	children   []*diffTable
+}
+
+// Compares the fetch of req.FetchID, or every finished fetch that wasn't compared yet, with the
+// rows it superseded and publishes the changes to the sink of req.Sink, CLOUDQUERY_DIFF_SINK or
+// stdout. Needs the rows a fetch superseded, so a fetch is diffed before the snapshot retention
+// removes them.
+func Diff(ctx context.Context, driver, dsn string, req *Request, resp *Response) error {
+	db, err := openDB(driver, dsn)
+	if err != nil {
+		return newTaskError(ErrorTypeDatabase, fmt.Errorf("unable to connect to database: %w", err))
+	}
+	if !skipMigrations(req) {
+		err = db.AutoMigrate(&FetchRecord{}, &FetchScope{})
+		if err != nil {
+			return newTaskError(ErrorTypeDatabase, err)
+		}
+	}
+	target := req.Sink
+	if target == "" {
+		target = os.Getenv("CLOUDQUERY_DIFF_SINK")
+	}
+	sink, err := newChangeSink(target)
+	if err != nil {
+		return newTaskError(ErrorTypeInvalidRequest, err)
+	}
+	defer sink.close()
+
+	var fetches []FetchRecord
+	if req.FetchID != "" {
+		err = db.Where("id = ?", req.FetchID).Find(&fetches).Error
+		if err == nil && len(fetches) == 0 {
+			return newTaskError(ErrorTypeInvalidRequest, fmt.Errorf("fetch %s is not found", req.FetchID))
+		}
+	} else {
+		err = db.Where("finished_at IS NOT NULL AND diffed_at IS NULL AND pruned_at IS NULL").
+			Order("finished_at").Find(&fetches).Error
+	}
+	if err != nil {
+		return newTaskError(ErrorTypeDatabase, err)
+	}
+
+	resp.Diff = &DiffResult{Sink: sink.String(), Fetches: []FetchDiff{}}
+	succeeded, failed := 0, 0
+	for _, fetch := range fetches {
+		if ctx.Err() != nil {
+			break
+		}
+		result, err := diffFetch(db, fetch, sink, req.FetchID != "")
+		if result == nil {
+			// claimed by another invocation
+			continue
+		}
+		if err != nil {
+			result.Error = err.Error()
+			failed++
+		} else {
+			succeeded++
+		}
+		resp.Diff.Fetches = append(resp.Diff.Fetches, *result)
+	}
+	resp.Status = aggregateStatus(succeeded, failed)
+	if resp.Status == StatusFailed {
+		return newTaskError(ErrorTypeDiff, fmt.Errorf("unable to diff %d fetches", failed))
+	}
+	return nil
+}
+
+// Diffs a fetch and publishes its changes. The fetch is claimed by setting diffed_at first, so
+// concurrent invocations don't publish it twice, and released again when the diff fails. The
+// retry publishes the events that went out before the failure again, with the same IDs. force
+// diffs a fetch that was diffed before.
+func diffFetch(db *gorm.DB, fetch FetchRecord, sink changeSink, force bool) (*FetchDiff, error) {
+	result := &FetchDiff{FetchID: fetch.ID, Shard: fetch.Shard}
+	if fetch.FinishedAt == nil {
+		return result, fmt.Errorf("fetch %s hasn't finished", fetch.ID)
+	}
+	if fetch.PrunedAt != nil {
+		return result, fmt.Errorf("the rows fetch %s superseded were removed. Raise CLOUDQUERY_SNAPSHOT_RETENTION to diff older fetches", fetch.ID)
+	}
+	claim := db.Model(&FetchRecord{}).Where("id = ?", fetch.ID)
+	if !force {
+		claim = claim.Where("diffed_at IS NULL")
+	}
+	update := claim.Update("diffed_at", time.Now().UTC())
+	if update.Error != nil {
+		return result, update.Error
+	}
+	if update.RowsAffected == 0 {
+		return nil, nil
+	}
+	err := diffSnapshots(db, fetch, sink, result)
+	if err != nil {
+		release := db.Model(&FetchRecord{}).Where("id = ?", fetch.ID).Update("diffed_at", fetch.DiffedAt).Error
+		if release != nil {
+			err = fmt.Errorf("%w (and unable to release the fetch: %v)", err, release)
+		}
+	}
+	return result, err
+}
+
+func diffSnapshots(db *gorm.DB, fetch FetchRecord, sink changeSink, result *FetchDiff) error {
+	var earlier int64
+	err := db.Model(&FetchRecord{}).Where("shard = ? AND id <> ? AND finished_at IS NOT NULL AND finished_at < ?",
+		fetch.Shard, fetch.ID, *fetch.FinishedAt).Count(&earlier).Error
+	if err != nil {
+		return err
+	}
+	if earlier == 0 {
+		result.Baseline = true
+		return nil
+	}
+	var scopes []FetchScope
+	err = db.Where("fetch_id = ?", fetch.ID).Find(&scopes).Error
+	if err != nil {
+		return err
+	}
+	fetched := map[string]bool{}
+	for _, scope := range scopes {
+		fetched[scope.ScopeTable] = true
+	}
+	tables, err := diffTables(strings.Split(fetch.Providers, ","), fetched)
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		old, err := loadDocuments(db, table, "superseded_by = ?", []interface{}{fetch.ID})
+		if err == nil {
+			var current []map[string]interface{}
+			current, err = loadDocuments(db, table, "fetch_id = ?", []interface{}{fetch.ID})
+			if err == nil {
+				key := naturalKey(table.name, table.columns)
+				events := diffDocuments(table.name, key, old, current, fetch.ID)
+				tableDiff := TableDiff{Table: table.name, Key: key}
+				for _, event := range events {
+					switch event.Type {
+					case ChangeAdded:
+						tableDiff.Added++
+					case ChangeRemoved:
+						tableDiff.Removed++
+					case ChangeModified:
+						tableDiff.Modified++
+					}
+				}
+				result.Tables = append(result.Tables, tableDiff)
+				err = sink.publish(events)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("table %s: %w", table.name, err)
+		}
+	}
+	return nil
+}
+
+// Returns the top level tables of the resources of the providers that the fetch replaced rows of,
+// with their child tables. A child table references its parent with a foreign key.
+func diffTables(providers []string, fetched map[string]bool) ([]*diffTable, error) {
+	var roots []*diffTable
+	for _, provider := range providers {
+		for _, resource := range supportedResources(provider) {
+			catalogTables, err := cachedResourceTables(provider, resource)
+			if err != nil {
+				return nil, err
+			}
+			tables := map[string]*diffTable{}
+			for _, table := range catalogTables {
+				t := &diffTable{name: table.Name}
+				for _, column := range table.Columns {
+					t.columns = append(t.columns, column.Name)
+				}
+				tables[table.Name] = t
+			}
+			for _, table := range catalogTables {
+				t := tables[table.Name]
+				for _, foreignKey := range table.ForeignKeys {
+					if parent := tables[foreignKey.References]; parent != nil && parent != t {
+						t.foreignKey, t.parent = foreignKey.Column, foreignKey.ReferencedColumn
+						parent.children = append(parent.children, t)
+						break
+					}
+				}
+			}
+			for _, table := range catalogTables {
+				if t := tables[table.Name]; t.foreignKey == "" && fetched[table.Name] && table.versioned() {
+					roots = append(roots, t)
+				}
+			}
+		}
+	}
+	return roots, nil
+}
+
+// Loads the rows of a table matching the condition with the rows of its child tables embedded
+// under the names of the child tables
+func loadDocuments(db *gorm.DB, table *diffTable, condition string, args []interface{}) ([]map[string]interface{}, error) {
+	rows, err := db.Raw("SELECT * FROM ? WHERE "+condition, append([]interface{}{clause.Table{Name: table.name}}, args...)...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	docs, err := scanRows(rows, 0)
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	quote := db.Statement.Quote
+	for _, child := range table.children {
+		childCondition := fmt.Sprintf("%s IN (SELECT %s FROM %s WHERE %s)", quote(clause.Column{Name: child.foreignKey}),
+			quote(clause.Column{Name: child.parent}), quote(clause.Table{Name: table.name}), condition)
+		childDocs, err := loadDocuments(db, child, childCondition, args)
+		if err != nil {
+			return nil, fmt.Errorf("table %s: %w", child.name, err)
+		}
+		byParent := map[interface{}][]interface{}{}
+		for _, doc := range childDocs {
+			byParent[doc[child.foreignKey]] = append(byParent[doc[child.foreignKey]], comparedFields(doc, child.foreignKey))
+		}
+		for _, doc := range docs {
+			children := byParent[doc[child.parent]]
+			if children == nil {
+				children = []interface{}{}
+			}
+			sort.Slice(children, func(i, j int) bool { return encodeValue(children[i]) < encodeValue(children[j]) })
+			doc[child.name] = children
+		}
+	}
+	return docs, nil
+}
+
+// Returns the fields of a row that are compared between snapshots
+func comparedFields(doc map[string]interface{}, foreignKey string) map[string]interface{} {
+	fields := make(map[string]interface{}, len(doc))
+	for name, value := range doc {
+		if !diffIgnoredColumns[name] && name != foreignKey {
+			fields[name] = value
+		}
+	}
+	return fields
+}
+
+// Returns the columns that identify a resource across fetches: the scope columns of the table
+// and an identifier column guessed from the table name, since the catalog doesn't record which
+// column the provider APIs identify a resource by. The provider prefix is dropped and the rest of
+// the name, singular, is tried from the longest to the shortest suffix with the endings arn, id,
+// identifier, name and digest: aws_ec2_vpc_peering_connections tries ec2_vpc_peering_connection_arn
+// first and connection_digest last. Then the generic arn, resource_id, uid, self_link, name and
+// cidr columns are tried. Underscores are ignored, so direct_connect_gateway_id matches
+// aws_directconnect_gateways. Returns nil when no column matches, and the rows are then matched by
+// their content. A wrong guess, like a name that isn't unique in its scope, turns the changes of
+// the rows sharing it into pairs of removed and added events.
+func naturalKey(table string, columns []string) []string {
+	has := map[string]string{}
+	for _, column := range columns {
+		has[strings.ReplaceAll(column, "_", "")] = column
+	}
+	var key []string
+	for _, column := range diffScopeColumns {
+		if _, ok := has[strings.ReplaceAll(column, "_", "")]; ok {
+			key = append(key, column)
+		}
+	}
+	parts := strings.Split(table, "_")
+	var candidates []string
+	for i := 1; i < len(parts); i++ {
+		entity := singular(strings.Join(parts[i:], ""))
+		for _, suffix := range []string{"arn", "id", "identifier", "name", "digest"} {
+			candidates = append(candidates, entity+suffix)
+		}
+	}
+	candidates = append(candidates, "arn", "resourceid", "uid", "selflink", "name", "cidr")
+	for _, candidate := range candidates {
+		if column, ok := has[candidate]; ok {
+			return append(key, column)
+		}
+	}
+	return nil
+}
+
+func singular(name string) string {
+	switch {
+	case strings.HasSuffix(name, "ies"):
+		return strings.TrimSuffix(name, "ies") + "y"
+	case strings.HasSuffix(name, "sses"), strings.HasSuffix(name, "xes"), strings.HasSuffix(name, "shes"):
+		return strings.TrimSuffix(name, "es")
+	case strings.HasSuffix(name, "s") && !strings.HasSuffix(name, "ss"):
+		return strings.TrimSuffix(name, "s")
+	}
+	return name
+}
+
+// Matches the rows of two snapshots by their natural key and returns the changes ordered by key.
+// Rows sharing a key are matched in the order of their content.
+func diffDocuments(table string, key []string, old, current []map[string]interface{}, fetchID string) []ChangeEvent {
+	oldByKey, currentByKey := indexDocuments(key, old), indexDocuments(key, current)
+	keys := make([]string, 0, len(oldByKey)+len(currentByKey))
+	for k := range oldByKey {
+		keys = append(keys, k)
+	}
+	for k := range currentByKey {
+		if _, ok := oldByKey[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	now := time.Now().UTC()
+	var events []ChangeEvent
+	for _, k := range keys {
+		before, after := oldByKey[k], currentByKey[k]
+		event := ChangeEvent{ID: changeEventID(fetchID, table, k), Table: table, FetchID: fetchID, DetectedAt: now}
+		switch {
+		case before == nil:
+			event.Type, event.Key, event.Resource = ChangeAdded, keyFields(key, after), comparedFields(after, "")
+		case after == nil:
+			event.Type, event.Key, event.Resource = ChangeRemoved, keyFields(key, before), comparedFields(before, "")
+			event.PreviousFetchID, _ = before["fetch_id"].(string)
+		default:
+			event.Changes = fieldChanges(comparedFields(before, ""), comparedFields(after, ""))
+			if len(event.Changes) == 0 {
+				continue
+			}
+			event.Type, event.Key = ChangeModified, keyFields(key, after)
+			event.PreviousFetchID, _ = before["fetch_id"].(string)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// Identifies the event of the rows with an index key in a table of a fetch
+func changeEventID(fetchID, table, key string) string {
+	sum := sha256.Sum256([]byte(fetchID + "\x00" + table + "\x00" + key))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Indexes the rows by the encoded values of their key, or by their content without a key
+func indexDocuments(key []string, docs []map[string]interface{}) map[string]map[string]interface{} {
+	groups := map[string][]map[string]interface{}{}
+	for _, doc := range docs {
+		var k string
+		if key == nil {
+			k = encodeValue(comparedFields(doc, ""))
+		} else {
+			k = encodeValue(keyFields(key, doc))
+		}
+		groups[k] = append(groups[k], doc)
+	}
+	index := make(map[string]map[string]interface{}, len(docs))
+	for k, group := range groups {
+		sort.Slice(group, func(i, j int) bool {
+			return encodeValue(comparedFields(group[i], "")) < encodeValue(comparedFields(group[j], ""))
+		})
+		for i, doc := range group {
+			if i == 0 {
+				index[k] = doc
+			} else {
+				index[fmt.Sprintf("%s#%d", k, i)] = doc
+			}
+		}
+	}
+	return index
+}
+
+func keyFields(key []string, doc map[string]interface{}) map[string]interface{} {
+	if key == nil {
+		return nil
+	}
+	fields := make(map[string]interface{}, len(key))
+	for _, column := range key {
+		fields[column] = doc[column]
+	}
+	return fields
+}
+
+func fieldChanges(before, after map[string]interface{}) []FieldChange {
+	names := make([]string, 0, len(after))
+	for name := range after {
+		names = append(names, name)
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var changes []FieldChange
+	for _, name := range names {
+		if encodeValue(before[name]) != encodeValue(after[name]) {
+			changes = append(changes, FieldChange{Field: name, Old: before[name], New: after[name]})
+		}
+	}
+	return changes
+}
+
+// Encodes a value for comparison. Maps are encoded with sorted keys.
+func encodeValue(value interface{}) string {
+	data, _ := json.Marshal(value)
+	return string(data)
+}
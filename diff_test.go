@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/cloudquery/cloudquery/providers/aws/ec2"
+)
+
+func TestNaturalKey(t *testing.T) {
+	tests := []struct {
+		table   string
+		columns []string
+		want    []string
+	}{
+		{
+			table:   "aws_ec2_instances",
+			columns: []string{"id", "fetch_id", "account_id", "region", "instance_id", "image_id", "instance_type"},
+			want:    []string{"account_id", "region", "instance_id"},
+		},
+		{
+			table:   "aws_directconnect_gateways",
+			columns: []string{"id", "account_id", "region", "direct_connect_gateway_id", "name"},
+			want:    []string{"account_id", "region", "direct_connect_gateway_id"},
+		},
+		{
+			table:   "aws_ec2_vpc_peering_connections",
+			columns: []string{"id", "account_id", "region", "requester_vpc_id", "vpc_peering_connection_id"},
+			want:    []string{"account_id", "region", "vpc_peering_connection_id"},
+		},
+		{
+			table:   "aws_iam_policies",
+			columns: []string{"id", "account_id", "arn", "policy_id", "policy_name"},
+			want:    []string{"account_id", "policy_id"},
+		},
+		{
+			table:   "gcp_compute_addresses",
+			columns: []string{"id", "project_id", "address", "name", "self_link"},
+			want:    []string{"project_id", "self_link"},
+		},
+		{
+			table:   "k8s_core_pods",
+			columns: []string{"id", "cluster_name", "name", "namespace", "uid"},
+			want:    []string{"cluster_name", "uid"},
+		},
+		{
+			table:   "okta_users",
+			columns: []string{"id", "domain", "status", "profile_login"},
+			want:    nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.table, func(t *testing.T) {
+			if got := naturalKey(tt.table, tt.columns); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("naturalKey() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffDocuments(t *testing.T) {
+	instance := func(fetch, id, instanceType string) map[string]interface{} {
+		return map[string]interface{}{
+			"id": float64(len(fetch)), "fetch_id": fetch, "fetched_at": fetch,
+			"account_id": "123", "instance_id": id, "instance_type": instanceType,
+		}
+	}
+	key := []string{"account_id", "instance_id"}
+	tests := []struct {
+		name    string
+		key     []string
+		old     []map[string]interface{}
+		current []map[string]interface{}
+		want    []ChangeEvent
+	}{
+		{
+			name:    "added, removed and modified",
+			key:     key,
+			old:     []map[string]interface{}{instance("f1", "i-1", "t2.micro"), instance("f1", "i-2", "t2.micro"), instance("f1", "i-3", "t2.micro")},
+			current: []map[string]interface{}{instance("f2", "i-1", "t3.micro"), instance("f2", "i-2", "t2.micro"), instance("f2", "i-4", "t2.micro")},
+			want: []ChangeEvent{
+				{
+					Type: ChangeModified, Key: map[string]interface{}{"account_id": "123", "instance_id": "i-1"}, PreviousFetchID: "f1",
+					Changes: []FieldChange{{Field: "instance_type", Old: "t2.micro", New: "t3.micro"}},
+				},
+				{
+					Type: ChangeRemoved, Key: map[string]interface{}{"account_id": "123", "instance_id": "i-3"}, PreviousFetchID: "f1",
+					Resource: map[string]interface{}{"account_id": "123", "instance_id": "i-3", "instance_type": "t2.micro"},
+				},
+				{
+					Type: ChangeAdded, Key: map[string]interface{}{"account_id": "123", "instance_id": "i-4"},
+					Resource: map[string]interface{}{"account_id": "123", "instance_id": "i-4", "instance_type": "t2.micro"},
+				},
+			},
+		},
+		{
+			name: "child tables are a field",
+			key:  key,
+			old: []map[string]interface{}{{
+				"fetch_id": "f1", "account_id": "123", "instance_id": "i-1",
+				"aws_ec2_instance_tags": []interface{}{map[string]interface{}{"key": "env", "value": "dev"}},
+			}},
+			current: []map[string]interface{}{{
+				"fetch_id": "f2", "account_id": "123", "instance_id": "i-1",
+				"aws_ec2_instance_tags": []interface{}{map[string]interface{}{"key": "env", "value": "prod"}},
+			}},
+			want: []ChangeEvent{{
+				Type: ChangeModified, Key: map[string]interface{}{"account_id": "123", "instance_id": "i-1"}, PreviousFetchID: "f1",
+				Changes: []FieldChange{{
+					Field: "aws_ec2_instance_tags",
+					Old:   []interface{}{map[string]interface{}{"key": "env", "value": "dev"}},
+					New:   []interface{}{map[string]interface{}{"key": "env", "value": "prod"}},
+				}},
+			}},
+		},
+		{
+			name:    "rows sharing a key are matched by content",
+			key:     []string{"account_id"},
+			old:     []map[string]interface{}{instance("f1", "i-2", "t2.micro"), instance("f1", "i-1", "t2.micro")},
+			current: []map[string]interface{}{instance("f2", "i-1", "t2.micro"), instance("f2", "i-2", "t2.micro")},
+		},
+		{
+			name:    "without a key a change is a remove and an add",
+			old:     []map[string]interface{}{instance("f1", "i-1", "t2.micro")},
+			current: []map[string]interface{}{instance("f2", "i-1", "t3.micro")},
+			want: []ChangeEvent{
+				{Type: ChangeRemoved, PreviousFetchID: "f1", Resource: map[string]interface{}{"account_id": "123", "instance_id": "i-1", "instance_type": "t2.micro"}},
+				{Type: ChangeAdded, Resource: map[string]interface{}{"account_id": "123", "instance_id": "i-1", "instance_type": "t3.micro"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diffDocuments("aws_ec2_instances", tt.key, tt.old, tt.current, "f2")
+			if len(got) != len(tt.want) {
+				t.Fatalf("diffDocuments() = %d events, want %d: %+v", len(got), len(tt.want), got)
+			}
+			ids := map[string]bool{}
+			for i, event := range got {
+				if event.ID == "" || ids[event.ID] {
+					t.Errorf("event %d has the id %q, want a unique one", i, event.ID)
+				}
+				ids[event.ID] = true
+				want := tt.want[i]
+				want.ID, want.Table, want.FetchID, want.DetectedAt = event.ID, "aws_ec2_instances", "f2", event.DetectedAt
+				if !reflect.DeepEqual(event, want) {
+					t.Errorf("event %d = %+v, want %+v", i, event, want)
+				}
+			}
+		})
+	}
+}
+
+// A retried diff publishes its events with the same IDs
+func TestDiffDocumentsStableIDs(t *testing.T) {
+	key := []string{"instance_id"}
+	old := []map[string]interface{}{{"instance_id": "i-1", "state": "running"}, {"instance_id": "i-2"}}
+	current := []map[string]interface{}{{"instance_id": "i-1", "state": "stopped"}, {"instance_id": "i-3"}}
+	first := diffDocuments("aws_ec2_instances", key, old, current, "f2")
+	retried := diffDocuments("aws_ec2_instances", key, old, current, "f2")
+	other := diffDocuments("aws_ec2_instances", key, old, current, "f3")
+	if len(first) != 3 || len(retried) != 3 || len(other) != 3 {
+		t.Fatalf("diffDocuments() = %d, %d and %d events, want 3", len(first), len(retried), len(other))
+	}
+	for i := range first {
+		if first[i].ID != retried[i].ID {
+			t.Errorf("event %d got the id %s, then %s", i, first[i].ID, retried[i].ID)
+		}
+		if first[i].ID == other[i].ID {
+			t.Errorf("event %d has the id %s in two fetches", i, first[i].ID)
+		}
+	}
+}
+
+// Returns the change events a file sink wrote
+func readChangeEvents(t *testing.T, path string) []ChangeEvent {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []ChangeEvent
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for decoder.More() {
+		var event ChangeEvent
+		err = decoder.Decode(&event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// failingSink fails every publish
+type failingSink struct{}
+
+func (failingSink) publish(events []ChangeEvent) error {
+	return errors.New("sink is unavailable")
+}
+
+func (failingSink) close() error {
+	return nil
+}
+
+func (failingSink) String() string {
+	return "failing"
+}
+
+// The second fetch of a shard is compared with the rows it superseded, the first one is the
+// baseline. Each fetch is diffed once unless it is asked for by ID.
+func TestDiff(t *testing.T) {
+	dsn := testSQLiteDSN(t)
+	db, err := openDB("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrateTestInstances(t, db)
+	shard := &Shard{Provider: "aws", Account: "111111111111", Region: "us-east-1"}
+	first := testInstances("i-1", "i-2")
+	first[0].InstanceType = aws.String("t3.micro")
+	fetchTestInstances(t, db, "fetch-1", shard, true, first...)
+	path := filepath.Join(filepath.Dir(dsn), "changes.json")
+	var resp Response
+	err = Diff(context.Background(), "sqlite", dsn, &Request{Sink: "file://" + path}, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Diff == nil || len(resp.Diff.Fetches) != 1 || !resp.Diff.Fetches[0].Baseline {
+		t.Fatalf("Diff() = %+v, want the baseline fetch-1", resp.Diff)
+	}
+
+	second := testInstances("i-1", "i-3")
+	second[0].InstanceType = aws.String("t3.large")
+	second[0].Tags = append(second[0].Tags, &ec2.InstanceTag{Key: aws.String("env"), Value: aws.String("prod")})
+	fetchTestInstances(t, db, "fetch-2", shard, true, second...)
+	resp = Response{}
+	err = Diff(context.Background(), "sqlite", dsn, &Request{Sink: "file://" + path}, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantTables := []TableDiff{{Table: "aws_ec2_instances", Key: []string{"account_id", "region", "instance_id"}, Added: 1, Removed: 1, Modified: 1}}
+	if len(resp.Diff.Fetches) != 1 || resp.Diff.Fetches[0].FetchID != "fetch-2" || !reflect.DeepEqual(resp.Diff.Fetches[0].Tables, wantTables) {
+		t.Fatalf("Diff() = %+v, want the changes of fetch-2", resp.Diff)
+	}
+
+	events := readChangeEvents(t, path)
+	if len(events) != 3 {
+		t.Fatalf("Diff() published %d events, want 3", len(events))
+	}
+	for i, want := range []struct {
+		changeType string
+		instanceID string
+	}{{ChangeModified, "i-1"}, {ChangeRemoved, "i-2"}, {ChangeAdded, "i-3"}} {
+		event := events[i]
+		if event.Type != want.changeType || event.Key["instance_id"] != want.instanceID || event.FetchID != "fetch-2" {
+			t.Errorf("event %d = %s of %v in %s, want %s of %s in fetch-2", i, event.Type, event.Key, event.FetchID, want.changeType, want.instanceID)
+		}
+	}
+	var changed []string
+	for _, change := range events[0].Changes {
+		changed = append(changed, change.Field)
+	}
+	if !reflect.DeepEqual(changed, []string{"aws_ec2_instance_tags", "instance_type"}) || events[0].PreviousFetchID != "fetch-1" {
+		t.Errorf("modified event changes %v since %s, want the tags and instance_type since fetch-1", changed, events[0].PreviousFetchID)
+	}
+	if events[1].Resource["instance_id"] != "i-2" || events[2].Resource["instance_id"] != "i-3" {
+		t.Errorf("removed and added resources = %v, %v, want i-2 and i-3", events[1].Resource, events[2].Resource)
+	}
+
+	// both fetches were claimed, so nothing is left to diff
+	resp = Response{}
+	err = Diff(context.Background(), "sqlite", dsn, &Request{Sink: "file://" + path}, &resp)
+	if err != nil || len(resp.Diff.Fetches) != 0 {
+		t.Errorf("Diff() again = %+v, %v, want no fetches", resp.Diff, err)
+	}
+	for _, id := range []string{"fetch-1", "fetch-2"} {
+		if fetch := readFetch(t, db, id); fetch.DiffedAt == nil {
+			t.Errorf("fetch %s wasn't marked as diffed", id)
+		}
+	}
+
+	// a fetch asked for by ID is diffed again with the same event IDs
+	resp = Response{}
+	err = Diff(context.Background(), "sqlite", dsn, &Request{Sink: "file://" + path, FetchID: "fetch-2"}, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again := readChangeEvents(t, path)
+	if len(again) != 6 {
+		t.Fatalf("Diff() of fetch-2 published %d events, want 3 more", len(again)-3)
+	}
+	for i, event := range again[3:] {
+		if event.ID != events[i].ID {
+			t.Errorf("event %d published again with ID %s, want %s", i, event.ID, events[i].ID)
+		}
+	}
+}
+
+// A fetch is claimed through diffed_at while it is diffed and released when publishing fails
+func TestDiffFetchClaim(t *testing.T) {
+	db := openTestDB(t)
+	migrateTestInstances(t, db)
+	shard := &Shard{Provider: "aws", Account: "111111111111", Region: "us-east-1"}
+	fetchTestInstances(t, db, "fetch-1", shard, true, testInstances("i-1")...)
+	fetchTestInstances(t, db, "fetch-2", shard, true, testInstances("i-2")...)
+
+	result, err := diffFetch(db, readFetch(t, db, "fetch-2"), failingSink{}, false)
+	if err == nil || result == nil || !strings.Contains(err.Error(), "sink is unavailable") {
+		t.Fatalf("diffFetch() = %+v, %v, want the error of the sink", result, err)
+	}
+	if fetch := readFetch(t, db, "fetch-2"); fetch.DiffedAt != nil {
+		t.Errorf("fetch-2 diffed at %v after the sink failed, want it released", fetch.DiffedAt)
+	}
+
+	// a fetch another invocation claimed since it was read is skipped
+	fetch := readFetch(t, db, "fetch-2")
+	err = db.Model(&FetchRecord{}).Where("id = ?", "fetch-2").Update("diffed_at", time.Now().UTC()).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = diffFetch(db, fetch, failingSink{}, false)
+	if result != nil || err != nil {
+		t.Errorf("diffFetch() of a claimed fetch = %+v, %v, want it skipped", result, err)
+	}
+
+	// without the rows it superseded a fetch can't be diffed
+	now := time.Now().UTC()
+	fetch.PrunedAt = &now
+	if _, err = diffFetch(db, fetch, failingSink{}, true); err == nil || !strings.Contains(err.Error(), "CLOUDQUERY_SNAPSHOT_RETENTION") {
+		t.Errorf("diffFetch() of a pruned fetch error = %v, want it to point at the retention", err)
+	}
+}
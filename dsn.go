@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/rds/rdsutils"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v4/stdlib"
+)
+
+const (
+	secretsManagerPrefix = "secretsmanager:"
+	rdsIAMPrefix         = "rds-iam://"
+	// Secrets are fetched again after this long to pick up rotations. Set by CLOUDQUERY_SECRET_TTL.
+	defaultSecretTTL = 5 * time.Minute
+	// Name of the TLS config registered with the mysql driver for CLOUDQUERY_DB_CA_BUNDLE
+	mysqlTLSConfig = "cloudquery"
+)
+
+// databaseSource is a resolved CLOUDQUERY_DATABASE_STRING. Connector is set when every new
+// connection needs fresh credentials, as with rds-iam.
+type databaseSource struct {
+	dsn       string
+	connector driver.Connector
+	// version of the secret the DSN was built from
+	version string
+}
+
+// databaseSecret is the JSON of a Secrets Manager database secret, as created by RDS
+type databaseSecret struct {
+	Host     string      `json:"host"`
+	Port     json.Number `json:"port"`
+	Username string      `json:"username"`
+	User     string      `json:"user"`
+	Password string      `json:"password"`
+	DBName   string      `json:"dbname"`
+}
+
+type cachedSecret struct {
+	value     string
+	version   string
+	fetchedAt time.Time
+}
+
+var (
+	secretCache     = map[string]*cachedSecret{}
+	secretCacheLock sync.Mutex
+)
+
+// Resolves the database string. Besides a plain DSN it accepts secretsmanager:<arn or name> of a
+// JSON secret with host, port, username, password and dbname, and rds-iam://user@host:port/dbname
+// which signs a short-lived IAM auth token as the password of every new connection. refresh
+// fetches the secret again even if the cached one hasn't expired.
+func resolveDSN(driverName, dsn string, refresh bool) (*databaseSource, error) {
+	switch {
+	case strings.HasPrefix(dsn, secretsManagerPrefix):
+		secret, err := getSecret(strings.TrimPrefix(dsn, secretsManagerPrefix), refresh)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the database secret: %w", err)
+		}
+		var fields databaseSecret
+		err = json.Unmarshal([]byte(secret.value), &fields)
+		if err != nil {
+			return nil, fmt.Errorf("the database secret should be a JSON object with host, port, username, password and dbname: %w", err)
+		}
+		user := fields.Username
+		if user == "" {
+			user = fields.User
+		}
+		built, err := buildDSN(driverName, fields.Host, fields.Port.String(), user, fields.Password, fields.DBName, false)
+		if err != nil {
+			return nil, err
+		}
+		return &databaseSource{dsn: built, version: secret.version}, nil
+	case strings.HasPrefix(dsn, rdsIAMPrefix):
+		return rdsIAMSource(driverName, dsn)
+	}
+	return &databaseSource{dsn: dsn}, nil
+}
+
+// Returns the secret from the cache, or from Secrets Manager when it expired. The lock is only
+// held to read or write the cache. CLOUDQUERY_SECRETSMANAGER_ENDPOINT overrides the endpoint.
+func getSecret(id string, refresh bool) (*cachedSecret, error) {
+	secretCacheLock.Lock()
+	cached := secretCache[id]
+	secretCacheLock.Unlock()
+	if cached != nil && !refresh && time.Since(cached.fetchedAt) < envDuration("CLOUDQUERY_SECRET_TTL", defaultSecretTTL) {
+		return cached, nil
+	}
+	sess, err := sharedAWSSession()
+	if err != nil {
+		return nil, err
+	}
+	output, err := secretsmanager.New(sess, awsServiceConfig("secretsmanager")).GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(id),
+	})
+	if err != nil {
+		return nil, err
+	}
+	cached = &cachedSecret{
+		value:     aws.StringValue(output.SecretString),
+		version:   aws.StringValue(output.VersionId),
+		fetchedAt: time.Now(),
+	}
+	secretCacheLock.Lock()
+	secretCache[id] = cached
+	secretCacheLock.Unlock()
+	return cached, nil
+}
+
+// Builds the DSN of rds-iam://user@host:port/dbname. The region is taken from ?region= or the
+// AWS_REGION of the function, and the token is signed with the credentials of its role.
+func rdsIAMSource(driverName, dsn string) (*databaseSource, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rds-iam database string: %w", err)
+	}
+	host, port, user, dbName := u.Hostname(), u.Port(), u.User.Username(), strings.TrimPrefix(u.Path, "/")
+	if host == "" || user == "" {
+		return nil, fmt.Errorf("rds-iam database string should look like rds-iam://user@host:port/dbname")
+	}
+	var base driver.Driver
+	switch driverName {
+	case "postgresql":
+		base = stdlib.GetDefaultDriver()
+		if port == "" {
+			port = "5432"
+		}
+	case "mysql":
+		base = &mysql.MySQLDriver{}
+		if port == "" {
+			port = "3306"
+		}
+	default:
+		return nil, fmt.Errorf("rds-iam only supports the postgresql and mysql drivers")
+	}
+	sess, err := sharedAWSSession()
+	if err != nil {
+		return nil, err
+	}
+	region := u.Query().Get("region")
+	if region == "" {
+		region = aws.StringValue(sess.Config.Region)
+	}
+	connector := &iamConnector{driver: base, dsn: func() (string, error) {
+		token, err := rdsutils.BuildAuthToken(net.JoinHostPort(host, port), region, user, sess.Config.Credentials)
+		if err != nil {
+			return "", fmt.Errorf("unable to build the rds-iam auth token: %w", err)
+		}
+		return buildDSN(driverName, host, port, user, token, dbName, true)
+	}}
+	return &databaseSource{dsn: dsn, connector: connector}, nil
+}
+
+// iamConnector opens every connection with a new DSN, as IAM auth tokens expire after 15 minutes
+type iamConnector struct {
+	driver driver.Driver
+	dsn    func() (string, error)
+}
+
+func (c *iamConnector) Connect(context.Context) (driver.Conn, error) {
+	dsn, err := c.dsn()
+	if err != nil {
+		return nil, err
+	}
+	return c.driver.Open(dsn)
+}
+
+func (c *iamConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// Builds a DSN with TLS set by CLOUDQUERY_DB_TLS: verify (the default) checks the server
+// certificate against CLOUDQUERY_DB_CA_BUNDLE or the system roots, require only encrypts and off
+// disables TLS. IAM auth always needs TLS.
+func buildDSN(driverName, host, port, user, password, dbName string, iam bool) (string, error) {
+	mode := os.Getenv("CLOUDQUERY_DB_TLS")
+	if mode == "" || (iam && mode == "off") {
+		mode = "verify"
+	}
+	if mode != "verify" && mode != "require" && mode != "off" {
+		return "", fmt.Errorf("CLOUDQUERY_DB_TLS should be one of verify, require or off")
+	}
+	bundle := os.Getenv("CLOUDQUERY_DB_CA_BUNDLE")
+	switch driverName {
+	case "postgresql":
+		if port == "" {
+			port = "5432"
+		}
+		query := url.Values{}
+		switch mode {
+		case "verify":
+			query.Set("sslmode", "verify-full")
+			if bundle != "" {
+				query.Set("sslrootcert", bundle)
+			}
+		case "require":
+			query.Set("sslmode", "require")
+		default:
+			query.Set("sslmode", "disable")
+		}
+		u := url.URL{
+			Scheme:   "postgres",
+			User:     url.UserPassword(user, password),
+			Host:     net.JoinHostPort(host, port),
+			Path:     "/" + dbName,
+			RawQuery: query.Encode(),
+		}
+		return u.String(), nil
+	case "mysql":
+		if port == "" {
+			port = "3306"
+		}
+		config := mysql.NewConfig()
+		config.User, config.Passwd = user, password
+		config.Net, config.Addr, config.DBName = "tcp", net.JoinHostPort(host, port), dbName
+		config.ParseTime = true
+		config.AllowCleartextPasswords = iam
+		switch {
+		case mode == "verify" && bundle != "":
+			err := registerMySQLTLS(bundle)
+			if err != nil {
+				return "", err
+			}
+			config.TLSConfig = mysqlTLSConfig
+		case mode == "verify":
+			config.TLSConfig = "true"
+		case mode == "require":
+			config.TLSConfig = "skip-verify"
+		}
+		return config.FormatDSN(), nil
+	case "sqlserver":
+		if port == "" {
+			port = "1433"
+		}
+		query := url.Values{"database": {dbName}}
+		switch mode {
+		case "verify":
+			query.Set("encrypt", "true")
+			if bundle != "" {
+				query.Set("certificate", bundle)
+			}
+		case "require":
+			query.Set("encrypt", "true")
+			query.Set("TrustServerCertificate", "true")
+		default:
+			query.Set("encrypt", "disable")
+		}
+		u := url.URL{
+			Scheme:   "sqlserver",
+			User:     url.UserPassword(user, password),
+			Host:     net.JoinHostPort(host, port),
+			RawQuery: query.Encode(),
+		}
+		return u.String(), nil
+	}
+	return "", fmt.Errorf("database secrets only support the postgresql, mysql and sqlserver drivers")
+}
+
+var registerMySQLTLSOnce sync.Once
+var registerMySQLTLSErr error
+
+// Registers the CA bundle, e.g. the RDS global-bundle.pem, with the mysql driver
+func registerMySQLTLS(bundle string) error {
+	registerMySQLTLSOnce.Do(func() {
+		pem, err := ioutil.ReadFile(bundle)
+		if err != nil {
+			registerMySQLTLSErr = fmt.Errorf("unable to read CLOUDQUERY_DB_CA_BUNDLE: %w", err)
+			return
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			registerMySQLTLSErr = fmt.Errorf("CLOUDQUERY_DB_CA_BUNDLE has no PEM certificates")
+			return
+		}
+		registerMySQLTLSErr = mysql.RegisterTLSConfig(mysqlTLSConfig, &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12})
+	})
+	return registerMySQLTLSErr
+}
+
+// Reports whether the database string is resolved from a secret, whose password may be rotated
+func isSecretDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, secretsManagerPrefix)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/aws/aws-lambda-go/lambda/messages"
+)
+
+const (
+	ErrorTypeConfig         = "ConfigError"
+	ErrorTypeDatabase       = "DatabaseError"
+	ErrorTypeFetch          = "FetchError"
+	ErrorTypePolicy         = "PolicyError"
+	ErrorTypeSchema         = "SchemaError"
+	ErrorTypeDiff           = "DiffError"
+	ErrorTypeExport         = "ExportError"
+	ErrorTypeUnknownTask    = "UnknownTask"
+	ErrorTypeInvalidRequest = "InvalidRequest"
+	ErrorTypePanic          = "Panic"
+	ErrorTypeInternal       = "InternalError"
+)
+
+// TaskError carries the error type reported to the Lambda platform alongside the cause
+type TaskError struct {
+	Type string
+	Err  error
+}
+
+func (e *TaskError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TaskError) Unwrap() error {
+	return e.Err
+}
+
+func newTaskError(errorType string, err error) error {
+	return &TaskError{Type: errorType, Err: err}
+}
+
+// Returns the type of a TaskError or InternalError for any other error
+func errorType(err error) string {
+	var taskErr *TaskError
+	if errors.As(err, &taskErr) {
+		return taskErr.Type
+	}
+	return ErrorTypeInternal
+}
+
+// Reports whether an error is returned as a Lambda function error rather than in a failed Response:
+// the request couldn't be decoded or names no task, or the task panicked
+func isFunctionError(err error) bool {
+	switch errorType(err) {
+	case ErrorTypeInvalidRequest, ErrorTypeUnknownTask, ErrorTypePanic:
+		return true
+	}
+	return false
+}
+
+// Converts an error into a Lambda function error so the platform reports our error type
+// instead of the Go type name
+func lambdaError(err error) error {
+	return messages.InvokeResponse_Error{
+		Type:    errorType(err),
+		Message: err.Error(),
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Task run by scheduled events whose detail doesn't name one
+const defaultScheduledTask = "fetch"
+
+// SQSBatchResponse reports the records of an SQS batch that failed, so only they are retried.
+// Requires ReportBatchItemFailures on the event source mapping.
+type SQSBatchResponse struct {
+	BatchItemFailures []SQSBatchItemFailure `json:"batchItemFailures"`
+}
+
+type SQSBatchItemFailure struct {
+	ItemIdentifier string `json:"itemIdentifier"`
+}
+
+// Reports whether the payload is an SQS batch. Only the source is decoded, so a batch with a
+// malformed record is rejected by handleSQS rather than run as a direct invocation.
+func isSQSEvent(keys map[string]json.RawMessage) bool {
+	var records []struct {
+		EventSource string `json:"eventSource"`
+	}
+	err := json.Unmarshal(keys["Records"], &records)
+	return err == nil && len(records) > 0 && records[0].EventSource == "aws:sqs"
+}
+
+// Reports whether the payload is an EventBridge or CloudWatch Events event, e.g. of a schedule rule
+func isEventBridgeEvent(keys map[string]json.RawMessage) bool {
+	_, hasDetailType := keys["detail-type"]
+	_, hasSource := keys["source"]
+	return hasDetailType && hasSource
+}
+
+// Turns an EventBridge event into a task payload. The detail carries the request, e.g. set by an
+// input transformer, and the task defaults to CLOUDQUERY_SCHEDULED_TASK or fetch. Rules with a
+// constant input don't send an event at all, their input is a direct invoke payload.
+func scheduledPayload(payload []byte) ([]byte, error) {
+	var event events.CloudWatchEvent
+	err := json.Unmarshal(payload, &event)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]interface{}{}
+	if len(event.Detail) > 0 && string(event.Detail) != "null" {
+		err = json.Unmarshal(event.Detail, &fields)
+		if err != nil {
+			return nil, fmt.Errorf("event detail should be a request object: %w", err)
+		}
+	}
+	if name, _ := fields["taskName"].(string); name == "" {
+		fields["taskName"] = defaultScheduledTask
+		if env := os.Getenv("CLOUDQUERY_SCHEDULED_TASK"); env != "" {
+			fields["taskName"] = env
+		}
+	}
+	log.Printf("Running task %v for EventBridge event %s (%s)", fields["taskName"], event.ID, event.DetailType)
+	return json.Marshal(fields)
+}
+
+// Runs the request in the body of every record one after the other. Failed records, and the
+// records left when the deadline gets close, are reported as batch item failures.
+func handleSQS(ctx context.Context, payload []byte) (*SQSBatchResponse, error) {
+	var event events.SQSEvent
+	err := json.Unmarshal(payload, &event)
+	if err != nil {
+		return nil, newTaskError(ErrorTypeInvalidRequest, err)
+	}
+	resp := SQSBatchResponse{BatchItemFailures: []SQSBatchItemFailure{}}
+	for _, record := range event.Records {
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < deadlineReserve() {
+			log.Printf("Deadline is close. Returning message %s to the queue", record.MessageId)
+			resp.BatchItemFailures = append(resp.BatchItemFailures, SQSBatchItemFailure{ItemIdentifier: record.MessageId})
+			continue
+		}
+		result, err := handle(ctx, []byte(record.Body))
+		if err != nil {
+			log.Printf("Message %s failed: %s", record.MessageId, err)
+			resp.BatchItemFailures = append(resp.BatchItemFailures, SQSBatchItemFailure{ItemIdentifier: record.MessageId})
+			continue
+		}
+		log.Printf("Message %s: task %s %s", record.MessageId, result.TaskName, result.Status)
+	}
+	return &resp, nil
+}
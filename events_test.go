@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda/messages"
+)
+
+// Registers a task that records the requests it receives
+func registerRecordingTask(t *testing.T, name string) *[]Request {
+	var received []Request
+	registerTestTask(t, name, func(ctx context.Context, req interface{}, resp *Response) error {
+		received = append(received, *req.(*Request))
+		return nil
+	})
+	return &received
+}
+
+func TestLambdaHandlerEvents(t *testing.T) {
+	received := registerRecordingTask(t, "test-record")
+	setenv(t, "CLOUDQUERY_SCHEDULED_TASK", "test-record")
+	tests := []struct {
+		name          string
+		payload       string
+		want          []Request
+		wantErrorType string
+	}{
+		{
+			name:    "direct invocation",
+			payload: `{"taskName": "test-record", "config": "s3://bucket/config.yml", "autoResume": true}`,
+			want:    []Request{{TaskName: "test-record", ConfigPath: "s3://bucket/config.yml", AutoResume: true}},
+		},
+		{
+			name: "eventbridge event with a request",
+			payload: `{"version": "0", "id": "1", "detail-type": "Scheduled Event", "source": "aws.events",
+				"detail": {"taskName": "test-record", "shard": {"provider": "aws", "account": "111111111111"}}}`,
+			want: []Request{{TaskName: "test-record", Shard: &Shard{Provider: "aws", Account: "111111111111"}}},
+		},
+		{
+			name:    "eventbridge event without a task",
+			payload: `{"version": "0", "id": "1", "detail-type": "Scheduled Event", "source": "aws.events", "detail": {}}`,
+			want:    []Request{{TaskName: "test-record"}},
+		},
+		{
+			name:    "eventbridge event without detail",
+			payload: `{"version": "0", "id": "1", "detail-type": "Scheduled Event", "source": "aws.events"}`,
+			want:    []Request{{TaskName: "test-record"}},
+		},
+		{
+			name:          "eventbridge event with a malformed detail",
+			payload:       `{"version": "0", "id": "1", "detail-type": "Scheduled Event", "source": "aws.events", "detail": ["fetch"]}`,
+			wantErrorType: ErrorTypeInvalidRequest,
+		},
+		{name: "malformed payload", payload: `{"taskName": `, wantErrorType: ErrorTypeInvalidRequest},
+		{name: "array payload", payload: `["fetch"]`, wantErrorType: ErrorTypeInvalidRequest},
+		{name: "wrong field type", payload: `{"taskName": "test-record", "autoResume": "yes"}`, wantErrorType: ErrorTypeInvalidRequest},
+		{name: "unknown task", payload: `{"taskName": "fetch-all"}`, wantErrorType: ErrorTypeUnknownTask},
+		{
+			name:          "records of another source",
+			payload:       `{"Records": [{"eventSource": "aws:s3"}]}`,
+			wantErrorType: ErrorTypeUnknownTask,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*received = nil
+			resp, err := LambdaHandler(context.Background(), json.RawMessage(tt.payload))
+			if tt.wantErrorType != "" {
+				invokeErr, ok := err.(messages.InvokeResponse_Error)
+				if !ok || invokeErr.Type != tt.wantErrorType {
+					t.Fatalf("LambdaHandler() = %v, %v, want a %s function error", resp, err, tt.wantErrorType)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := resp.(*Response); !ok {
+				t.Errorf("LambdaHandler() = %T, want a *Response", resp)
+			}
+			if !reflect.DeepEqual(*received, tt.want) {
+				t.Errorf("LambdaHandler() ran %+v, want %+v", *received, tt.want)
+			}
+		})
+	}
+}
+
+func sqsEvent(bodies ...string) string {
+	var event events.SQSEvent
+	for i, body := range bodies {
+		event.Records = append(event.Records, events.SQSMessage{
+			MessageId:   fmt.Sprintf("m%d", i+1),
+			EventSource: "aws:sqs",
+			Body:        body,
+		})
+	}
+	data, _ := json.Marshal(event)
+	return string(data)
+}
+
+func TestLambdaHandlerSQS(t *testing.T) {
+	received := registerRecordingTask(t, "test-record")
+	registerTestTask(t, "test-fail", func(ctx context.Context, req interface{}, resp *Response) error {
+		return newTaskError(ErrorTypeFetch, errors.New("all 1 providers failed"))
+	})
+	payload := sqsEvent(
+		`{"taskName": "test-record", "shard": {"provider": "aws", "account": "111111111111", "region": "us-east-1"}}`,
+		`{"taskName": "fetch-all"}`,
+		`not json`,
+		`{"taskName": "test-fail"}`,
+		`{"taskName": "test-record", "continuationToken": "abc"}`,
+	)
+	resp, err := LambdaHandler(context.Background(), json.RawMessage(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, ok := resp.(*SQSBatchResponse)
+	if !ok {
+		t.Fatalf("LambdaHandler() = %T, want an *SQSBatchResponse", resp)
+	}
+	wantFailures := []SQSBatchItemFailure{{ItemIdentifier: "m2"}, {ItemIdentifier: "m3"}, {ItemIdentifier: "m4"}}
+	if !reflect.DeepEqual(batch.BatchItemFailures, wantFailures) {
+		t.Errorf("LambdaHandler() failures = %+v, want %+v", batch.BatchItemFailures, wantFailures)
+	}
+	want := []Request{
+		{TaskName: "test-record", Shard: &Shard{Provider: "aws", Account: "111111111111", Region: "us-east-1"}},
+		{TaskName: "test-record", ContinuationToken: "abc"},
+	}
+	if !reflect.DeepEqual(*received, want) {
+		t.Errorf("LambdaHandler() ran %+v, want %+v", *received, want)
+	}
+
+	// the records left when the deadline is close go back to the queue
+	*received = nil
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	resp, err = LambdaHandler(ctx, json.RawMessage(sqsEvent(`{"taskName": "test-record"}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantFailures = []SQSBatchItemFailure{{ItemIdentifier: "m1"}}
+	if batch := resp.(*SQSBatchResponse); !reflect.DeepEqual(batch.BatchItemFailures, wantFailures) || len(*received) > 0 {
+		t.Errorf("LambdaHandler() close to the deadline failures = %+v, want %+v", batch.BatchItemFailures, wantFailures)
+	}
+
+	_, err = LambdaHandler(context.Background(), json.RawMessage(`{"Records": [{"eventSource": "aws:sqs", "body": 1}]}`))
+	if invokeErr, ok := err.(messages.InvokeResponse_Error); !ok || invokeErr.Type != ErrorTypeInvalidRequest {
+		t.Errorf("LambdaHandler() with a malformed record error = %v, want a %s function error", err, ErrorTypeInvalidRequest)
+	}
+}
+
+func TestLambdaHandlerHTTP(t *testing.T) {
+	useRunDatabase(t)
+	setenv(t, "CLOUDQUERY_API_TOKENS", "token")
+	tests := []struct {
+		name       string
+		payload    string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name: "function url",
+			payload: `{"version": "2.0", "rawPath": "/runs/run-1", "headers": {"authorization": "Bearer token"},
+				"requestContext": {"stage": "$default", "http": {"method": "GET", "path": "/runs/run-1"}}}`,
+			wantStatus: http.StatusNotFound,
+			wantBody:   "run run-1 not found",
+		},
+		{
+			name: "rest api with a stage",
+			payload: `{"httpMethod": "GET", "path": "/prod/runs/run-1", "headers": {"Authorization": "Bearer token"},
+				"requestContext": {"stage": "prod"}}`,
+			wantStatus: http.StatusNotFound,
+			wantBody:   "run run-1 not found",
+		},
+		{
+			name: "without a token",
+			payload: `{"version": "2.0", "rawPath": "/runs/run-1",
+				"requestContext": {"http": {"method": "GET", "path": "/runs/run-1"}}}`,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "malformed base64 body",
+			payload: `{"version": "2.0", "rawPath": "/query", "body": "not base64!", "isBase64Encoded": true,
+				"requestContext": {"http": {"method": "POST", "path": "/query"}}}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "malformed event",
+			payload:    `{"httpMethod": "GET", "path": 1}`,
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := LambdaHandler(context.Background(), json.RawMessage(tt.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			httpResp, ok := resp.(*events.APIGatewayV2HTTPResponse)
+			if !ok {
+				t.Fatalf("LambdaHandler() = %T, want an HTTP response", resp)
+			}
+			if httpResp.StatusCode != tt.wantStatus || !strings.Contains(httpResp.Body, tt.wantBody) {
+				t.Errorf("LambdaHandler() = %d %s, want %d %s", httpResp.StatusCode, httpResp.Body, tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+}
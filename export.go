@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// Partition of the rows of resources that aren't fetched per account or region
+	exportGlobalPartition = "global"
+	// Rows selected per query, below the limit sqlite sets on the variables of a statement
+	exportQueryBatchSize = 500
+)
+
+// ExportResult counts the objects an exporting fetch wrote
+type ExportResult struct {
+	Destination string `json:"destination"`
+	Objects     int    `json:"objects"`
+	Rows        int    `json:"rows"`
+	Error       string `json:"error,omitempty"`
+}
+
+// objectSink stores the exported objects under keys relative to the destination
+type objectSink interface {
+	put(key string, data []byte) error
+	// URL of a key, as used in the LOCATION of the DDL
+	location(key string) string
+}
+
+// exporter writes the rows a unit fetched as gzipped JSON lines under
+// table=<name>/account=<id>/region=<region>/dt=<date>/, with the Athena DDL of every table under ddl/
+type exporter struct {
+	sink   objectSink
+	lock   sync.Mutex
+	ddl    map[string]bool
+	result ExportResult
+}
+
+// Returns the exporter of the destination: s3://bucket/prefix or file:///path
+func newExporter(destination string) (*exporter, error) {
+	u, err := url.Parse(destination)
+	if err != nil {
+		return nil, fmt.Errorf("invalid export destination: %w", err)
+	}
+	var sink objectSink
+	switch u.Scheme {
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("export destination %s should be in format s3://bucket/prefix", destination)
+		}
+		sess, err := sharedAWSSession()
+		if err != nil {
+			return nil, err
+		}
+		sink = &s3ObjectSink{bucket: u.Host, prefix: strings.Trim(u.Path, "/"), client: s3.New(sess, awsServiceConfig("s3"))}
+	case "file":
+		sink = &fileObjectSink{dir: u.Path}
+	default:
+		return nil, fmt.Errorf("export destination should be s3://bucket/prefix or file:///path, not %s", destination)
+	}
+	return &exporter{sink: sink, ddl: map[string]bool{}, result: ExportResult{Destination: destination}}, nil
+}
+
+// Returns the export destination of the request, or CLOUDQUERY_EXPORT
+func exportDestination(req *Request) string {
+	if req.Export != "" {
+		return req.Export
+	}
+	return os.Getenv("CLOUDQUERY_EXPORT")
+}
+
+// Exports the rows a finished unit wrote, selected by the primary keys the run recorded for every
+// table. Rows are partitioned by their account_id and region columns. Child tables have neither,
+// so their rows go to the partition of the row they reference.
+func (e *exporter) exportRows(db *gorm.DB, runID string, written map[string][]interface{}) error {
+	tables := make([]CatalogTable, 0, len(written))
+	depths := map[string]int{}
+	for name := range written {
+		table, err := exportTable(name)
+		if err != nil {
+			return err
+		}
+		tables = append(tables, table)
+		depths[name] = exportDepth(table)
+	}
+	// parents go first, so the partitions of their rows are known when their children are exported
+	sort.Slice(tables, func(i, j int) bool {
+		if depths[tables[i].Name] != depths[tables[j].Name] {
+			return depths[tables[i].Name] < depths[tables[j].Name]
+		}
+		return tables[i].Name < tables[j].Name
+	})
+	date := time.Now().UTC().Format("2006-01-02")
+	// the partitions of the exported rows by table and primary key
+	rowPartitions := map[string]map[string]exportPartition{}
+	for _, table := range tables {
+		keys := written[table.Name]
+		primaryKey := exportPrimaryKey(table)
+		var docs []map[string]interface{}
+		for start := 0; start < len(keys); start += exportQueryBatchSize {
+			end := start + exportQueryBatchSize
+			if end > len(keys) {
+				end = len(keys)
+			}
+			rows, err := db.Raw("SELECT * FROM ? WHERE ? IN ? AND fetch_id = ?", clause.Table{Name: table.Name},
+				clause.Column{Name: primaryKey}, keys[start:end], runID).Rows()
+			if err != nil {
+				return fmt.Errorf("table %s: %w", table.Name, err)
+			}
+			batch, err := scanRows(rows, 0)
+			rows.Close()
+			if err != nil {
+				return fmt.Errorf("table %s: %w", table.Name, err)
+			}
+			docs = append(docs, batch...)
+		}
+
+		parent, hasParent := exportParentKey(table)
+		rowPartitions[table.Name] = map[string]exportPartition{}
+		partitions := map[exportPartition][]map[string]interface{}{}
+		for _, doc := range docs {
+			partition, ok := rowPartition(doc)
+			if !ok && hasParent {
+				partition, ok = rowPartitions[parent.References][fmt.Sprint(doc[parent.Column])]
+			}
+			if !ok {
+				partition = exportPartition{account: exportGlobalPartition, region: exportGlobalPartition}
+			}
+			rowPartitions[table.Name][fmt.Sprint(doc[primaryKey])] = partition
+			partitions[partition] = append(partitions[partition], doc)
+		}
+		sum := fnv.New32a()
+		_, _ = sum.Write([]byte(encodeValue(keys)))
+		for partition, docs := range partitions {
+			data, err := encodeExportRows(table, docs)
+			if err != nil {
+				return fmt.Errorf("table %s: %w", table.Name, err)
+			}
+			key := fmt.Sprintf("table=%s/account=%s/region=%s/dt=%s/%s-%08x.json.gz", table.Name,
+				url.PathEscape(partition.account), url.PathEscape(partition.region), date, runID, sum.Sum32())
+			err = e.sink.put(key, data)
+			if err != nil {
+				return fmt.Errorf("table %s: %w", table.Name, err)
+			}
+			e.lock.Lock()
+			e.result.Objects++
+			e.result.Rows += len(docs)
+			e.lock.Unlock()
+		}
+		err := e.writeDDL(table)
+		if err != nil {
+			return fmt.Errorf("table %s: %w", table.Name, err)
+		}
+	}
+	return nil
+}
+
+// Returns the primary key column of a versioned table
+func exportPrimaryKey(table CatalogTable) string {
+	for _, column := range table.Columns {
+		if column.PrimaryKey {
+			return column.Name
+		}
+	}
+	return "id"
+}
+
+// Returns the foreign key of a child table that references its parent
+func exportParentKey(table CatalogTable) (CatalogForeignKey, bool) {
+	for _, foreignKey := range table.ForeignKeys {
+		if foreignKey.References != table.Name {
+			return foreignKey, true
+		}
+	}
+	return CatalogForeignKey{}, false
+}
+
+// Returns the number of parents above a table
+func exportDepth(table CatalogTable) int {
+	seen := map[string]bool{table.Name: true}
+	for depth := 0; ; depth++ {
+		foreignKey, ok := exportParentKey(table)
+		if !ok || seen[foreignKey.References] {
+			return depth
+		}
+		parent, err := exportTable(foreignKey.References)
+		if err != nil {
+			return depth
+		}
+		seen[parent.Name] = true
+		table = parent
+	}
+}
+
+// Records the first export error of the run
+func (e *exporter) fail(err error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.result.Error == "" {
+		e.result.Error = err.Error()
+	}
+}
+
+// Returns a copy of the counts of the run
+func (e *exporter) report() *ExportResult {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	result := e.result
+	return &result
+}
+
+// Writes the DDL of a table once per invocation
+func (e *exporter) writeDDL(table CatalogTable) error {
+	e.lock.Lock()
+	written := e.ddl[table.Name]
+	e.ddl[table.Name] = true
+	e.lock.Unlock()
+	if written {
+		return nil
+	}
+	return e.sink.put("ddl/"+table.Name+".sql", []byte(athenaDDL(table, e.sink.location("table="+table.Name+"/"))))
+}
+
+type exportPartition struct {
+	account string
+	region  string
+}
+
+// Returns the partition of a row of a table with an account_id column. Global resources have no region.
+func rowPartition(doc map[string]interface{}) (exportPartition, bool) {
+	account, ok := doc["account_id"]
+	if !ok {
+		return exportPartition{}, false
+	}
+	partition := exportPartition{account: exportGlobalPartition, region: exportGlobalPartition}
+	if s, _ := account.(string); s != "" {
+		partition.account = s
+	}
+	if s, _ := doc["region"].(string); s != "" {
+		partition.region = s
+	}
+	return partition, true
+}
+
+// Encodes the rows as gzipped JSON lines with the values typed by the columns of the table.
+// superseded_by is left out, as it is never set when a unit finishes.
+func encodeExportRows(table CatalogTable, docs []map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	encoder := json.NewEncoder(w)
+	for _, doc := range docs {
+		row := make(map[string]interface{}, len(table.Columns))
+		for _, column := range table.Columns {
+			if column.Name != "superseded_by" {
+				row[column.Name] = exportValue(column.Type, doc[column.Name])
+			}
+		}
+		err := encoder.Encode(row)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := w.Close()
+	return buf.Bytes(), err
+}
+
+// Converts a scanned value to the JSON type of the column. sqlite stores booleans as 1 and 0.
+func exportValue(columnType string, value interface{}) interface{} {
+	s, ok := value.(string)
+	if !ok {
+		return value
+	}
+	switch athenaType(columnType) {
+	case "bigint":
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n
+		}
+	case "double":
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b
+		}
+	}
+	return s
+}
+
+// Maps the sqlite type of a catalog column to an Athena type. Decimals are read as doubles and
+// times are kept as ISO 8601 strings.
+func athenaType(columnType string) string {
+	switch strings.ToLower(columnType) {
+	case "integer", "bigint", "int":
+		return "bigint"
+	case "real", "double", "float", "numeric", "decimal":
+		return "double"
+	case "boolean":
+		return "boolean"
+	}
+	return "string"
+}
+
+// Returns the CREATE EXTERNAL TABLE statement of a table. Columns named like a partition, such as
+// region, are left out as Athena reads them from the partition.
+func athenaDDL(table CatalogTable, location string) string {
+	partitions := []string{"account", "region", "dt"}
+	isPartition := map[string]bool{}
+	for _, partition := range partitions {
+		isPartition[partition] = true
+	}
+	var columns []string
+	for _, column := range table.Columns {
+		if column.Name != "superseded_by" && !isPartition[column.Name] {
+			columns = append(columns, fmt.Sprintf("  `%s` %s", column.Name, athenaType(column.Type)))
+		}
+	}
+	var partitionColumns []string
+	for _, partition := range partitions {
+		partitionColumns = append(partitionColumns, fmt.Sprintf("`%s` string", partition))
+	}
+	return fmt.Sprintf("CREATE EXTERNAL TABLE IF NOT EXISTS `%s` (\n%s\n)\nPARTITIONED BY (%s)\n"+
+		"ROW FORMAT SERDE 'org.openx.data.jsonserde.JsonSerDe'\nLOCATION '%s';\n",
+		table.Name, strings.Join(columns, ",\n"), strings.Join(partitionColumns, ", "), location)
+}
+
+var (
+	exportTableCache map[string]CatalogTable
+	exportTableLock  sync.Mutex
+)
+
+// Returns the catalog entry of a provider table
+func exportTable(name string) (CatalogTable, error) {
+	exportTableLock.Lock()
+	defer exportTableLock.Unlock()
+	if exportTableCache == nil {
+		tables := map[string]CatalogTable{}
+		for provider := range resourceRegistry {
+			for _, resource := range supportedResources(provider) {
+				resourceTables, err := cachedResourceTables(provider, resource)
+				if err != nil {
+					return CatalogTable{}, err
+				}
+				for _, table := range resourceTables {
+					tables[table.Name] = table
+				}
+			}
+		}
+		exportTableCache = tables
+	}
+	table, ok := exportTableCache[name]
+	if !ok {
+		return CatalogTable{}, fmt.Errorf("table %s is not in the catalog", name)
+	}
+	return table, nil
+}
+
+type s3ObjectSink struct {
+	bucket string
+	prefix string
+	client *s3.S3
+}
+
+func (s *s3ObjectSink) key(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+	return s.prefix + "/" + key
+}
+
+func (s *s3ObjectSink) put(key string, data []byte) error {
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+		Body:   bytes.NewReader(data),
+	}
+	_, err := s.client.PutObject(input)
+	return err
+}
+
+func (s *s3ObjectSink) location(key string) string {
+	return "s3://" + s.bucket + "/" + s.key(key)
+}
+
+type fileObjectSink struct {
+	dir string
+}
+
+func (s *fileObjectSink) put(key string, data []byte) error {
+	path := filepath.Join(s.dir, filepath.FromSlash(key))
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func (s *fileObjectSink) location(key string) string {
+	return "file://" + filepath.ToSlash(filepath.Join(s.dir, filepath.FromSlash(key))) + "/"
+}
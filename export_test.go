@@ -0,0 +1,179 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/cloudquery/cloudquery/providers/aws/ec2"
+	"go.uber.org/zap"
+)
+
+func TestAthenaType(t *testing.T) {
+	tests := map[string]string{
+		"integer":  "bigint",
+		"INTEGER":  "bigint",
+		"real":     "double",
+		"numeric":  "double",
+		"decimal":  "double",
+		"boolean":  "boolean",
+		"text":     "string",
+		"datetime": "string",
+		"blob":     "string",
+	}
+	for columnType, want := range tests {
+		if got := athenaType(columnType); got != want {
+			t.Errorf("athenaType(%q) = %q, want %q", columnType, got, want)
+		}
+	}
+}
+
+func TestExportValue(t *testing.T) {
+	tests := []struct {
+		columnType string
+		value      interface{}
+		want       interface{}
+	}{
+		{columnType: "integer", value: "42", want: int64(42)},
+		{columnType: "real", value: "1.5", want: 1.5},
+		{columnType: "numeric", value: "12.25", want: 12.25},
+		{columnType: "boolean", value: "1", want: true},
+		{columnType: "boolean", value: "false", want: false},
+		{columnType: "integer", value: "n/a", want: "n/a"},
+		{columnType: "text", value: "1", want: "1"},
+		{columnType: "integer", value: nil, want: nil},
+	}
+	for _, tt := range tests {
+		if got := exportValue(tt.columnType, tt.value); got != tt.want {
+			t.Errorf("exportValue(%q, %v) = %#v, want %#v", tt.columnType, tt.value, got, tt.want)
+		}
+	}
+}
+
+// A unit that only inserts, without deleting earlier rows first, is exported too, with the rows of
+// child tables in the partition of their parent
+func TestExportRows(t *testing.T) {
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dsn := filepath.Join(dir, "fetch.db")
+	defer forgetDB("sqlite", dsn)
+	db, err := openDB("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrateTestInstances(t, db)
+
+	run, err := newFetchRun(context.Background(), db, zap.NewNop(), "run-1", "", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exportDir := filepath.Join(dir, "export")
+	run.export, err = newExporter("file://" + exportDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = run.addSnapshotTables("aws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	instances := []ec2.Instance{
+		{
+			AccountID: "123456789012", Region: "us-east-1", InstanceId: aws.String("i-1"), InstanceType: aws.String("t3.micro"),
+			EbsOptimized: aws.Bool(true), Tags: []*ec2.InstanceTag{{Key: aws.String("env"), Value: aws.String("prod")}},
+		},
+		{
+			AccountID: "123456789012", Region: "eu-west-1", InstanceId: aws.String("i-2"), EbsOptimized: aws.Bool(false),
+			Tags: []*ec2.InstanceTag{{Key: aws.String("env"), Value: aws.String("dev")}, {Key: aws.String("team"), Value: aws.String("infra")}},
+		},
+	}
+	err = run.snapshotDB(db).Create(&instances).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	unit := fetchUnit{Provider: "aws", Account: "123456789012", Resource: "ec2.instances"}
+	run.commitScopes(unit)
+	// nothing was written since
+	run.commitScopes(unit)
+
+	result := run.export.report()
+	if result.Error != "" || result.Objects != 4 || result.Rows != 5 {
+		t.Errorf("export result = %+v, want 4 objects and 5 rows", result)
+	}
+	objects := map[string][]map[string]interface{}{}
+	err = filepath.Walk(exportDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !strings.HasSuffix(path, ".json.gz") {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		decoder := json.NewDecoder(r)
+		rel, _ := filepath.Rel(exportDir, filepath.Dir(path))
+		for decoder.More() {
+			var row map[string]interface{}
+			err = decoder.Decode(&row)
+			if err != nil {
+				return err
+			}
+			objects[filepath.ToSlash(rel)] = append(objects[filepath.ToSlash(rel)], row)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var partitions []string
+	for partition := range objects {
+		partitions = append(partitions, partition[:strings.LastIndex(partition, "/dt=")])
+	}
+	sort.Strings(partitions)
+	want := []string{
+		"table=aws_ec2_instance_tags/account=123456789012/region=eu-west-1",
+		"table=aws_ec2_instance_tags/account=123456789012/region=us-east-1",
+		"table=aws_ec2_instances/account=123456789012/region=eu-west-1",
+		"table=aws_ec2_instances/account=123456789012/region=us-east-1",
+	}
+	if strings.Join(partitions, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("exported partitions\n%s\nwant\n%s", strings.Join(partitions, "\n"), strings.Join(want, "\n"))
+	}
+	for partition, rows := range objects {
+		if strings.HasPrefix(partition, "table=aws_ec2_instances/") && strings.Contains(partition, "us-east-1") {
+			row := rows[0]
+			if row["instance_id"] != "i-1" || row["instance_type"] != "t3.micro" || row["ebs_optimized"] != true || row["fetch_id"] != "run-1" {
+				t.Errorf("exported instance = %v", row)
+			}
+		}
+		if strings.HasPrefix(partition, "table=aws_ec2_instance_tags/") && strings.Contains(partition, "eu-west-1") && len(rows) != 2 {
+			t.Errorf("exported %d tags of i-2, want 2", len(rows))
+		}
+	}
+
+	ddl, err := ioutil.ReadFile(filepath.Join(exportDir, "ddl", "aws_ec2_instances.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, column := range []string{"`ebs_optimized` boolean", "`instance_type` string", "`id` bigint"} {
+		if !strings.Contains(string(ddl), column) {
+			t.Errorf("DDL doesn't declare %s:\n%s", column, ddl)
+		}
+	}
+	if strings.Contains(string(ddl), "  `region` string,") {
+		t.Errorf("DDL declares the region column, which is a partition:\n%s", ddl)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"go.uber.org/multierr"
+)
+
+// The vendored providers call log.Fatal when a resource fails, which would exit the warm runtime.
+// The standard logger writes through fatalWriter, which turns a log.Fatal of a provider into an
+// error instead: a panic when it runs under runProvider, which recovers it, or the end of the
+// goroutine otherwise, e.g. the goroutine of an aws resource, with the error kept for
+// takeProviderFatals. Any other log.Fatal still exits.
+func init() {
+	log.SetOutput(fatalWriter{out: os.Stderr})
+}
+
+// fatalError is the message of a log.Fatal
+type fatalError struct {
+	message string
+}
+
+func (e *fatalError) Error() string {
+	return e.message
+}
+
+// log.Fatal only passes on the text of an error. aws errors start with their code, which is
+// turned back into an aws error so resourceOutcome can classify it.
+func (e *fatalError) Unwrap() error {
+	i := strings.Index(e.message, ": ")
+	if i <= 0 || strings.ContainsAny(e.message[:i], " \t") {
+		return nil
+	}
+	return awserr.New(e.message[:i], e.message[i+2:], nil)
+}
+
+var providerFatals struct {
+	sync.Mutex
+	errs []error
+}
+
+// Returns and forgets the errors of the log.Fatal calls that ended provider goroutines
+func takeProviderFatals() error {
+	providerFatals.Lock()
+	defer providerFatals.Unlock()
+	err := multierr.Combine(providerFatals.errs...)
+	providerFatals.errs = nil
+	return err
+}
+
+// Name of runProvider in stack frames, which depends on the package path of the binary
+var runProviderFunction = runtime.FuncForPC(reflect.ValueOf(runProvider).Pointer()).Name()
+
+// Date and time the standard logger adds to every message
+var logTimestamp = regexp.MustCompile(`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}(\.\d+)? `)
+
+type fatalWriter struct {
+	out io.Writer
+}
+
+func (w fatalWriter) Write(p []byte) (int, error) {
+	n, err := w.out.Write(p)
+	fatal, recoverable, provider := fatalCaller()
+	if !fatal {
+		return n, err
+	}
+	fatalErr := &fatalError{message: strings.TrimSpace(logTimestamp.ReplaceAllString(string(p), ""))}
+	switch {
+	case recoverable:
+		panic(fatalErr)
+	case provider:
+		providerFatals.Lock()
+		providerFatals.errs = append(providerFatals.errs, fatalErr)
+		providerFatals.Unlock()
+		// runs the deferred calls of the goroutine, such as the Done of its wait group
+		runtime.Goexit()
+	}
+	return n, err
+}
+
+// Reports whether the standard logger writes for a log.Fatal, whether runProvider is on the
+// stack to recover a panic, and whether the goroutine runs vendored provider code
+func fatalCaller() (fatal, recoverable, provider bool) {
+	pcs := make([]uintptr, 128)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		frame, more := frames.Next()
+		switch frame.Function {
+		case "log.Fatal", "log.Fatalf", "log.Fatalln", "log.(*Logger).Fatal", "log.(*Logger).Fatalf", "log.(*Logger).Fatalln":
+			fatal = true
+		case runProviderFunction:
+			recoverable = true
+		}
+		if strings.HasPrefix(frame.Function, "github.com/cloudquery/cloudquery/providers/") {
+			provider = true
+		}
+		if !more {
+			return fatal, recoverable, provider
+		}
+	}
+}
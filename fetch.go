@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/cloudquery/cloudquery/cloudqueryclient"
+	"github.com/cloudquery/cloudquery/providers/azure"
+	"github.com/cloudquery/cloudquery/providers/gcp"
+	"github.com/cloudquery/cloudquery/providers/k8s"
+	"github.com/cloudquery/cloudquery/providers/okta"
+	"github.com/cloudquery/cloudquery/providers/provider"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gorm.io/gorm"
+)
+
+func init() {
+	RegisterTask("fetch", Task{
+		Description: "Fetches the resources in config.yml and saves them in the configured database",
+		NewRequest:  func() interface{} { return &Request{} },
+		Run: func(ctx context.Context, req interface{}, resp *Response) error {
+			return Fetch(ctx, DRIVER, DSN, VERBOSE, req.(*Request), resp)
+		},
+	})
+}
+
+// Same providers as cloudqueryclient.ProviderMap except for aws, which is replaced by
+// awsProvider so a failing resource is reported instead of exiting the process.
+var providerMap = map[string]func(*gorm.DB, *zap.Logger) (provider.Interface, error){
+	"aws":   newAWSProvider,
+	"gcp":   gcp.NewProvider,
+	"okta":  okta.NewProvider,
+	"azure": azure.NewProvider,
+	"k8s":   k8s.NewProvider,
+}
+
+// Fetches resources from a cloud provider and saves them in the configured database. The fetch
+// stops starting new resources shortly before the deadline of ctx and returns a continuation
+// token that resumes it. With an export destination every finished resource is also exported,
+// and without a database the rows are kept in a sqlite database in /tmp. With
+// CLOUDQUERY_SQLITE_SNAPSHOT that database is restored from and uploaded to S3.
+func Fetch(ctx context.Context, driver, dsn string, verbose bool, req *Request, resp *Response) (err error) {
+	destination := exportDestination(req)
+	snapshotLocation := sqliteSnapshotLocation()
+	if snapshotLocation != "" {
+		driver, dsn, err = sqliteSnapshotDatabase(driver, dsn)
+		if err != nil {
+			return newTaskError(ErrorTypeConfig, err)
+		}
+		err = restoreSQLiteSnapshot(snapshotLocation, dsn)
+		if err != nil {
+			return newTaskError(ErrorTypeDatabase, fmt.Errorf("unable to restore the sqlite snapshot: %w", err))
+		}
+	} else if driver == "" && destination != "" {
+		// the rows only pass through the database on their way to the export
+		driver, dsn = "sqlite", scratchDSN
+	}
+	db, err := openDB(driver, dsn)
+	if err != nil {
+		return newTaskError(ErrorTypeDatabase, fmt.Errorf("unable to initialize client: %w", err))
+	}
+	logger, err := cloudqueryclient.NewLogger(verbose)
+	if err != nil {
+		return newTaskError(ErrorTypeInternal, fmt.Errorf("unable to initialize client: %w", err))
+	}
+	config, err := resolveConfig(req)
+	if err != nil {
+		return newTaskError(ErrorTypeConfig, err)
+	}
+	if req.Shard != nil {
+		resp.Shard = req.Shard
+		config, err = narrowConfig(config, req.Shard)
+		if err != nil {
+			return newTaskError(ErrorTypeConfig, err)
+		}
+	}
+	names := make([]string, 0, len(config.Providers))
+	for _, provider := range config.Providers {
+		names = append(names, provider.Name)
+	}
+	skip := skipMigrations(req)
+	if skip {
+		err = checkSchema(db, names)
+		if err != nil {
+			return newTaskError(ErrorTypeSchema, err)
+		}
+	}
+	run, err := newFetchRun(ctx, db, logger, req.RunID, req.ContinuationToken, req.Shard, skip)
+	if errorType(err) == ErrorTypeInvalidRequest {
+		return err
+	}
+	if err != nil {
+		return newTaskError(ErrorTypeDatabase, fmt.Errorf("unable to load checkpoints: %w", err))
+	}
+	resp.RunID = run.id
+	if destination != "" {
+		run.export, err = newExporter(destination)
+		if err != nil {
+			return newTaskError(ErrorTypeConfig, err)
+		}
+		defer func() { resp.Export = run.export.report() }()
+	}
+	if snapshotLocation != "" {
+		// also after a stopped or failed fetch, so the next invocation resumes from it
+		defer func() {
+			location, uploadErr := uploadSQLiteSnapshot(db, snapshotLocation, dsn, run.id)
+			if uploadErr != nil {
+				logger.Error("Unable to upload the sqlite snapshot", zap.String("run_id", run.id), zap.Error(uploadErr))
+				if err == nil {
+					err = newTaskError(ErrorTypeDatabase, fmt.Errorf("unable to upload the sqlite snapshot: %w", uploadErr))
+				}
+				return
+			}
+			resp.SQLiteSnapshot = location
+		}()
+	}
+	err = run.start(req.Shard, names)
+	if err != nil {
+		return newTaskError(ErrorTypeDatabase, fmt.Errorf("unable to record the fetch: %w", err))
+	}
+	err = runProviders(run.snapshotDB(db), logger, config, run, resp)
+	if run.export != nil && err == nil {
+		if exportErr := run.export.report().Error; exportErr != "" {
+			err = newTaskError(ErrorTypeExport, fmt.Errorf("unable to export the fetched rows: %s", exportErr))
+		}
+	}
+	if !run.isStopped() {
+		finishErr := run.finish(resp.Status)
+		if finishErr != nil {
+			logger.Error("Unable to publish the snapshot", zap.String("run_id", run.id), zap.Error(finishErr))
+			if err == nil {
+				err = newTaskError(ErrorTypeDatabase, fmt.Errorf("unable to publish the snapshot: %w", finishErr))
+			}
+		}
+		run.cleanup()
+		return err
+	}
+
+	resp.ContinuationToken = encodeContinuationToken(run.id)
+	if req.AutoResume {
+		next := *req
+		next.ContinuationToken = resp.ContinuationToken
+		invokeErr := invokeAsync(context.Background(), workerFunctionName(), &next)
+		if invokeErr != nil {
+			logger.Error("Unable to resume run", zap.String("run_id", run.id), zap.Error(invokeErr))
+		} else {
+			logger.Info("Resuming run in a new invocation", zap.String("run_id", run.id))
+		}
+	}
+	return err
+}
+
+// Runs every provider in the config and records an outcome for each provider and resource. Unlike
+// cloudqueryclient.Client.Run a failing provider or resource doesn't stop the remaining ones.
+func runProviders(db *gorm.DB, log *zap.Logger, config *Config, run *fetchRun, resp *Response) error {
+	succeeded, partial, failed := 0, 0, 0
+	for _, provider := range config.Providers {
+		resources, err := fetchProvider(db, log, provider, run)
+		if err != nil {
+			log.Error("Error fetching resources", zap.String("provider", provider.Name), zap.Error(err))
+			if len(resources) == 0 {
+				for _, resource := range configuredResources(provider.Rest) {
+					resources = append(resources, ResourceOutcome{
+						Provider: provider.Name,
+						Resource: resource,
+						Status:   resourceOutcome(err),
+						Error:    err.Error(),
+					})
+				}
+			}
+		}
+		outcome := providerOutcome(provider.Name, resources, err)
+		switch outcome.Status {
+		case StatusSucceeded:
+			succeeded++
+		case StatusFailed:
+			failed++
+		default:
+			partial++
+		}
+		resp.Providers = append(resp.Providers, outcome)
+		resp.Resources = append(resp.Resources, resources...)
+	}
+	resp.Status = aggregateStatus(succeeded+partial, failed)
+	if (partial > 0 || run.isStopped()) && resp.Status == StatusSucceeded {
+		resp.Status = StatusPartial
+	}
+	if resp.Status == StatusFailed {
+		return newTaskError(ErrorTypeFetch, fmt.Errorf("all %d providers failed", failed))
+	}
+	return nil
+}
+
+// Fetches the resources of a provider. Providers that don't report their own outcomes are run
+// one resource at a time, so a failing resource doesn't stop the remaining ones. The provider is
+// created once per fetch and its tables are only migrated here, unless the fetch skips migrations.
+func fetchProvider(db *gorm.DB, log *zap.Logger, provider ProviderConfig, run *fetchRun) ([]ResourceOutcome, error) {
+	p, err := newProvider(db, log, provider.Name)
+	if err != nil {
+		return nil, err
+	}
+	// the tables and snapshot columns are created here rather than by the providers, whose
+	// migrations newProvider leaves out
+	if !run.skipsMigrations() {
+		log.Info("Creating tables if needed", zap.String("provider", provider.Name))
+		err = migrateProvider(db, provider.Name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = run.addSnapshotTables(provider.Name)
+	if err != nil {
+		return nil, err
+	}
+	if reporter, ok := p.(outcomeReporter); ok {
+		if aware, ok := p.(runAware); ok {
+			aware.setRun(run)
+		}
+		err = runProvider(log, provider.Name, p, provider.Rest)
+		return reporter.resourceOutcomes(), err
+	}
+
+	resources := configuredResources(provider.Rest)
+	if len(resources) == 0 {
+		err = runProvider(log, provider.Name, p, provider.Rest)
+		if err == nil {
+			run.commitScopes(fetchUnit{Provider: provider.Name})
+		} else {
+			run.discardScopes(fetchUnit{Provider: provider.Name})
+		}
+		return nil, err
+	}
+	var outcomes []ResourceOutcome
+	// options of the resources run so far, see singleResource
+	options := map[string]bool{}
+	for _, resource := range resources {
+		unit := fetchUnit{Provider: provider.Name, Resource: resource}
+		outcome := ResourceOutcome{Provider: provider.Name, Resource: resource}
+		switch {
+		case !isSupportedResource(provider.Name, resource):
+			outcome.Status = OutcomeError
+			outcome.Error = fmt.Sprintf("unsupported %s resource %s", provider.Name, resource)
+		case run.isCompleted(unit):
+			outcome.Status = StatusCompleted
+		case run.shouldStop():
+			outcome.Status = StatusDeferred
+		default:
+			rest := make(map[string]interface{}, len(provider.Rest))
+			for k, v := range provider.Rest {
+				rest[k] = v
+			}
+			rest["resources"] = singleResource(provider.Rest, resource, options)
+			err = runProvider(log, provider.Name, p, rest)
+			outcome.Status = resourceOutcome(err)
+			if err != nil {
+				log.Error("Error fetching resource", zap.String("provider", provider.Name),
+					zap.String("resource", resource), zap.Error(err))
+				outcome.Error = err.Error()
+			}
+			if outcomeSucceeded(outcome.Status) {
+				run.complete(unit)
+			} else {
+				run.discardScopes(unit)
+			}
+		}
+		outcomes = append(outcomes, outcome)
+	}
+	return outcomes, nil
+}
+
+// Returns the resources list with only the entries of resource. The providers decode every config
+// onto the config of their previous run, which keeps the options of earlier resources, so the
+// options seen so far that the entries don't set are passed as nil.
+func singleResource(rest map[string]interface{}, resource string, options map[string]bool) []interface{} {
+	filtered := filterResources(rest, []string{resource})
+	entries := make([]interface{}, 0, len(filtered))
+	for _, item := range filtered {
+		entry := map[string]interface{}{}
+		for key := range options {
+			entry[key] = nil
+		}
+		for key, value := range item.(map[string]interface{}) {
+			entry[key] = value
+			if key != "name" {
+				options[key] = true
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// Derives the status of a provider from the outcomes of its resources
+func providerOutcome(name string, resources []ResourceOutcome, err error) ProviderOutcome {
+	outcome := ProviderOutcome{Name: name}
+	ok, deferred, failed := 0, 0, 0
+	for _, resource := range resources {
+		switch {
+		case outcomeSucceeded(resource.Status):
+			ok++
+		case resource.Status == StatusDeferred:
+			deferred++
+		default:
+			failed++
+		}
+	}
+	if err != nil {
+		outcome.Error = err.Error()
+		failed++
+	} else if failed > 0 {
+		outcome.Error = fmt.Sprintf("%d of %d resources failed", failed, len(resources))
+	}
+	switch {
+	case failed == 0 && deferred == 0:
+		outcome.Status = StatusSucceeded
+	case ok == 0 && deferred == 0:
+		outcome.Status = StatusFailed
+	case ok == 0 && failed == 0:
+		outcome.Status = StatusDeferred
+	default:
+		outcome.Status = StatusPartial
+	}
+	return outcome
+}
+
+func newProvider(db *gorm.DB, log *zap.Logger, name string) (p provider.Interface, err error) {
+	defer recoverProviderPanic(log, name, &err)
+	if name == "" {
+		return nil, fmt.Errorf("provider must contain key: name")
+	}
+	newFunc := providerMap[name]
+	if newFunc == nil {
+		return nil, fmt.Errorf("provider %s is not supported", name)
+	}
+	// gcp and okta change the naming strategy of the db they are given, so each provider gets its
+	// own session rather than the pool shared across invocations. The providers migrate their
+	// tables when they are created or run, which the session leaves to migrateProvider.
+	logger := log.With(zap.String("provider", name)).WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return migrationlessCore{Core: core}
+	}))
+	return newFunc(migrationlessDB(db), logger)
+}
+
+func runProvider(log *zap.Logger, name string, p provider.Interface, config map[string]interface{}) (err error) {
+	defer recoverProviderPanic(log, name, &err)
+	return p.Run(config)
+}
+
+func recoverProviderPanic(log *zap.Logger, name string, err *error) {
+	if r := recover(); r != nil {
+		if fatal, ok := r.(*fatalError); ok {
+			// a log.Fatal of the provider, see fatal.go
+			*err = fatal
+			return
+		}
+		log.Error("Panic while fetching resources", zap.String("provider", name),
+			zap.Any("panic", r), zap.String("stack", string(debug.Stack())))
+		*err = fmt.Errorf("panic: %v", r)
+	}
+}
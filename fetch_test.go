@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSingleResource(t *testing.T) {
+	rest := map[string]interface{}{
+		"project_id": "project",
+		"resources": []interface{}{
+			map[string]interface{}{"name": "compute.instances", "filter": "status = RUNNING"},
+			map[string]interface{}{"name": "compute.images"},
+			map[string]interface{}{"name": "compute.addresses", "labels": true},
+		},
+	}
+	options := map[string]bool{}
+	tests := []struct {
+		resource string
+		want     []interface{}
+	}{
+		{
+			resource: "compute.instances",
+			want:     []interface{}{map[string]interface{}{"name": "compute.instances", "filter": "status = RUNNING"}},
+		},
+		{
+			resource: "compute.images",
+			want:     []interface{}{map[string]interface{}{"name": "compute.images", "filter": nil}},
+		},
+		{
+			resource: "compute.addresses",
+			want:     []interface{}{map[string]interface{}{"name": "compute.addresses", "filter": nil, "labels": true}},
+		},
+		{
+			resource: "compute.instances",
+			want:     []interface{}{map[string]interface{}{"name": "compute.instances", "filter": "status = RUNNING", "labels": nil}},
+		},
+		{resource: "compute.disk_types", want: []interface{}{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.resource, func(t *testing.T) {
+			got := singleResource(rest, tt.resource, options)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("singleResource() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if _, ok := rest["resources"].([]interface{})[1].(map[string]interface{})["filter"]; ok {
+		t.Errorf("singleResource() modified the config")
+	}
+}
@@ -4,5 +4,21 @@ go 1.15
 
 require (
 	github.com/aws/aws-lambda-go v1.21.0
+	github.com/aws/aws-sdk-go v1.35.0
 	github.com/cloudquery/cloudquery v0.6.8
+	github.com/go-sql-driver/mysql v1.5.0
+	github.com/jackc/pgx/v4 v4.9.0
+	github.com/mitchellh/mapstructure v1.3.3
+	github.com/okta/okta-sdk-golang/v2 v2.2.1
+	github.com/spf13/pflag v1.0.5
+	go.uber.org/multierr v1.5.0
+	go.uber.org/zap v1.10.0
+	google.golang.org/api v0.35.0
+	gopkg.in/yaml.v3 v3.0.0-20200615113413-eeeca48fe776
+	gorm.io/driver/mysql v1.0.2
+	gorm.io/driver/postgres v1.0.2
+	gorm.io/driver/sqlite v1.1.3
+	gorm.io/driver/sqlserver v1.0.4
+	gorm.io/gorm v1.20.9
+	k8s.io/apimachinery v0.19.0
 )
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultQueryLimit   = 1000
+	defaultQueryTimeout = 20 * time.Second
+	// Signed requests older or newer than this are rejected to prevent replays
+	signatureTolerance = 5 * time.Minute
+)
+
+// httpRequest is the part of an API Gateway REST (1.0) or HTTP API and Function URL (2.0) event
+// the routes need
+type httpRequest struct {
+	Method  string
+	Path    string
+	Headers map[string]string
+	Body    []byte
+}
+
+// Reports whether the payload is an API Gateway or Function URL event
+func isHTTPEvent(keys map[string]json.RawMessage) bool {
+	if _, ok := keys["httpMethod"]; ok {
+		return true
+	}
+	var version string
+	_ = json.Unmarshal(keys["version"], &version)
+	_, hasContext := keys["requestContext"]
+	return version == "2.0" && hasContext
+}
+
+// Decodes either payload format. The stage is removed from the path, so routes and signatures
+// don't depend on it.
+func parseHTTPEvent(payload []byte) (*httpRequest, error) {
+	var event events.APIGatewayV2HTTPRequest
+	err := json.Unmarshal(payload, &event)
+	if err != nil {
+		return nil, err
+	}
+	req := httpRequest{Method: event.RequestContext.HTTP.Method, Path: event.RawPath, Headers: map[string]string{}}
+	stage := event.RequestContext.Stage
+	body, isBase64 := event.Body, event.IsBase64Encoded
+	if event.Version != "2.0" {
+		var v1 events.APIGatewayProxyRequest
+		err = json.Unmarshal(payload, &v1)
+		if err != nil {
+			return nil, err
+		}
+		req.Method, req.Path, stage = v1.HTTPMethod, v1.Path, v1.RequestContext.Stage
+		body, isBase64 = v1.Body, v1.IsBase64Encoded
+		event.Headers = v1.Headers
+	}
+	for name, value := range event.Headers {
+		req.Headers[strings.ToLower(name)] = value
+	}
+	if stage != "" && stage != "$default" {
+		req.Path = strings.TrimPrefix(req.Path, "/"+stage)
+	}
+	req.Body = []byte(body)
+	if isBase64 {
+		req.Body, err = base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &req, nil
+}
+
+// Serves the HTTP API routes. Every route needs a bearer token or an HMAC signature.
+func handleHTTP(ctx context.Context, payload []byte) *events.APIGatewayV2HTTPResponse {
+	req, err := parseHTTPEvent(payload)
+	if err != nil {
+		return httpError(http.StatusBadRequest, err)
+	}
+	err = authenticate(req, time.Now())
+	if err != nil {
+		log.Printf("Rejected %s %s: %s", req.Method, req.Path, err)
+		return httpError(http.StatusUnauthorized, err)
+	}
+	parts := strings.Split(strings.Trim(req.Path, "/"), "/")
+	switch {
+	case req.Method == http.MethodPost && req.Path == "/fetch":
+		return dispatchRun(ctx, "fetch", req.Body)
+	case req.Method == http.MethodPost && req.Path == "/policy":
+		return dispatchRun(ctx, "policy", req.Body)
+	case req.Method == http.MethodGet && len(parts) == 2 && parts[0] == "runs":
+		return getRun(parts[1])
+	case req.Method == http.MethodGet && len(parts) == 3 && parts[0] == "policies" && parts[2] == "results":
+		return getPolicyResults(parts[1])
+	case req.Method == http.MethodPost && req.Path == "/query":
+		return runReadOnlyQuery(ctx, req.Body)
+	}
+	return httpError(http.StatusNotFound, fmt.Errorf("no route for %s %s", req.Method, req.Path))
+}
+
+// Accepts Authorization: Bearer with one of the comma separated CLOUDQUERY_API_TOKENS, or an
+// X-Cloudquery-Signature of sha256=HMAC-SHA256(CLOUDQUERY_API_HMAC_SECRET, timestamp, method, path
+// and body separated by newlines) with the unix timestamp in X-Cloudquery-Timestamp
+func authenticate(req *httpRequest, now time.Time) error {
+	tokens := os.Getenv("CLOUDQUERY_API_TOKENS")
+	secret := os.Getenv("CLOUDQUERY_API_HMAC_SECRET")
+	if tokens == "" && secret == "" {
+		return errors.New("authentication is not configured. set CLOUDQUERY_API_TOKENS or CLOUDQUERY_API_HMAC_SECRET")
+	}
+	if auth := req.Headers["authorization"]; tokens != "" && strings.HasPrefix(auth, "Bearer ") {
+		presented := []byte(strings.TrimPrefix(auth, "Bearer "))
+		for _, token := range strings.Split(tokens, ",") {
+			token = strings.TrimSpace(token)
+			if token != "" && subtle.ConstantTimeCompare(presented, []byte(token)) == 1 {
+				return nil
+			}
+		}
+		return errors.New("invalid bearer token")
+	}
+	signature := req.Headers["x-cloudquery-signature"]
+	if secret == "" || signature == "" {
+		return errors.New("missing bearer token or signature")
+	}
+	timestamp := req.Headers["x-cloudquery-timestamp"]
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("missing or invalid X-Cloudquery-Timestamp")
+	}
+	if skew := now.Sub(time.Unix(seconds, 0)); skew > signatureTolerance || skew < -signatureTolerance {
+		return errors.New("signature timestamp is too old or in the future")
+	}
+	if subtle.ConstantTimeCompare([]byte(signature), []byte(signRequest(secret, timestamp, req))) != 1 {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+func signRequest(secret, timestamp string, req *httpRequest) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", timestamp, req.Method, req.Path)
+	mac.Write(req.Body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// dispatchInput holds the only request fields a caller of the HTTP API may set. The config, its
+// providers and credentials, the export destination, the policy file and the migrations come
+// from the configuration of the function.
+type dispatchInput struct {
+	// Narrows a fetch to a shard of the configured providers
+	Shard *Shard `json:"shard,omitempty"`
+	// Resumes a fetch that stops at its deadline in a new invocation
+	AutoResume bool `json:"autoResume,omitempty"`
+}
+
+// Records a running run and invokes the function asynchronously to run the task, as API Gateway
+// doesn't wait for a fetch. The body of a fetch may hold the fields of dispatchInput, any other
+// field is rejected.
+func dispatchRun(ctx context.Context, taskName string, body []byte) *events.APIGatewayV2HTTPResponse {
+	var input dispatchInput
+	if len(bytes.TrimSpace(body)) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&input)
+		if err != nil {
+			return httpError(http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		}
+	}
+	if taskName != "fetch" && input != (dispatchInput{}) {
+		return httpError(http.StatusBadRequest, fmt.Errorf("invalid request: %s takes no fields", taskName))
+	}
+	req := Request{TaskName: taskName, RunID: newRunID(), Shard: input.Shard, AutoResume: input.AutoResume}
+	functionName := workerFunctionName()
+	if functionName == "" {
+		return httpError(http.StatusInternalServerError, errors.New("unable to find the function to invoke. please set CLOUDQUERY_WORKER_FUNCTION"))
+	}
+	db, err := openDB(DRIVER, DSN)
+	if err != nil {
+		return httpError(http.StatusInternalServerError, err)
+	}
+	if !skipMigrations(&req) {
+		err = db.AutoMigrate(&RunRecord{})
+		if err != nil {
+			return httpError(http.StatusInternalServerError, err)
+		}
+	}
+	run := RunRecord{ID: req.RunID, TaskName: taskName, Status: StatusRunning, StartedAt: time.Now().UTC()}
+	err = saveRun(db, &run)
+	if err != nil {
+		return httpError(http.StatusInternalServerError, err)
+	}
+	err = invokeAsync(ctx, functionName, &req)
+	if err != nil {
+		run.Status = StatusFailed
+		_ = saveRun(db, &run)
+		return httpError(http.StatusBadGateway, fmt.Errorf("unable to start %s: %w", taskName, err))
+	}
+	resp := httpJSON(http.StatusAccepted, run)
+	resp.Headers["Location"] = "/runs/" + run.ID
+	return resp
+}
+
+func getRun(id string) *events.APIGatewayV2HTTPResponse {
+	db, err := openDB(DRIVER, DSN)
+	if err != nil {
+		return httpError(http.StatusInternalServerError, err)
+	}
+	var run RunRecord
+	err = db.Where("id = ?", id).Take(&run).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err != nil && !db.Migrator().HasTable(&RunRecord{})) {
+		return httpError(http.StatusNotFound, fmt.Errorf("run %s not found", id))
+	}
+	if err != nil {
+		return httpError(http.StatusInternalServerError, err)
+	}
+	return httpJSON(http.StatusOK, struct {
+		RunRecord
+		Response json.RawMessage `json:"response,omitempty"`
+	}{run, rawJSON(run.Response)})
+}
+
+// Returns the findings of the latest run of a policy
+func getPolicyResults(name string) *events.APIGatewayV2HTTPResponse {
+	db, err := openDB(DRIVER, DSN)
+	if err != nil {
+		return httpError(http.StatusInternalServerError, err)
+	}
+	var latest PolicyFinding
+	err = db.Where("policy = ?", name).Order("checked_at DESC").Take(&latest).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err != nil && !db.Migrator().HasTable(&PolicyFinding{})) {
+		return httpError(http.StatusNotFound, fmt.Errorf("no results for policy %s", name))
+	}
+	if err != nil {
+		return httpError(http.StatusInternalServerError, err)
+	}
+	var findings []PolicyFinding
+	err = db.Where("run_id = ? AND policy = ?", latest.RunID, name).Order("id").Find(&findings).Error
+	if err != nil {
+		return httpError(http.StatusInternalServerError, err)
+	}
+	type result struct {
+		PolicyFinding
+		Rows json.RawMessage `json:"rows,omitempty"`
+	}
+	results := make([]result, 0, len(findings))
+	passed := true
+	for _, finding := range findings {
+		passed = passed && finding.Passed
+		results = append(results, result{finding, rawJSON(finding.Rows)})
+	}
+	return httpJSON(http.StatusOK, map[string]interface{}{
+		"policy":    name,
+		"runId":     latest.RunID,
+		"checkedAt": latest.CheckedAt,
+		"passed":    passed,
+		"queries":   results,
+	})
+}
+
+var (
+	// The quoted strings and identifiers of each dialect, matched in a single pass so a quote
+	// inside one doesn't start another. Only '...' is a literal everywhere, the others are
+	// identifiers, or strings in MySQL without ANSI_QUOTES, whose content is checked too.
+	sqlQuoted = map[string]*regexp.Regexp{
+		"postgres": regexp.MustCompile(`'(?:[^']|'')*'|"(?:[^"]|"")*"`),
+		"mysql":    regexp.MustCompile("'(?:[^']|'')*'|\"(?:[^\"]|\"\")*\"|`(?:[^`]|``)*`"),
+		"sqlite":   regexp.MustCompile("'(?:[^']|'')*'|\"(?:[^\"]|\"\")*\"|`(?:[^`]|``)*`|\\[[^\\]]*\\]"),
+	}
+	sqlWord       = regexp.MustCompile(`[a-z_][a-z0-9_]*`)
+	forbiddenWord = map[string]bool{
+		"insert": true, "update": true, "delete": true, "create": true, "alter": true, "drop": true, "truncate": true, "rename": true, "grant": true,
+		"revoke": true, "copy": true, "into": true, "attach": true, "detach": true, "pragma": true,
+		"vacuum": true, "analyze": true, "reindex": true, "call": true, "exec": true, "execute": true,
+		"do": true, "set": true, "lock": true, "listen": true, "notify": true, "load": true,
+		"pg_read_file": true, "pg_read_binary_file": true, "pg_ls_dir": true, "pg_stat_file": true,
+		"lo_import": true, "lo_export": true, "dblink": true, "load_file": true, "pg_sleep": true,
+		"sleep": true, "benchmark": true, "set_config": true, "pg_terminate_backend": true,
+		"pg_cancel_backend": true, "nextval": true, "setval": true, "openrowset": true, "xp_cmdshell": true,
+		"load_extension": true,
+	}
+)
+
+// Vets a query for POST /query: a single SELECT or WITH statement without comments, statements
+// that change anything or functions that reach outside the database. String literals are ignored,
+// quoted identifiers are checked like unquoted ones, e.g. "pg_sleep"(10) on postgres. Backslash
+// escapes and postgres dollar quoting are rejected, as the literals would end elsewhere.
+func checkReadOnlyQuery(dialect, query string) error {
+	quoted, ok := sqlQuoted[dialect]
+	if !ok {
+		return fmt.Errorf("queries are not supported on %s", dialect)
+	}
+	if (dialect == "postgres" || dialect == "mysql") && strings.Contains(query, `\`) {
+		return errors.New("backslashes are not allowed")
+	}
+	stripped := quoted.ReplaceAllStringFunc(query, func(token string) string {
+		if token[0] == '\'' {
+			return "''"
+		}
+		return " " + token[1:len(token)-1] + " "
+	})
+	stripped = strings.ToLower(stripped)
+	stripped = strings.TrimRight(strings.TrimSpace(stripped), "; \t\n")
+	if dialect == "postgres" && strings.Contains(stripped, "$") {
+		return errors.New("dollar quoting is not allowed")
+	}
+	if strings.Contains(stripped, ";") {
+		return errors.New("only a single statement is allowed")
+	}
+	if strings.Contains(stripped, "--") || strings.Contains(stripped, "/*") || strings.Contains(stripped, "#") {
+		return errors.New("comments are not allowed")
+	}
+	words := sqlWord.FindAllString(stripped, -1)
+	if len(words) == 0 || (words[0] != "select" && words[0] != "with") {
+		return errors.New("only SELECT and WITH queries are allowed")
+	}
+	for _, word := range words {
+		if forbiddenWord[word] {
+			return fmt.Errorf("%s is not allowed in a read-only query", strings.ToUpper(word))
+		}
+	}
+	return nil
+}
+
+// Reports whether the query of POST /query runs read-only in the database itself rather than
+// only vetted by checkReadOnlyQuery: a read-only transaction on postgres, also over the Data
+// API, and MySQL, and query_only on sqlite. sqlserver and MySQL over the Data API have neither.
+func enforcesReadOnly(db *gorm.DB) bool {
+	switch db.Dialector.Name() {
+	case "postgres":
+		return true
+	case "mysql", "sqlite":
+		return !isDataAPI(db)
+	}
+	return false
+}
+
+var errQueryRolledBack = errors.New("query rolled back")
+
+// Runs a vetted query in a read-only snapshot transaction that is always rolled back. The body is
+// {"query": "...", "limit": 100}. At most CLOUDQUERY_API_QUERY_LIMIT rows are returned.
+func runReadOnlyQuery(ctx context.Context, body []byte) *events.APIGatewayV2HTTPResponse {
+	var input struct {
+		Query string `json:"query"`
+		Limit int    `json:"limit"`
+	}
+	err := json.Unmarshal(body, &input)
+	if err != nil {
+		return httpError(http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+	}
+	limit := defaultQueryLimit
+	if env, err := strconv.Atoi(os.Getenv("CLOUDQUERY_API_QUERY_LIMIT")); err == nil && env > 0 {
+		limit = env
+	}
+	if input.Limit > 0 && input.Limit < limit {
+		limit = input.Limit
+	}
+	db, err := openDB(DRIVER, DSN)
+	if err != nil {
+		return httpError(http.StatusInternalServerError, err)
+	}
+	if !enforcesReadOnly(db) {
+		return httpError(http.StatusNotImplemented, fmt.Errorf("POST /query needs a database that runs it read-only, not %s", DRIVER))
+	}
+	err = checkReadOnlyQuery(db.Dialector.Name(), input.Query)
+	if err != nil {
+		return httpError(http.StatusBadRequest, err)
+	}
+	tables, err := versionedTables()
+	if err != nil {
+		return httpError(http.StatusInternalServerError, err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, defaultQueryTimeout)
+	defer cancel()
+	// like the policy task the query reads the latest snapshot of every versioned table
+	var results []map[string]interface{}
+	var queryErr error
+	err = snapshotTransaction(db.WithContext(ctx), func(tx *gorm.DB) error {
+		if tx.Dialector.Name() == "sqlite" {
+			tx.Exec("PRAGMA query_only = ON")
+			defer tx.Exec("PRAGMA query_only = OFF")
+		}
+		results, queryErr = queryRows(tx, readLatest(input.Query, tables), limit+1)
+		// rolls back, also where the transaction can't be read-only
+		return errQueryRolledBack
+	})
+	if queryErr != nil {
+		return httpError(http.StatusBadRequest, queryErr)
+	}
+	if !errors.Is(err, errQueryRolledBack) {
+		return httpError(http.StatusInternalServerError, err)
+	}
+	truncated := len(results) > limit
+	if truncated {
+		results = results[:limit]
+	}
+	if results == nil {
+		results = []map[string]interface{}{}
+	}
+	return httpJSON(http.StatusOK, map[string]interface{}{
+		"rows":      results,
+		"count":     len(results),
+		"truncated": truncated,
+	})
+}
+
+func rawJSON(data string) json.RawMessage {
+	if data == "" || data == "null" {
+		return nil
+	}
+	return json.RawMessage(data)
+}
+
+func httpJSON(status int, body interface{}) *events.APIGatewayV2HTTPResponse {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return httpError(http.StatusInternalServerError, err)
+	}
+	return &events.APIGatewayV2HTTPResponse{
+		StatusCode: status,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(data),
+	}
+}
+
+func httpError(status int, err error) *events.APIGatewayV2HTTPResponse {
+	data, _ := json.Marshal(map[string]string{"error": err.Error()})
+	return &events.APIGatewayV2HTTPResponse{
+		StatusCode: status,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(data),
+	}
+}
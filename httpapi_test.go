@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Sets an environment variable for the duration of the test
+func setenv(t *testing.T, key, value string) {
+	previous, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestCheckReadOnlyQuery(t *testing.T) {
+	tests := []struct {
+		dialect string
+		query   string
+		wantErr bool
+	}{
+		{query: "select * from aws_ec2_instances"},
+		{query: "SELECT count(*) FROM aws_ec2_instances;"},
+		{query: "with running as (select * from aws_ec2_instances) select * from running"},
+		{query: "select * from aws_iam_users where user_name = 'delete; drop table x'"},
+		{query: "select * from aws_iam_users where user_name = 'o''brien'"},
+		{query: `select "instance_id" from "aws_ec2_instances"`},
+		{query: `select "insert" from aws_ec2_instances`, wantErr: true},
+		{query: "delete from aws_ec2_instances", wantErr: true},
+		{query: "select 1; delete from aws_ec2_instances", wantErr: true},
+		{query: "select 1 -- comment", wantErr: true},
+		{query: "select /* comment */ 1", wantErr: true},
+		{query: "select * into copy from aws_ec2_instances", wantErr: true},
+		{query: "with gone as (delete from aws_ec2_instances returning *) select * from gone", wantErr: true},
+		{query: "select pg_read_file('/etc/passwd')", wantErr: true},
+		{query: "select pg_sleep(10)", wantErr: true},
+		{query: "explain select 1", wantErr: true},
+		{query: "", wantErr: true},
+		// quoted identifiers are still identifiers
+		{query: `select "pg_terminate_backend"(123)`, wantErr: true},
+		{query: `select * from "dblink"('host=evil', 'select 1') as t(a int)`, wantErr: true},
+		{query: `select "lo_export"(1, '/tmp/x')`, wantErr: true},
+		{query: `select "PG_SLEEP"(10)`, wantErr: true},
+		{query: `select "a""b", "pg_sleep"(1)`, wantErr: true},
+		// a quote inside an identifier doesn't start a literal
+		{query: `select "a'b", pg_sleep(1), "c'd"`, wantErr: true},
+		{query: `select 'a"b', pg_sleep(1), 'c"d'`, wantErr: true},
+		// literals that end elsewhere in postgres
+		{query: `select E'\'', pg_sleep(1), ''`, wantErr: true},
+		{query: `select $$'$$, pg_sleep(1), $$'$$`, wantErr: true},
+		{query: `select $q$'$q$`, wantErr: true},
+		{dialect: "mysql", query: "select `instance_id` from aws_ec2_instances"},
+		{dialect: "mysql", query: "select `sleep`(10)", wantErr: true},
+		{dialect: "mysql", query: `select "benchmark"`, wantErr: true},
+		{dialect: "mysql", query: "select `a'b`, sleep(1), `c'd`", wantErr: true},
+		{dialect: "mysql", query: `select '\'', sleep(1), ''`, wantErr: true},
+		{dialect: "sqlite", query: "select [instance_id] from aws_ec2_instances"},
+		{dialect: "sqlite", query: "select [load_extension]('x')", wantErr: true},
+		{dialect: "sqlite", query: "select [a'b], load_extension('x'), [c'd]", wantErr: true},
+		{dialect: "sqlserver", query: "select 1", wantErr: true},
+	}
+	for _, tt := range tests {
+		if tt.dialect == "" {
+			tt.dialect = "postgres"
+		}
+		t.Run(tt.dialect+" "+tt.query, func(t *testing.T) {
+			err := checkReadOnlyQuery(tt.dialect, tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkReadOnlyQuery() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	body := []byte(`{"query": "select 1"}`)
+	signed := func(secret, timestamp string) map[string]string {
+		req := &httpRequest{Method: http.MethodPost, Path: "/query", Body: body}
+		return map[string]string{
+			"x-cloudquery-timestamp": timestamp,
+			"x-cloudquery-signature": signRequest(secret, timestamp, req),
+		}
+	}
+	tests := []struct {
+		name    string
+		tokens  string
+		secret  string
+		headers map[string]string
+		path    string
+		wantErr bool
+	}{
+		{name: "not configured", headers: map[string]string{"authorization": "Bearer a"}, wantErr: true},
+		{name: "bearer token", tokens: "a, b", headers: map[string]string{"authorization": "Bearer b"}},
+		{name: "wrong bearer token", tokens: "a,b", headers: map[string]string{"authorization": "Bearer c"}, wantErr: true},
+		{name: "empty bearer token", tokens: "a,", headers: map[string]string{"authorization": "Bearer "}, wantErr: true},
+		{name: "no credentials", tokens: "a", secret: "s", headers: map[string]string{}, wantErr: true},
+		{name: "signature", secret: "s", headers: signed("s", timestamp)},
+		{name: "signature with another secret", secret: "s", headers: signed("t", timestamp), wantErr: true},
+		{name: "signature of another path", secret: "s", headers: signed("s", timestamp), path: "/fetch", wantErr: true},
+		{name: "signature without a secret", tokens: "a", headers: signed("s", timestamp), wantErr: true},
+		{
+			name:    "old signature",
+			secret:  "s",
+			headers: signed("s", strconv.FormatInt(now.Add(-6*time.Minute).Unix(), 10)),
+			wantErr: true,
+		},
+		{
+			name:    "future signature",
+			secret:  "s",
+			headers: signed("s", strconv.FormatInt(now.Add(6*time.Minute).Unix(), 10)),
+			wantErr: true,
+		},
+		{name: "invalid timestamp", secret: "s", headers: signed("s", "yesterday"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenv(t, "CLOUDQUERY_API_TOKENS", tt.tokens)
+			setenv(t, "CLOUDQUERY_API_HMAC_SECRET", tt.secret)
+			path := "/query"
+			if tt.path != "" {
+				path = tt.path
+			}
+			req := &httpRequest{Method: http.MethodPost, Path: path, Headers: tt.headers, Body: body}
+			err := authenticate(req, now)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("authenticate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDispatchRunFields(t *testing.T) {
+	// without a function to invoke the run fails after its fields were accepted
+	setenv(t, "CLOUDQUERY_WORKER_FUNCTION", "")
+	setenv(t, "AWS_LAMBDA_FUNCTION_NAME", "")
+	tests := []struct {
+		task       string
+		body       string
+		wantStatus int
+	}{
+		{task: "fetch", body: "", wantStatus: http.StatusInternalServerError},
+		{task: "fetch", body: `{"autoResume": true, "shard": {"provider": "aws", "account": "default"}}`, wantStatus: http.StatusInternalServerError},
+		{task: "policy", body: "{}", wantStatus: http.StatusInternalServerError},
+		{task: "fetch", body: `{"config": "https://example.com/config.yml"}`, wantStatus: http.StatusBadRequest},
+		{task: "fetch", body: `{"providers": [{"name": "aws", "accounts": [{"id": "1", "role_arn": "arn"}]}]}`, wantStatus: http.StatusBadRequest},
+		{task: "fetch", body: `{"export": "s3://other-bucket"}`, wantStatus: http.StatusBadRequest},
+		{task: "fetch", body: `{"skipMigrations": true}`, wantStatus: http.StatusBadRequest},
+		{task: "fetch", body: `{"runId": "mine"}`, wantStatus: http.StatusBadRequest},
+		{task: "policy", body: `{"policy": "/etc/passwd"}`, wantStatus: http.StatusBadRequest},
+		{task: "policy", body: `{"autoResume": true}`, wantStatus: http.StatusBadRequest},
+		{task: "fetch", body: `[]`, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.task+" "+tt.body, func(t *testing.T) {
+			resp := dispatchRun(context.Background(), tt.task, []byte(tt.body))
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("dispatchRun() = %d %s, want %d", resp.StatusCode, resp.Body, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRunReadOnlyQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	driver, dsn := DRIVER, DSN
+	DRIVER, DSN = "sqlite", filepath.Join(dir, "query.db")
+	defer func() { DRIVER, DSN = driver, dsn }()
+	db, err := openDB(DRIVER, DSN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, statement := range []string{
+		"CREATE TABLE aws_ec2_instances (id integer primary key, instance_id text, superseded_by text)",
+		"INSERT INTO aws_ec2_instances VALUES (1, 'i-old', 'fetch-2'), (2, 'i-new', NULL)",
+		"CREATE VIEW aws_ec2_instances_latest AS SELECT * FROM aws_ec2_instances WHERE superseded_by IS NULL",
+	} {
+		err = db.Exec(statement).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantRows   int
+	}{
+		{name: "latest snapshot", body: `{"query": "select instance_id from aws_ec2_instances"}`, wantStatus: http.StatusOK, wantRows: 1},
+		{name: "limit", body: `{"query": "select 1 union all select 2", "limit": 1}`, wantStatus: http.StatusOK, wantRows: 1},
+		{name: "write", body: `{"query": "delete from aws_ec2_instances"}`, wantStatus: http.StatusBadRequest},
+		{name: "invalid sql", body: `{"query": "select * from missing"}`, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := runReadOnlyQuery(context.Background(), []byte(tt.body))
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("runReadOnlyQuery() = %d %s, want %d", resp.StatusCode, resp.Body, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var result struct {
+				Rows []map[string]interface{}
+			}
+			err := json.Unmarshal([]byte(resp.Body), &result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Rows) != tt.wantRows {
+				t.Errorf("runReadOnlyQuery() = %v, want %d rows", result.Rows, tt.wantRows)
+			}
+		})
+	}
+	var count int64
+	db.Table("aws_ec2_instances").Count(&count)
+	if count != 2 {
+		t.Errorf("aws_ec2_instances has %d rows, want 2", count)
+	}
+}
+
+// Without a read-only transaction in the database the query would only be vetted by the regexes
+func TestRunReadOnlyQueryNeedsReadOnlyDatabase(t *testing.T) {
+	stub, err := newDataAPIStub("sqlite", testSQLiteDSN(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	setenv(t, "CLOUDQUERY_RDSDATA_ENDPOINT", server.URL)
+	setenv(t, "AWS_REGION", "us-east-1")
+	setenv(t, "AWS_ACCESS_KEY_ID", "test")
+	setenv(t, "AWS_SECRET_ACCESS_KEY", "test")
+	driver, dsn := DRIVER, DSN
+	DRIVER, DSN = "rds-data-api", "cluster=arn:aws:rds:us-east-1:123456789012:cluster:cq&secret=arn:aws:secretsmanager:us-east-1:123456789012:secret:cq&engine=sqlite"
+	defer func() { DRIVER, DSN = driver, dsn }()
+	defer forgetDB(DRIVER, DSN)
+
+	resp := runReadOnlyQuery(context.Background(), []byte(`{"query": "select 1"}`))
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("runReadOnlyQuery() over the Data API = %d %s, want %d", resp.StatusCode, resp.Body, http.StatusNotImplemented)
+	}
+}
@@ -2,62 +2,138 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"runtime/debug"
+	"syscall"
 
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/cloudquery/cloudquery/cloudqueryclient"
 )
 
 var DRIVER string
 var DSN string
+var VERBOSE bool
 
+// Request is the invocation payload shared by the fetch, orchestrate, policy and diff tasks. Every payload
+// carries at least the taskName, which selects the task from the registry.
 type Request struct {
 	TaskName string `json:"taskName"`
+	// Location of the config used by the fetch task, see readSource. Defaults to CLOUDQUERY_CONFIG or config.yml
+	ConfigPath string `json:"config,omitempty"`
+	// Path to the policy file used by the policy task. Defaults to policy.yml
+	PolicyPath string `json:"policy,omitempty"`
+	// Providers to fetch in the same shape as the providers list of config.yml
+	Providers []ProviderConfig `json:"providers,omitempty"`
+	// Whether Providers replace config.yml (override, the default) or are merged onto it (merge)
+	ProvidersMode string `json:"providersMode,omitempty"`
+	// Narrows the fetch to a single shard of the config, see the orchestrate task
+	Shard *Shard `json:"shard,omitempty"`
+	// Resumes the run that returned this token, skipping the units it already completed
+	ContinuationToken string `json:"continuationToken,omitempty"`
+	// Invoke the function again with the continuation token when the fetch stops at the deadline
+	AutoResume bool `json:"autoResume,omitempty"`
+	// Records the run under this ID in cloudquery_runs so its status can be looked up. Set by the HTTP API.
+	RunID string `json:"runId,omitempty"`
+	// Don't create or update tables during the fetch. Requires the schema to be migrated by the migrate task.
+	SkipMigrations bool `json:"skipMigrations,omitempty"`
+	// Fetch compared by the diff task. Defaults to every finished fetch that wasn't diffed yet
+	FetchID string `json:"fetchId,omitempty"`
+	// Where the diff task publishes the change events, see newChangeSink. Defaults to
+	// CLOUDQUERY_DIFF_SINK or stdout
+	Sink string `json:"sink,omitempty"`
+	// Exports the fetched rows as JSON lines to s3://bucket/prefix or file:///path, see export.go.
+	// Defaults to CLOUDQUERY_EXPORT
+	Export string `json:"export,omitempty"`
 }
 
-func LambdaHandler(ctx context.Context, req Request) (string, error) {
-	return TaskExecutor(req.TaskName)
+// Runs the requested task. Failed tasks return their Response with the status and error details,
+// so callers can branch on the outcomes. Requests that can't be run at all and panics are reported
+// as Lambda function errors with the error type set. Besides direct invocations the payload can be
+// an EventBridge event, e.g. of a schedule rule, an SQS batch, which returns the failed records
+// instead of a Response, or an API Gateway or Function URL request, which returns an HTTP response.
+func LambdaHandler(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	var keys map[string]json.RawMessage
+	if json.Unmarshal(payload, &keys) == nil {
+		switch {
+		case isSQSEvent(keys):
+			resp, err := handleSQS(ctx, payload)
+			if err != nil {
+				return nil, lambdaError(err)
+			}
+			return resp, nil
+		case isHTTPEvent(keys):
+			return handleHTTP(ctx, payload), nil
+		case isEventBridgeEvent(keys):
+			var err error
+			payload, err = scheduledPayload(payload)
+			if err != nil {
+				return nil, lambdaError(newTaskError(ErrorTypeInvalidRequest, err))
+			}
+		}
+	}
+	resp, err := handle(ctx, payload)
+	if err != nil && (resp == nil || isFunctionError(err)) {
+		return nil, lambdaError(err)
+	}
+	return resp, nil
 }
 
-func TaskExecutor(taskName string) (string, error) {
-	switch taskName {
-	case "fetch":
-		Fetch(DRIVER, DSN, false)
-	case "policy":
-		Policy(DRIVER, DSN, false)
-	default:
-		log.Printf("Unknown task: %s", taskName)
+// Runs the task named in the payload. Shared by the Lambda handler and the command line, and
+// recovers panics so the warm runtime survives the invocation.
+func handle(ctx context.Context, payload []byte) (resp *Response, err error) {
+	var req Request
+	err = json.Unmarshal(payload, &req)
+	if err != nil {
+		return nil, newTaskError(ErrorTypeInvalidRequest, err)
 	}
-	return fmt.Sprintf("Completed task %s", taskName), nil
+	// the run record is finished here, so a task that panics doesn't leave it running
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic while running task %s: %v\n%s", req.TaskName, r, debug.Stack())
+			resp = nil
+			err = newTaskError(ErrorTypePanic, fmt.Errorf("panic: %v", r))
+			failed := newResponse(req.TaskName)
+			failed.fail(err)
+			trackRun(&req, failed.finish())
+			return
+		}
+		trackRun(&req, resp)
+	}()
+	return TaskExecutor(ctx, req.TaskName, payload)
 }
 
-// Fetches resources from a cloud provider and saves them in the configured database
-func Fetch(driver, dsn string, verbose bool) {
-	client, err := cloudqueryclient.New(driver, dsn, verbose)
-	if err != nil {
-		log.Fatalf("Unable to initialize client: %s", err)
+// Runs the named task with the given payload. The response is always returned, and
+// carries the error details when the task fails.
+func TaskExecutor(ctx context.Context, taskName string, payload []byte) (*Response, error) {
+	resp := newResponse(taskName)
+	task, req, err := lookupTask(taskName, payload)
+	if err == nil {
+		err = task.Run(ctx, req, resp)
 	}
-	err = client.Run("config.yml")
 	if err != nil {
-		log.Fatalf("Error fetching resources: %s", err)
+		resp.fail(err)
 	}
+	return resp.finish(), err
 }
 
-// Runs a policy SQL statement and returns results
-func Policy(driver, dsn string, verbose bool) {
-	fmt.Println("Running policy queries")
-}
 func main() {
 	DRIVER = os.Getenv("CLOUDQUERY_DRIVER")
 	DSN = os.Getenv("CLOUDQUERY_DATABASE_STRING")
+	VERBOSE = os.Getenv("CLOUDQUERY_VERBOSE") == "true"
 	if env := os.Getenv("AWS_LAMBDA_RUNTIME_API"); env != "" {
+		// the runtime sends SIGTERM before it shuts the instance down when an extension is registered
+		shutdown := make(chan os.Signal, 1)
+		signal.Notify(shutdown, syscall.SIGTERM)
+		go func() {
+			<-shutdown
+			closeDatabases()
+			os.Exit(0)
+		}()
 		lambda.Start(LambdaHandler)
-	} else if len(os.Args) > 1 {
-		TaskExecutor(os.Args[1])
-	} else {
-		log.Fatalf("Usage: ./main [TASK]")
+		return
 	}
-
+	os.Exit(runCLI(os.Args[1:], os.Stdout, os.Stderr))
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	lambdasvc "github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const StatusDispatched = "dispatched"
+
+func init() {
+	RegisterTask("orchestrate", Task{
+		Description: "Splits the config into shards and invokes this function asynchronously or queues a message to fetch each of them",
+		NewRequest:  func() interface{} { return &Request{} },
+		Run: func(ctx context.Context, req interface{}, resp *Response) error {
+			return Orchestrate(ctx, req.(*Request), resp)
+		},
+	})
+}
+
+type ShardOutcome struct {
+	Shard  *Shard `json:"shard,omitempty"`
+	RunID  string `json:"runId,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Plans the shards of the config and dispatches each of them as an asynchronous fetch, or as a
+// message to the queue in CLOUDQUERY_SHARD_QUEUE_URL
+func Orchestrate(ctx context.Context, req *Request, resp *Response) error {
+	config, err := resolveConfig(req)
+	if err != nil {
+		return newTaskError(ErrorTypeConfig, err)
+	}
+	shards, err := planShards(config)
+	if err != nil {
+		return newTaskError(ErrorTypeConfig, err)
+	}
+	queueURL := os.Getenv("CLOUDQUERY_SHARD_QUEUE_URL")
+	functionName := workerFunctionName()
+	if queueURL == "" && functionName == "" {
+		return newTaskError(ErrorTypeConfig, fmt.Errorf("unable to find the function to invoke. please set CLOUDQUERY_WORKER_FUNCTION or CLOUDQUERY_SHARD_QUEUE_URL"))
+	}
+
+	succeeded, failed := 0, 0
+	for i := range shards {
+		shard := shards[i]
+		shardReq := shardRequest(req, &shard, i)
+		outcome := ShardOutcome{Shard: &shard, RunID: shardReq.RunID, Status: StatusDispatched}
+		var err error
+		if queueURL != "" {
+			err = sendToQueue(ctx, queueURL, shardReq)
+		} else {
+			err = invokeAsync(ctx, functionName, shardReq)
+		}
+		if err != nil {
+			log.Printf("Unable to dispatch shard %s: %s", shard, err)
+			outcome.Status = StatusFailed
+			outcome.Error = err.Error()
+			failed++
+		} else {
+			succeeded++
+		}
+		resp.Shards = append(resp.Shards, outcome)
+	}
+	resp.Status = aggregateStatus(succeeded, failed)
+	if resp.Status == StatusFailed {
+		return newTaskError(ErrorTypeFetch, fmt.Errorf("unable to dispatch any of the %d shards", failed))
+	}
+	return nil
+}
+
+// Builds the fetch request for a shard. The config location, inline providers and options of the
+// original request are passed on so every worker sees the same config. Each shard is recorded
+// under the run ID of the original request with the index of the shard appended, as the shards
+// are separate fetches.
+func shardRequest(req *Request, shard *Shard, index int) *Request {
+	shardReq := &Request{
+		TaskName:       "fetch",
+		ConfigPath:     req.ConfigPath,
+		Providers:      req.Providers,
+		ProvidersMode:  req.ProvidersMode,
+		Shard:          shard,
+		AutoResume:     req.AutoResume,
+		SkipMigrations: req.SkipMigrations,
+		Export:         req.Export,
+	}
+	if req.RunID != "" {
+		shardReq.RunID = fmt.Sprintf("%s-%d", req.RunID, index)
+	}
+	return shardReq
+}
+
+// Returns the function that fetches the shards. Defaults to the running function itself.
+func workerFunctionName() string {
+	if name := os.Getenv("CLOUDQUERY_WORKER_FUNCTION"); name != "" {
+		return name
+	}
+	return os.Getenv("AWS_LAMBDA_FUNCTION_NAME")
+}
+
+// Invokes a function with the Event invocation type. CLOUDQUERY_LAMBDA_ENDPOINT overrides the
+// Lambda endpoint so a local stub can be used in tests.
+func invokeAsync(ctx context.Context, functionName string, req *Request) error {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	sess, err := sharedAWSSession()
+	if err != nil {
+		return err
+	}
+	_, err = lambdasvc.New(sess, awsServiceConfig("lambda")).InvokeWithContext(ctx, &lambdasvc.InvokeInput{
+		FunctionName:   aws.String(functionName),
+		InvocationType: aws.String(lambdasvc.InvocationTypeEvent),
+		Payload:        payload,
+	})
+	return err
+}
+
+// Sends a request to an SQS queue whose consumer is this function. The queue retries failed
+// shards and moves them to its dead-letter queue. CLOUDQUERY_SQS_ENDPOINT overrides the endpoint.
+func sendToQueue(ctx context.Context, queueURL string, req *Request) error {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	sess, err := sharedAWSSession()
+	if err != nil {
+		return err
+	}
+	_, err = sqs.New(sess, awsServiceConfig("sqs")).SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(queueURL),
+		MessageBody: aws.String(string(payload)),
+	})
+	return err
+}
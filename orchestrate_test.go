@@ -0,0 +1,41 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestShardRequest(t *testing.T) {
+	shard := &Shard{Provider: "aws", Account: "default", Region: "us-east-1", Resources: []string{"ec2.instances"}}
+	req := &Request{
+		TaskName:          "orchestrate",
+		ConfigPath:        "s3://bucket/config.yml",
+		Providers:         []ProviderConfig{{Name: "aws", Rest: map[string]interface{}{}}},
+		ProvidersMode:     "merge",
+		ContinuationToken: "token",
+		AutoResume:        true,
+		RunID:             "run",
+		SkipMigrations:    true,
+		Export:            "s3://bucket/export",
+	}
+	want := &Request{
+		TaskName:       "fetch",
+		ConfigPath:     req.ConfigPath,
+		Providers:      req.Providers,
+		ProvidersMode:  req.ProvidersMode,
+		Shard:          shard,
+		AutoResume:     true,
+		RunID:          "run-3",
+		SkipMigrations: true,
+		Export:         req.Export,
+	}
+	got := shardRequest(req, shard, 3)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("shardRequest() = %+v, want %+v", got, want)
+	}
+
+	req.RunID = ""
+	if got := shardRequest(req, shard, 3); got.RunID != "" {
+		t.Errorf("shardRequest() without a run ID = %q, want none", got.RunID)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/okta/okta-sdk-golang/v2/okta"
+	"google.golang.org/api/googleapi"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Outcomes of a single resource fetch
+const (
+	OutcomeOK           = "ok"
+	OutcomeAccessDenied = "skipped-access-denied"
+	OutcomeThrottled    = "throttled"
+	OutcomeError        = "error"
+	// The aws region isn't enabled in the account
+	OutcomeRegionDisabled = "skipped-region-disabled"
+)
+
+var awsAccessDeniedCodes = map[string]bool{
+	"AccessDenied":          true,
+	"AccessDeniedException": true,
+	"UnauthorizedOperation": true,
+	"AuthorizationError":    true,
+}
+
+var awsThrottlingCodes = map[string]bool{
+	"Throttling":                             true,
+	"ThrottlingException":                    true,
+	"ThrottledException":                     true,
+	"RequestLimitExceeded":                   true,
+	"RequestThrottled":                       true,
+	"RequestThrottledException":              true,
+	"TooManyRequestsException":               true,
+	"ProvisionedThroughputExceededException": true,
+	"SlowDown":                               true,
+}
+
+// Classifies the error of a resource fetch into one of the outcomes
+func resourceOutcome(err error) string {
+	if err == nil {
+		return OutcomeOK
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		switch {
+		case awsAccessDeniedCodes[awsErr.Code()]:
+			return OutcomeAccessDenied
+		case awsThrottlingCodes[awsErr.Code()]:
+			return OutcomeThrottled
+		}
+	}
+	var googleErr *googleapi.Error
+	if errors.As(err, &googleErr) {
+		switch googleErr.Code {
+		case http.StatusForbidden:
+			return OutcomeAccessDenied
+		case http.StatusTooManyRequests:
+			return OutcomeThrottled
+		}
+	}
+	var oktaErr *okta.Error
+	if errors.As(err, &oktaErr) {
+		switch oktaErr.ErrorCode {
+		case "E0000006":
+			return OutcomeAccessDenied
+		case "E0000047":
+			return OutcomeThrottled
+		}
+	}
+	switch {
+	case k8serrors.IsForbidden(err):
+		return OutcomeAccessDenied
+	case k8serrors.IsTooManyRequests(err):
+		return OutcomeThrottled
+	}
+	return OutcomeError
+}
+
+// Reports whether an outcome means the resource is covered or deliberately skipped
+func outcomeSucceeded(outcome string) bool {
+	return outcome == OutcomeOK || outcome == OutcomeAccessDenied || outcome == OutcomeRegionDisabled || outcome == StatusCompleted
+}
+
+// Providers that implement outcomeReporter report their own resource outcomes, e.g. per account and region
+type outcomeReporter interface {
+	resourceOutcomes() []ResourceOutcome
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+func init() {
+	RegisterTask("plan", Task{
+		Description: "Splits the config into shards and returns a fetch request for each of them, for a Step Functions Map state",
+		NewRequest:  func() interface{} { return &Request{} },
+		Run: func(ctx context.Context, req interface{}, resp *Response) error {
+			return Plan(req.(*Request), resp)
+		},
+	})
+	RegisterTask("summarize", Task{
+		Description: "Merges the responses of the fetched shards into a single run report",
+		NewRequest:  func() interface{} { return &SummarizeRequest{} },
+		Run: func(ctx context.Context, req interface{}, resp *Response) error {
+			return Summarize(req.(*SummarizeRequest), resp)
+		},
+	})
+}
+
+// Plans the shards of the config. Every entry of resp.Plan is a valid fetch request,
+// so a Map state can iterate over $.plan and invoke the function with each item.
+func Plan(req *Request, resp *Response) error {
+	config, err := resolveConfig(req)
+	if err != nil {
+		return newTaskError(ErrorTypeConfig, err)
+	}
+	shards, err := planShards(config)
+	if err != nil {
+		return newTaskError(ErrorTypeConfig, err)
+	}
+	resp.Plan = make([]*Request, 0, len(shards))
+	for i := range shards {
+		resp.Plan = append(resp.Plan, shardRequest(req, &shards[i], i))
+	}
+	return nil
+}
+
+type SummarizeRequest struct {
+	// Output of the Map state. Items are either a fetch response or the output of a Catch
+	// clause, see decodeShardResult.
+	Results []json.RawMessage `json:"results"`
+}
+
+// RunReport summarizes the shards of a run
+type RunReport struct {
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	DurationMs int64     `json:"durationMs"`
+	Shards     int       `json:"shards"`
+	Succeeded  int       `json:"succeeded"`
+	Partial    int       `json:"partial"`
+	Failed     int       `json:"failed"`
+}
+
+// Output of a failed Lambda invocation as caught by a Step Functions Catch clause
+type caughtError struct {
+	Error string `json:"Error"`
+	Cause string `json:"Cause"`
+}
+
+// Merges the shard responses into a single report. Provider outcomes are merged by name,
+// resource outcomes are concatenated.
+func Summarize(req *SummarizeRequest, resp *Response) error {
+	report := RunReport{Shards: len(req.Results)}
+	providers := map[string]*ProviderOutcome{}
+	var providerOrder []string
+	for i, raw := range req.Results {
+		result, err := decodeShardResult(raw)
+		if err != nil {
+			return newTaskError(ErrorTypeInvalidRequest, fmt.Errorf("result %d: %w", i, err))
+		}
+		switch result.Status {
+		case StatusSucceeded:
+			report.Succeeded++
+		case StatusPartial:
+			report.Partial++
+		default:
+			report.Failed++
+		}
+		if !result.StartedAt.IsZero() && (report.StartedAt.IsZero() || result.StartedAt.Before(report.StartedAt)) {
+			report.StartedAt = result.StartedAt
+		}
+		if result.FinishedAt.After(report.FinishedAt) {
+			report.FinishedAt = result.FinishedAt
+		}
+		outcome := ShardOutcome{Shard: result.Shard, Status: result.Status}
+		if result.Error != nil {
+			outcome.Error = result.Error.Message
+		}
+		resp.Shards = append(resp.Shards, outcome)
+		for _, provider := range result.Providers {
+			merged, ok := providers[provider.Name]
+			if !ok {
+				merged = &ProviderOutcome{Name: provider.Name, Status: provider.Status, Error: provider.Error}
+				providers[provider.Name] = merged
+				providerOrder = append(providerOrder, provider.Name)
+				continue
+			}
+			merged.Status = mergeStatus(merged.Status, provider.Status)
+			if merged.Error == "" {
+				merged.Error = provider.Error
+			}
+		}
+		resp.Resources = append(resp.Resources, result.Resources...)
+	}
+	for _, name := range providerOrder {
+		resp.Providers = append(resp.Providers, *providers[name])
+	}
+	if !report.StartedAt.IsZero() {
+		report.DurationMs = report.FinishedAt.Sub(report.StartedAt).Milliseconds()
+	}
+	resp.Run = &report
+	resp.Status = aggregateStatus(report.Succeeded+report.Partial, report.Failed)
+	if report.Partial > 0 && resp.Status == StatusSucceeded {
+		resp.Status = StatusPartial
+	}
+	return nil
+}
+
+// Decodes a Map state item. Failed invocations are caught with their Error and Cause at the top
+// level, or under caught when the Catch clause uses "ResultPath": "$.caught" to keep the shard request.
+func decodeShardResult(raw json.RawMessage) (*Response, error) {
+	var keys map[string]json.RawMessage
+	err := json.Unmarshal(raw, &keys)
+	if err != nil {
+		return nil, err
+	}
+	caughtRaw, ok := keys["caught"]
+	if _, topLevel := keys["Error"]; topLevel {
+		caughtRaw, ok = raw, true
+	}
+	if !ok {
+		var result Response
+		err = json.Unmarshal(raw, &result)
+		if err != nil {
+			return nil, err
+		}
+		return &result, nil
+	}
+
+	var caught caughtError
+	err = json.Unmarshal(caughtRaw, &caught)
+	if err != nil {
+		return nil, err
+	}
+	result := Response{Status: StatusFailed}
+	if shardRaw, ok := keys["shard"]; ok {
+		err = json.Unmarshal(shardRaw, &result.Shard)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// the cause of a Lambda error is the JSON encoded function error
+	var cause struct {
+		ErrorMessage string `json:"errorMessage"`
+		ErrorType    string `json:"errorType"`
+	}
+	result.Error = &ErrorDetail{Type: caught.Error, Message: caught.Cause}
+	if json.Unmarshal([]byte(caught.Cause), &cause) == nil && cause.ErrorMessage != "" {
+		result.Error = &ErrorDetail{Type: cause.ErrorType, Message: cause.ErrorMessage}
+	}
+	return &result, nil
+}
+
+// Combines the status of the same provider across two shards
+func mergeStatus(a, b string) string {
+	if a == b {
+		return a
+	}
+	return StatusPartial
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSummarize(t *testing.T) {
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	shard := func(region string) *Shard {
+		return &Shard{Provider: "aws", Account: "111111111111", Region: region, Resources: []string{"ec2.instances"}}
+	}
+	succeeded := Response{
+		Status:     StatusSucceeded,
+		StartedAt:  start.Add(time.Second),
+		FinishedAt: start.Add(3 * time.Second),
+		Shard:      shard("us-east-1"),
+		Providers:  []ProviderOutcome{{Name: "aws", Status: StatusSucceeded}},
+		Resources: []ResourceOutcome{
+			{Provider: "aws", Account: "111111111111", Region: "us-east-1", Resource: "ec2.instances", Status: OutcomeOK},
+		},
+	}
+	partial := Response{
+		Status:     StatusPartial,
+		StartedAt:  start,
+		FinishedAt: start.Add(2 * time.Second),
+		Shard:      shard("eu-west-1"),
+		Providers:  []ProviderOutcome{{Name: "aws", Status: StatusPartial, Error: "ec2.instances: access denied"}},
+		Resources: []ResourceOutcome{
+			{Provider: "aws", Account: "111111111111", Region: "eu-west-1", Resource: "ec2.instances", Status: OutcomeAccessDenied},
+		},
+	}
+	caughtWithShard, err := json.Marshal(map[string]interface{}{
+		"shard": shard("ap-south-1"),
+		"caught": caughtError{
+			Error: "Lambda.Unknown",
+			Cause: `{"errorMessage":"task timed out","errorType":"timeout"}`,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := []json.RawMessage{caughtWithShard, []byte(`{"Error":"States.Timeout","Cause":"no response"}`)}
+	for _, r := range []Response{succeeded, partial} {
+		raw, err := json.Marshal(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results = append([]json.RawMessage{raw}, results...)
+	}
+
+	var resp Response
+	err = Summarize(&SummarizeRequest{Results: results}, &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRun := &RunReport{
+		StartedAt:  start,
+		FinishedAt: start.Add(3 * time.Second),
+		DurationMs: 3000,
+		Shards:     4,
+		Succeeded:  1,
+		Partial:    1,
+		Failed:     2,
+	}
+	if !reflect.DeepEqual(resp.Run, wantRun) {
+		t.Errorf("Summarize() run = %+v, want %+v", resp.Run, wantRun)
+	}
+	if resp.Status != StatusPartial {
+		t.Errorf("Summarize() status = %q, want %q", resp.Status, StatusPartial)
+	}
+	wantShards := []ShardOutcome{
+		{Shard: shard("eu-west-1"), Status: StatusPartial},
+		{Shard: shard("us-east-1"), Status: StatusSucceeded},
+		{Shard: shard("ap-south-1"), Status: StatusFailed, Error: "task timed out"},
+		{Status: StatusFailed, Error: "no response"},
+	}
+	if !reflect.DeepEqual(resp.Shards, wantShards) {
+		t.Errorf("Summarize() shards = %+v, want %+v", resp.Shards, wantShards)
+	}
+	wantProviders := []ProviderOutcome{{Name: "aws", Status: StatusPartial, Error: "ec2.instances: access denied"}}
+	if !reflect.DeepEqual(resp.Providers, wantProviders) {
+		t.Errorf("Summarize() providers = %+v, want %+v", resp.Providers, wantProviders)
+	}
+	wantResources := append(append([]ResourceOutcome(nil), partial.Resources...), succeeded.Resources...)
+	if !reflect.DeepEqual(resp.Resources, wantResources) {
+		t.Errorf("Summarize() resources = %+v, want %+v", resp.Resources, wantResources)
+	}
+}
+
+func TestSummarizeStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []string
+		want     string
+	}{
+		{name: "all succeeded", statuses: []string{StatusSucceeded, StatusSucceeded}, want: StatusSucceeded},
+		{name: "a partial shard", statuses: []string{StatusSucceeded, StatusPartial}, want: StatusPartial},
+		{name: "a failed shard", statuses: []string{StatusFailed, StatusSucceeded}, want: StatusPartial},
+		{name: "all failed", statuses: []string{StatusFailed, StatusFailed}, want: StatusFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var results []json.RawMessage
+			for _, status := range tt.statuses {
+				raw, err := json.Marshal(Response{Status: status})
+				if err != nil {
+					t.Fatal(err)
+				}
+				results = append(results, raw)
+			}
+			var resp Response
+			err := Summarize(&SummarizeRequest{Results: results}, &resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Status != tt.want {
+				t.Errorf("Summarize() status = %q, want %q", resp.Status, tt.want)
+			}
+		})
+	}
+
+	var resp Response
+	err := Summarize(&SummarizeRequest{Results: []json.RawMessage{[]byte(`[]`)}}, &resp)
+	if err == nil || errorType(err) != ErrorTypeInvalidRequest {
+		t.Errorf("Summarize() with a malformed result error = %v, want an %s error", err, ErrorTypeInvalidRequest)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/cloudquery/cloudquery/cloudqueryclient"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+)
+
+const defaultPolicyPath = "policy.yml"
+
+func init() {
+	RegisterTask("policy", Task{
+		Description: "Runs the queries in a policy file against the configured database",
+		NewRequest:  func() interface{} { return &Request{} },
+		Run: func(ctx context.Context, req interface{}, resp *Response) error {
+			return Policy(DRIVER, DSN, req.(*Request), VERBOSE, resp)
+		},
+	})
+}
+
+// Outcome of a single policy query. A query passes when it returns no rows.
+type QueryResult struct {
+	Name   string                   `json:"name"`
+	Passed bool                     `json:"passed"`
+	Count  int                      `json:"count"`
+	Rows   []map[string]interface{} `json:"rows,omitempty"`
+	Error  string                   `json:"error,omitempty"`
+}
+
+type PolicyResult struct {
+	Path    string        `json:"path"`
+	Passed  bool          `json:"passed"`
+	Queries []QueryResult `json:"queries"`
+}
+
+// Runs the policy SQL statements and records the results of each query. The findings are stored
+// in cloudquery_policy_results under the run ID. With CLOUDQUERY_SQLITE_SNAPSHOT the database is
+// restored from S3 first and uploaded with the findings afterwards.
+func Policy(driver, dsn string, req *Request, verbose bool, resp *Response) error {
+	path := req.PolicyPath
+	if path == "" {
+		path = defaultPolicyPath
+	}
+	location := sqliteSnapshotLocation()
+	if location != "" {
+		var err error
+		driver, dsn, err = sqliteSnapshotDatabase(driver, dsn)
+		if err != nil {
+			return newTaskError(ErrorTypeConfig, err)
+		}
+		err = restoreSQLiteSnapshot(location, dsn)
+		if err != nil {
+			return newTaskError(ErrorTypeDatabase, fmt.Errorf("unable to download the sqlite snapshot: %w", err))
+		}
+	}
+	db, err := openDB(driver, dsn)
+	if err != nil {
+		return newTaskError(ErrorTypeDatabase, fmt.Errorf("unable to connect to database: %w", err))
+	}
+	logger, err := cloudqueryclient.NewLogger(verbose)
+	if err != nil {
+		return newTaskError(ErrorTypeInternal, err)
+	}
+	var result *PolicyResult
+	err = snapshotTransaction(db, func(tx *gorm.DB) error {
+		result, err = runPolicy(tx, logger, path)
+		return err
+	})
+	if err != nil {
+		return newTaskError(ErrorTypePolicy, err)
+	}
+	resp.Policy = result
+	resp.RunID = req.RunID
+	if resp.RunID == "" {
+		resp.RunID = newRunID()
+	}
+	if !skipMigrations(req) {
+		err = db.AutoMigrate(&PolicyFinding{})
+	}
+	if err == nil {
+		err = savePolicyFindings(db, resp.RunID, result)
+	}
+	var uploadErr error
+	if err != nil {
+		logger.Error("Unable to store policy findings", zap.String("run_id", resp.RunID), zap.Error(err))
+	} else if location != "" {
+		resp.SQLiteSnapshot, uploadErr = uploadSQLiteSnapshot(db, location, dsn, resp.RunID)
+		if uploadErr != nil {
+			logger.Error("Unable to upload the sqlite snapshot", zap.String("run_id", resp.RunID), zap.Error(uploadErr))
+		}
+	}
+	succeeded, failed := 0, 0
+	for _, query := range result.Queries {
+		if query.Error != "" {
+			failed++
+		} else {
+			succeeded++
+		}
+	}
+	resp.Status = aggregateStatus(succeeded, failed)
+	if resp.Status == StatusFailed {
+		return newTaskError(ErrorTypePolicy, fmt.Errorf("all %d policy queries failed", failed))
+	}
+	if uploadErr != nil {
+		return newTaskError(ErrorTypeDatabase, fmt.Errorf("unable to upload the sqlite snapshot: %w", uploadErr))
+	}
+	return nil
+}
+
+// Loads a policy file in the cloudqueryclient.PolicyConfig format
+func loadPolicy(path string) (*cloudqueryclient.PolicyConfig, error) {
+	_, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("policy %s doesn't exist. set the policy field of the request to a policy file in the image", path)
+		}
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := cloudqueryclient.PolicyConfig{}
+	err = yaml.Unmarshal(data, &config)
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Runs every query in the policy file and collects the offending rows. Unlike
+// cloudqueryclient.Client.RunQuery the results are returned instead of rendered to stdout.
+// Versioned tables are read through their latest views, so a query never sees the rows of a
+// fetch that is still running or of older snapshots.
+func runPolicy(db *gorm.DB, log *zap.Logger, path string) (*PolicyResult, error) {
+	config, err := loadPolicy(path)
+	if err != nil {
+		return nil, err
+	}
+	tables, err := versionedTables()
+	if err != nil {
+		return nil, err
+	}
+
+	result := PolicyResult{
+		Path:    path,
+		Passed:  true,
+		Queries: make([]QueryResult, 0, len(config.Queries)),
+	}
+	log.Info("Executing queries", zap.Int("count", len(config.Queries)))
+	for _, query := range config.Queries {
+		log.Info("Executing query", zap.String("name", query.Name))
+		queryResult := runPolicyQuery(db, query.Name, readLatest(query.Query, tables))
+		if queryResult.Error != "" {
+			log.Error("Query failed", zap.String("name", query.Name), zap.String("error", queryResult.Error))
+		} else if queryResult.Passed {
+			log.Info("Check passed. Query returned no results.", zap.String("name", query.Name))
+		} else {
+			log.Info("Check failed. Query returned results.", zap.String("name", query.Name), zap.Int("count", queryResult.Count))
+		}
+		if !queryResult.Passed {
+			result.Passed = false
+		}
+		result.Queries = append(result.Queries, queryResult)
+	}
+	return &result, nil
+}
+
+// Runs a query in a savepoint, as a failed statement aborts the whole transaction on postgres
+func runPolicyQuery(db *gorm.DB, name, query string) QueryResult {
+	result := QueryResult{Name: name}
+	err := db.SavePoint("policy_query").Error
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Rows, err = queryRows(db, query, 0)
+	if err != nil {
+		result.Error = err.Error()
+		db.RollbackTo("policy_query")
+		return result
+	}
+	result.Count = len(result.Rows)
+	result.Passed = result.Count == 0
+	return result
+}
+
+// Returns the rows of a query, at most limit of them unless limit is 0
+func queryRows(db *gorm.DB, query string, limit int) ([]map[string]interface{}, error) {
+	rows, err := db.Raw(query).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanRows(rows, limit)
+}
+
+// Replaces the names of versioned tables outside quoted strings and comments with their latest
+// views, e.g. aws_ec2_instances with aws_ec2_instances_latest. Quoted identifiers are replaced
+// inside their quotes.
+func readLatest(query string, tables map[string]bool) string {
+	view := func(name string) string {
+		if tables[strings.ToLower(name)] {
+			return latestView(strings.ToLower(name))
+		}
+		return name
+	}
+	var out strings.Builder
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			end := i + 1
+			for end < len(query) && query[end] != c {
+				if query[end] == '\\' && c == '\'' {
+					end++
+				}
+				end++
+			}
+			if end >= len(query) {
+				out.WriteString(query[i:])
+				return out.String()
+			}
+			if c == '\'' {
+				out.WriteString(query[i : end+1])
+			} else {
+				out.WriteString(string(c) + view(query[i+1:end]) + string(c))
+			}
+			i = end
+		case c == '-' && strings.HasPrefix(query[i:], "--"), c == '/' && strings.HasPrefix(query[i:], "/*"):
+			terminator := "\n"
+			if c == '/' {
+				terminator = "*/"
+			}
+			end := strings.Index(query[i:], terminator)
+			if end < 0 {
+				out.WriteString(query[i:])
+				return out.String()
+			}
+			end += len(terminator)
+			out.WriteString(query[i : i+end])
+			i += end - 1
+		case isNameStart(c):
+			end := i + 1
+			for end < len(query) && (isNameStart(query[end]) || isDigit(query[end]) || query[end] == '$') {
+				end++
+			}
+			out.WriteString(view(query[i:end]))
+			i = end - 1
+		case isDigit(c):
+			// skips numbers like 1e5 so their letters aren't taken for names
+			end := i + 1
+			for end < len(query) && (isNameStart(query[end]) || isDigit(query[end])) {
+				end++
+			}
+			out.WriteString(query[i:end])
+			i = end - 1
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return out.String()
+}
+
+// Scans the rows into column name -> value maps, at most max of them unless max is 0. NULL
+// columns are returned as nil.
+func scanRows(rows *sql.Rows, max int) ([]map[string]interface{}, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	nc := len(columns)
+	res := make([]sql.NullString, nc)
+	resPtrs := make([]interface{}, nc)
+	for i := 0; i < nc; i++ {
+		resPtrs[i] = &res[i]
+	}
+	var results []map[string]interface{}
+	for (max == 0 || len(results) < max) && rows.Next() {
+		err := rows.Scan(resPtrs...)
+		if err != nil {
+			return nil, err
+		}
+		row := make(map[string]interface{}, nc)
+		for i, v := range res {
+			if v.Valid {
+				row[columns[i]] = v.String
+			} else {
+				row[columns[i]] = nil
+			}
+		}
+		results = append(results, row)
+	}
+	return results, rows.Err()
+}
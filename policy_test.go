@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadLatest(t *testing.T) {
+	long := "gcp_" + strings.Repeat("x", 60)
+	tables := map[string]bool{"aws_ec2_instances": true, "aws_s3_buckets": true, long: true}
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{
+			name:  "table",
+			query: "SELECT * FROM aws_ec2_instances WHERE region = 'us-east-1'",
+			want:  "SELECT * FROM aws_ec2_instances_latest WHERE region = 'us-east-1'",
+		},
+		{
+			name:  "join with aliases",
+			query: "SELECT i.instance_id, b.name FROM aws_ec2_instances i JOIN aws_s3_buckets AS b ON b.account_id = i.account_id",
+			want:  "SELECT i.instance_id, b.name FROM aws_ec2_instances_latest i JOIN aws_s3_buckets_latest AS b ON b.account_id = i.account_id",
+		},
+		{
+			name:  "names are matched case-insensitively",
+			query: "select count(*) from AWS_EC2_Instances",
+			want:  "select count(*) from aws_ec2_instances_latest",
+		},
+		{
+			name:  "qualified by a schema",
+			query: "SELECT * FROM public.aws_ec2_instances",
+			want:  "SELECT * FROM public.aws_ec2_instances_latest",
+		},
+		{
+			name:  "quoted identifiers",
+			query: "SELECT * FROM \"aws_ec2_instances\" JOIN `aws_s3_buckets` ON true",
+			want:  "SELECT * FROM \"aws_ec2_instances_latest\" JOIN `aws_s3_buckets_latest` ON true",
+		},
+		{
+			name:  "strings",
+			query: `SELECT 'aws_ec2_instances', 'it''s aws_ec2_instances', 'it\'s aws_s3_buckets' FROM aws_ec2_instances`,
+			want:  `SELECT 'aws_ec2_instances', 'it''s aws_ec2_instances', 'it\'s aws_s3_buckets' FROM aws_ec2_instances_latest`,
+		},
+		{
+			name:  "comments",
+			query: "SELECT * -- from aws_ec2_instances\nFROM /* aws_s3_buckets */ aws_s3_buckets",
+			want:  "SELECT * -- from aws_ec2_instances\nFROM /* aws_s3_buckets */ aws_s3_buckets_latest",
+		},
+		{
+			name:  "other tables and longer names",
+			query: "SELECT * FROM aws_ec2_instance_tags, aws_ec2_instances_latest, aws_ec2_instances2, cloudquery_fetches",
+			want:  "SELECT * FROM aws_ec2_instance_tags, aws_ec2_instances_latest, aws_ec2_instances2, cloudquery_fetches",
+		},
+		{
+			name:  "numbers aren't names",
+			query: "SELECT 1e5, 2aws_s3_buckets FROM aws_s3_buckets",
+			want:  "SELECT 1e5, 2aws_s3_buckets FROM aws_s3_buckets_latest",
+		},
+		{
+			name:  "shortened view names",
+			query: "SELECT * FROM " + long,
+			want:  "SELECT * FROM " + identifier(long+"_latest"),
+		},
+		{
+			name:  "unterminated string",
+			query: "SELECT * FROM aws_s3_buckets WHERE name = 'aws_s3_buckets",
+			want:  "SELECT * FROM aws_s3_buckets_latest WHERE name = 'aws_s3_buckets",
+		},
+		{
+			name:  "unterminated comment",
+			query: "SELECT * FROM aws_s3_buckets /* aws_s3_buckets",
+			want:  "SELECT * FROM aws_s3_buckets_latest /* aws_s3_buckets",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readLatest(tt.query, tables); got != tt.want {
+				t.Errorf("readLatest() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Child tables without a primary key have no latest view and are read as they are
+func TestReadLatestVersionedTables(t *testing.T) {
+	tables, err := versionedTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := "SELECT * FROM azure_resources_groups g JOIN azure_resources_group_tags t ON t.group_id = g.id"
+	want := "SELECT * FROM azure_resources_groups_latest g JOIN azure_resources_group_tags t ON t.group_id = g.id"
+	if got := readLatest(query, tables); got != want {
+		t.Errorf("readLatest() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	StatusPartial   = "partial"
+	// The provider or resource was skipped because the deadline was close
+	StatusDeferred = "deferred"
+	// The provider or resource was skipped because it completed in an earlier invocation of the run
+	StatusCompleted = "completed"
+)
+
+// Response is returned by every task so callers such as Step Functions can branch on the outcome
+type Response struct {
+	TaskName   string    `json:"taskName"`
+	Status     string    `json:"status"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	DurationMs int64     `json:"durationMs"`
+	RunID      string    `json:"runId,omitempty"`
+	// Schema version the migrate task migrated the tables to
+	SchemaVersion string `json:"schemaVersion,omitempty"`
+	// Set when a fetch stopped before its deadline. Pass it back to resume the run.
+	ContinuationToken string            `json:"continuationToken,omitempty"`
+	Providers         []ProviderOutcome `json:"providers,omitempty"`
+	Resources         []ResourceOutcome `json:"resources,omitempty"`
+	Shard             *Shard            `json:"shard,omitempty"`
+	Shards            []ShardOutcome    `json:"shards,omitempty"`
+	Plan              []*Request        `json:"plan,omitempty"`
+	Run               *RunReport        `json:"run,omitempty"`
+	Policy            *PolicyResult     `json:"policy,omitempty"`
+	Validation        *ValidationResult `json:"validation,omitempty"`
+	Catalog           []CatalogProvider `json:"catalog,omitempty"`
+	Diff              *DiffResult       `json:"diff,omitempty"`
+	Export            *ExportResult     `json:"export,omitempty"`
+	// The upload of the sqlite database, see sqlitesnapshot.go
+	SQLiteSnapshot string       `json:"sqliteSnapshot,omitempty"`
+	Markdown       string       `json:"markdown,omitempty"`
+	Error          *ErrorDetail `json:"error,omitempty"`
+}
+
+type ProviderOutcome struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ResourceOutcome is the result of fetching a resource. Status is one of ok, skipped-access-denied,
+// throttled, error, deferred or completed. Account and region are only set by providers with
+// per account and region resources, global aws resources have no region.
+type ResourceOutcome struct {
+	Provider string `json:"provider"`
+	Account  string `json:"account,omitempty"`
+	Region   string `json:"region,omitempty"`
+	Resource string `json:"resource"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+}
+
+type ErrorDetail struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+func newResponse(taskName string) *Response {
+	return &Response{
+		TaskName:  taskName,
+		Status:    StatusSucceeded,
+		StartedAt: time.Now().UTC(),
+	}
+}
+
+// Marks the response as failed with the given error
+func (r *Response) fail(err error) {
+	r.Status = StatusFailed
+	r.Error = &ErrorDetail{
+		Type:    errorType(err),
+		Message: err.Error(),
+	}
+}
+
+// Sets the end timestamp and duration of the task
+func (r *Response) finish() *Response {
+	r.FinishedAt = time.Now().UTC()
+	r.DurationMs = r.FinishedAt.Sub(r.StartedAt).Milliseconds()
+	return r
+}
+
+// Derives an overall status from a number of succeeded and failed units of work
+func aggregateStatus(succeeded, failed int) string {
+	switch {
+	case failed == 0:
+		return StatusSucceeded
+	case succeeded == 0:
+		return StatusFailed
+	default:
+		return StatusPartial
+	}
+}
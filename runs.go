@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// The run was dispatched and hasn't finished yet, or is resumed in another invocation
+const StatusRunning = "running"
+
+// Findings older than this are removed when a policy runs
+const policyResultRetention = 30 * 24 * time.Hour
+
+// RunRecord tracks the status of a task run that was started with a run ID, e.g. by the HTTP API
+type RunRecord struct {
+	ID         string     `gorm:"primaryKey" json:"runId"`
+	TaskName   string     `json:"taskName"`
+	Status     string     `json:"status"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	// The task response as JSON
+	Response string `json:"-"`
+}
+
+func (RunRecord) TableName() string {
+	return "cloudquery_runs"
+}
+
+// PolicyFinding is the stored result of one query of a policy run
+type PolicyFinding struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	RunID     string    `gorm:"index" json:"runId"`
+	Policy    string    `gorm:"index" json:"policy"`
+	Query     string    `json:"query"`
+	Passed    bool      `json:"passed"`
+	Count     int       `json:"count"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+	// The offending rows as JSON
+	Rows string `json:"-"`
+}
+
+func (PolicyFinding) TableName() string {
+	return "cloudquery_policy_results"
+}
+
+// Name under which the findings of a policy file are stored: the file name without extension
+func policyName(path string) string {
+	name := filepath.Base(path)
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// Creates or updates the run record
+func saveRun(db *gorm.DB, run *RunRecord) error {
+	return db.Save(run).Error
+}
+
+// Records the outcome of a task that was started with a run ID. A fetch that resumes itself
+// stays running. With the sqlite snapshots the record is written to the local database, which the
+// next fetch or policy run of the instance uploads.
+func trackRun(req *Request, resp *Response) {
+	if req.RunID == "" {
+		return
+	}
+	driver, dsn, err := taskDatabase(DRIVER, DSN)
+	var db *gorm.DB
+	if err == nil {
+		db, err = openDB(driver, dsn)
+	}
+	if err != nil {
+		log.Printf("Unable to record run %s: %s", req.RunID, err)
+		return
+	}
+	status := resp.Status
+	if resp.ContinuationToken != "" && req.AutoResume {
+		status = StatusRunning
+	}
+	data, _ := json.Marshal(resp)
+	run := RunRecord{ID: req.RunID, TaskName: resp.TaskName, Status: status, StartedAt: resp.StartedAt, Response: string(data)}
+	var existing RunRecord
+	if db.Where("id = ?", req.RunID).Take(&existing).Error == nil {
+		run.StartedAt = existing.StartedAt
+	}
+	if status != StatusRunning {
+		run.FinishedAt = &resp.FinishedAt
+	}
+	err = saveRun(db, &run)
+	if err != nil {
+		log.Printf("Unable to record run %s: %s", req.RunID, err)
+	}
+}
+
+// Stores the findings of a policy run and removes the ones past the retention
+func savePolicyFindings(db *gorm.DB, runID string, result *PolicyResult) error {
+	name := policyName(result.Path)
+	now := time.Now().UTC()
+	findings := make([]PolicyFinding, 0, len(result.Queries))
+	for _, query := range result.Queries {
+		rows, _ := json.Marshal(query.Rows)
+		findings = append(findings, PolicyFinding{
+			RunID:     runID,
+			Policy:    name,
+			Query:     query.Name,
+			Passed:    query.Passed,
+			Count:     query.Count,
+			Error:     query.Error,
+			CheckedAt: now,
+			Rows:      string(rows),
+		})
+	}
+	if len(findings) > 0 {
+		err := db.Create(&findings).Error
+		if err != nil {
+			return err
+		}
+	}
+	return db.Where("checked_at < ?", now.Add(-policyResultRetention)).Delete(&PolicyFinding{}).Error
+}
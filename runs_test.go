@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Registers a task for the duration of the test
+func registerTestTask(t *testing.T, name string, run func(ctx context.Context, req interface{}, resp *Response) error) {
+	RegisterTask(name, Task{
+		Description: "test task",
+		NewRequest:  func() interface{} { return &Request{} },
+		Run:         run,
+	})
+	t.Cleanup(func() { delete(taskRegistry, name) })
+}
+
+// Points the tasks at a sqlite database with the run records for the duration of the test
+func useRunDatabase(t *testing.T) {
+	driver, dsn := DRIVER, DSN
+	DRIVER, DSN = "sqlite", testSQLiteDSN(t)
+	t.Cleanup(func() { DRIVER, DSN = driver, dsn })
+	db, err := openDB(DRIVER, DSN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AutoMigrate(&RunRecord{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Returns the record of a run that was dispatched before its task started
+func dispatchedRun(t *testing.T, id string) *RunRecord {
+	db, err := openDB(DRIVER, DSN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := &RunRecord{ID: id, TaskName: "test", Status: StatusRunning, StartedAt: time.Now().UTC().Add(-time.Minute)}
+	err = saveRun(db, run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return run
+}
+
+func readRun(t *testing.T, id string) RunRecord {
+	db, err := openDB(DRIVER, DSN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var run RunRecord
+	err = db.Where("id = ?", id).Take(&run).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return run
+}
+
+func TestTrackRun(t *testing.T) {
+	useRunDatabase(t)
+	registerTestTask(t, "test-succeed", func(ctx context.Context, req interface{}, resp *Response) error {
+		return nil
+	})
+	registerTestTask(t, "test-fail", func(ctx context.Context, req interface{}, resp *Response) error {
+		return newTaskError(ErrorTypeFetch, errors.New("all 1 providers failed"))
+	})
+	registerTestTask(t, "test-stop", func(ctx context.Context, req interface{}, resp *Response) error {
+		resp.Status = StatusPartial
+		resp.ContinuationToken = encodeContinuationToken("run-stop")
+		return nil
+	})
+	tests := []struct {
+		name         string
+		payload      string
+		wantStatus   string
+		wantFinished bool
+	}{
+		{name: "succeeded", payload: `{"taskName": "test-succeed", "runId": "run-succeed"}`, wantStatus: StatusSucceeded, wantFinished: true},
+		{name: "failed", payload: `{"taskName": "test-fail", "runId": "run-fail"}`, wantStatus: StatusFailed, wantFinished: true},
+		{name: "resumed", payload: `{"taskName": "test-stop", "runId": "run-stop", "autoResume": true}`, wantStatus: StatusRunning},
+		{name: "stopped", payload: `{"taskName": "test-stop", "runId": "run-stopped"}`, wantStatus: StatusPartial, wantFinished: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req Request
+			err := json.Unmarshal([]byte(tt.payload), &req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dispatched := dispatchedRun(t, req.RunID)
+			_, _ = handle(context.Background(), []byte(tt.payload))
+			run := readRun(t, req.RunID)
+			if run.Status != tt.wantStatus {
+				t.Errorf("run status = %q, want %q", run.Status, tt.wantStatus)
+			}
+			if (run.FinishedAt != nil) != tt.wantFinished {
+				t.Errorf("run finished at %v, want finished %v", run.FinishedAt, tt.wantFinished)
+			}
+			if !run.StartedAt.Equal(dispatched.StartedAt) {
+				t.Errorf("run started at %s, want the dispatch time %s", run.StartedAt, dispatched.StartedAt)
+			}
+			if run.Response == "" {
+				t.Error("run response wasn't recorded")
+			}
+		})
+	}
+}
+
+// A task that panics fails its run rather than leaving it running
+func TestTrackRunOfPanickingTask(t *testing.T) {
+	useRunDatabase(t)
+	registerTestTask(t, "test-panic", func(ctx context.Context, req interface{}, resp *Response) error {
+		panic("nil map")
+	})
+	dispatchedRun(t, "run-panic")
+
+	resp, err := handle(context.Background(), []byte(`{"taskName": "test-panic", "runId": "run-panic"}`))
+	if resp != nil || errorType(err) != ErrorTypePanic {
+		t.Fatalf("handle() = %v, %v, want a %s error", resp, err, ErrorTypePanic)
+	}
+	run := readRun(t, "run-panic")
+	if run.Status != StatusFailed || run.FinishedAt == nil {
+		t.Errorf("run = %+v, want it failed and finished", run)
+	}
+	if !strings.Contains(run.Response, "panic: nil map") {
+		t.Errorf("run response = %s, want the panic", run.Response)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Path prefix of the S3 stub. Point the clients at it with CLOUDQUERY_S3_ENDPOINT=<server url>/s3.
+const s3StubPrefix = "/s3/"
+
+// s3StubStore emulates the path-style S3 object operations the sqlite snapshots and the export
+// use, storing the objects as files under <dir>/<bucket>/<key>. Signatures aren't checked. Writes
+// honor If-Match and If-None-Match: * like S3's conditional writes.
+type s3StubStore struct {
+	dir  string
+	lock sync.Mutex
+}
+
+func newS3StubStore(dir string) (*s3StubStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &s3StubStore{dir: dir}, nil
+}
+
+func (s *s3StubStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, s3StubPrefix))
+	if strings.Count(name, "/") < 2 {
+		s3StubError(w, http.StatusBadRequest, "InvalidRequest", "only object operations are supported")
+		return
+	}
+	file := filepath.Join(s.dir, filepath.FromSlash(name))
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		current, err := ioutil.ReadFile(file)
+		ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+		if ifMatch != "" && os.IsNotExist(err) {
+			s3StubError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		if (ifMatch != "" && ifMatch != s3StubETag(current)) || (ifNoneMatch == "*" && err == nil) {
+			s3StubError(w, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+			return
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(file), 0755)
+		}
+		if err == nil {
+			err = ioutil.WriteFile(file, data, 0644)
+		}
+		if err != nil {
+			s3StubError(w, http.StatusInternalServerError, "InternalError", err.Error())
+			return
+		}
+		w.Header().Set("ETag", s3StubETag(data))
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet, http.MethodHead:
+		data, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			s3StubError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		if err != nil {
+			s3StubError(w, http.StatusInternalServerError, "InternalError", err.Error())
+			return
+		}
+		etag := s3StubETag(data)
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		s3StubError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+	}
+}
+
+func s3StubETag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// The errors are shaped like the XML errors of S3, which the SDK reads the code from
+func s3StubError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_ = xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}{Code: code, Message: message})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Bump when the tables owned by this repo, such as cloudquery_checkpoints, change
+const internalSchemaRevision = 4
+
+// Name under which the tables owned by this repo are recorded in cloudquery_schema_versions
+const internalSchema = "cloudquery"
+
+func init() {
+	RegisterTask("migrate", Task{
+		Description: "Creates or updates the tables of the providers in config.yml without fetching anything",
+		NewRequest:  func() interface{} { return &Request{} },
+		Run: func(ctx context.Context, req interface{}, resp *Response) error {
+			return Migrate(DRIVER, DSN, req.(*Request), resp)
+		},
+	})
+}
+
+// SchemaVersion records the schema version a provider's tables were last migrated to
+type SchemaVersion struct {
+	Provider   string `gorm:"primaryKey"`
+	Version    string
+	MigratedAt time.Time
+}
+
+func (SchemaVersion) TableName() string {
+	return "cloudquery_schema_versions"
+}
+
+// Returns the schema version of this binary: the version of the cloudquery module, which defines
+// the provider tables, and the revision of the internal tables.
+func currentSchemaVersion() string {
+	cloudqueryVersion := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == "github.com/cloudquery/cloudquery" {
+				cloudqueryVersion = dep.Version
+				if dep.Replace != nil {
+					cloudqueryVersion = dep.Replace.Version
+				}
+			}
+		}
+	}
+	return fmt.Sprintf("%s/%d", cloudqueryVersion, internalSchemaRevision)
+}
+
+// Migrates the internal tables and the tables of every provider in the config, and records
+// the schema version of each of them
+func Migrate(driver, dsn string, req *Request, resp *Response) error {
+	db, err := openDB(driver, dsn)
+	if err != nil {
+		return newTaskError(ErrorTypeDatabase, fmt.Errorf("unable to initialize client: %w", err))
+	}
+	config, err := resolveConfig(req)
+	if err != nil {
+		return newTaskError(ErrorTypeConfig, err)
+	}
+	version := currentSchemaVersion()
+	resp.SchemaVersion = version
+
+	err = migrateInternal(db)
+	if err == nil {
+		err = recordSchemaVersion(db, internalSchema, version)
+	}
+	if err != nil {
+		return newTaskError(ErrorTypeDatabase, fmt.Errorf("unable to migrate internal tables: %w", err))
+	}
+	succeeded, failed := 0, 0
+	for _, provider := range config.Providers {
+		outcome := ProviderOutcome{Name: provider.Name, Status: StatusSucceeded}
+		err := migrateProvider(db, provider.Name)
+		if err == nil {
+			err = recordSchemaVersion(db, provider.Name, version)
+		}
+		if err != nil {
+			outcome.Status = StatusFailed
+			outcome.Error = err.Error()
+			failed++
+		} else {
+			succeeded++
+		}
+		resp.Providers = append(resp.Providers, outcome)
+	}
+	resp.Status = aggregateStatus(succeeded, failed)
+	if resp.Status == StatusFailed {
+		return newTaskError(ErrorTypeDatabase, fmt.Errorf("unable to migrate any of the %d providers", failed))
+	}
+	return nil
+}
+
+// Creates the tables owned by this repo
+func migrateInternal(db *gorm.DB) error {
+	return db.AutoMigrate(&SchemaVersion{}, &Checkpoint{}, &RunRecord{}, &PolicyFinding{}, &FetchRecord{}, &FetchScope{})
+}
+
+// Runs the migrations of every resource of a provider, then adds the snapshot columns and views.
+// Each runs in its own session, as some of them change the naming strategy.
+func migrateProvider(db *gorm.DB, name string) error {
+	resources := resourceRegistry[name]
+	if resources == nil {
+		return fmt.Errorf("provider %s is not supported", name)
+	}
+	for _, resource := range supportedResources(name) {
+		err := resources[resource](db.Session(&gorm.Session{}))
+		if err != nil {
+			return fmt.Errorf("resource %s: %w", resource, err)
+		}
+	}
+	return migrateSnapshotTables(db.Session(&gorm.Session{}), name)
+}
+
+// migrationlessDialector leaves out the AutoMigrate calls of the vendored providers, which
+// migrate their tables whenever they are created
+type migrationlessDialector struct {
+	gorm.Dialector
+}
+
+func (d migrationlessDialector) Migrator(db *gorm.DB) gorm.Migrator {
+	return migrationlessMigrator{Migrator: d.Dialector.Migrator(db)}
+}
+
+type migrationlessMigrator struct {
+	gorm.Migrator
+}
+
+func (migrationlessMigrator) AutoMigrate(dst ...interface{}) error {
+	return nil
+}
+
+// Returns a session whose AutoMigrate does nothing, for providers whose tables are migrated by
+// migrateProvider. A session has its own copy of the config, so the pool is unaffected.
+func migrationlessDB(db *gorm.DB) *gorm.DB {
+	tx := db.Session(&gorm.Session{})
+	tx.Dialector = migrationlessDialector{Dialector: tx.Dialector}
+	return tx
+}
+
+// Message the vendored providers log before they migrate their tables
+const providerMigrationMessage = "Creating tables if needed"
+
+// migrationlessCore drops the message the providers log before the migrations that
+// migrationlessDB leaves out
+type migrationlessCore struct {
+	zapcore.Core
+}
+
+func (c migrationlessCore) With(fields []zapcore.Field) zapcore.Core {
+	return migrationlessCore{Core: c.Core.With(fields)}
+}
+
+func (c migrationlessCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if entry.Message == providerMigrationMessage {
+		return checked
+	}
+	return c.Core.Check(entry, checked)
+}
+
+func recordSchemaVersion(db *gorm.DB, provider, version string) error {
+	return db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&SchemaVersion{
+		Provider:   provider,
+		Version:    version,
+		MigratedAt: time.Now().UTC(),
+	}).Error
+}
+
+// Reports whether fetches should skip migrations. Set by the request or CLOUDQUERY_SKIP_MIGRATIONS=true.
+func skipMigrations(req *Request) bool {
+	return req.SkipMigrations || os.Getenv("CLOUDQUERY_SKIP_MIGRATIONS") == "true"
+}
+
+// Fails unless the internal tables and the tables of every provider were migrated to the
+// schema version of this binary
+func checkSchema(db *gorm.DB, providers []string) error {
+	version := currentSchemaVersion()
+	for _, provider := range append([]string{internalSchema}, providers...) {
+		var recorded SchemaVersion
+		err := db.Where("provider = ?", provider).Take(&recorded).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) || (err != nil && !db.Migrator().HasTable(&SchemaVersion{})) {
+			return fmt.Errorf("the tables of %s were never migrated. run the migrate task first", provider)
+		}
+		if err != nil {
+			return err
+		}
+		if recorded.Version != version {
+			return fmt.Errorf("the tables of %s are at schema version %s but this binary needs %s. run the migrate task first",
+				provider, recorded.Version, version)
+		}
+	}
+	return nil
+}
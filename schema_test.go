@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+type migrationlessModel struct {
+	ID int
+}
+
+func TestMigrationlessDB(t *testing.T) {
+	db, err := newDB("sqlite", &databaseSource{dsn: ":memory:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlDB.Close()
+	sqlDB.SetMaxOpenConns(1)
+
+	tx := migrationlessDB(db)
+	err = tx.AutoMigrate(&migrationlessModel{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Migrator().HasTable(&migrationlessModel{}) {
+		t.Fatalf("migrationlessDB created a table")
+	}
+	err = db.AutoMigrate(&migrationlessModel{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !db.Migrator().HasTable(&migrationlessModel{}) {
+		t.Fatalf("migrationlessDB changed the migrations of the pool")
+	}
+	err = tx.Create(&migrationlessModel{ID: 1}).Error
+	if err != nil {
+		t.Fatalf("unable to write through migrationlessDB: %s", err)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda/messages"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/spf13/pflag"
+)
+
+const defaultServeTimeout = 15 * time.Minute
+
+// invokeServer emulates the invoke API of the Lambda Runtime Interface Emulator, so the
+// function can be tested locally without Docker
+type invokeServer struct {
+	functionName string
+	region       string
+	timeout      time.Duration
+	// invocations run one at a time like in a single Lambda instance
+	lock sync.Mutex
+}
+
+// Runs the local invoke server and returns the exit code
+func runServe(args []string, stderr io.Writer) int {
+	flags := pflag.NewFlagSet("serve", pflag.ContinueOnError)
+	flags.SetOutput(stderr)
+	addr := flags.String("addr", ":8080", "address to listen on")
+	timeout := flags.Duration("timeout", defaultServeTimeout, "simulated function timeout, the deadline of every invocation")
+	functionName := flags.String("function-name", "function", "function name reported in the Lambda context")
+	driver := flags.String("driver", DRIVER, "database driver: sqlite, postgresql, mysql, sqlserver or rds-data-api. defaults to CLOUDQUERY_DRIVER")
+	dsn := flags.String("dsn", DSN, "database connection string. defaults to CLOUDQUERY_DATABASE_STRING")
+	verbose := flags.BoolP("verbose", "v", VERBOSE, "log debug messages")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: ./main serve [flags]\n\nEmulates the Lambda invoke API on POST /2015-03-31/functions/function/invocations\n\nFlags:\n%s", flags.FlagUsages())
+	}
+	err := parseFlags(flags, args, stderr)
+	if err != nil {
+		return 2
+	}
+	DRIVER, DSN, VERBOSE = *driver, *dsn, *verbose
+
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	lambdacontext.FunctionName = *functionName
+	server := &invokeServer{functionName: *functionName, region: region, timeout: *timeout}
+	host := *addr
+	if strings.HasPrefix(host, ":") {
+		host = "localhost" + host
+	}
+	log.Printf("Listening on %s. Invoke with: http post http://%s/2015-03-31/functions/function/invocations taskName=fetch", *addr, host)
+	err = http.ListenAndServe(*addr, server)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// Serves POST /2015-03-31/functions/{name}/invocations. Any function name is accepted, so the
+// orchestrate task can dispatch shards to the server through CLOUDQUERY_LAMBDA_ENDPOINT. Other
+// paths are passed to the HTTP API like a Function URL would.
+func (s *invokeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/2015-03-31/functions/") || !strings.HasSuffix(r.URL.Path, "/invocations") {
+		s.serveFunctionURL(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	payload, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(payload) == 0 {
+		payload = []byte("{}")
+	}
+	if r.Header.Get("X-Amz-Invocation-Type") == "Event" {
+		go s.invoke(payload)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	out, failed := s.invoke(payload)
+	w.Header().Set("Content-Type", "application/json")
+	if failed {
+		w.Header().Set("X-Amz-Function-Error", "Unhandled")
+	}
+	_, _ = w.Write(out)
+}
+
+// Invokes the function with the payload format 2.0 event of a Function URL and writes its HTTP response
+func (s *invokeServer) serveFunctionURL(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	event := events.APIGatewayV2HTTPRequest{
+		Version:        "2.0",
+		RouteKey:       "$default",
+		RawPath:        r.URL.Path,
+		RawQueryString: r.URL.RawQuery,
+		Headers:        map[string]string{},
+		RequestContext: events.APIGatewayV2HTTPRequestContext{
+			RouteKey: "$default",
+			Stage:    "$default",
+			HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+				Method:   r.Method,
+				Path:     r.URL.Path,
+				Protocol: r.Proto,
+				SourceIP: r.RemoteAddr,
+			},
+		},
+		Body: string(body),
+	}
+	for name := range r.Header {
+		event.Headers[strings.ToLower(name)] = r.Header.Get(name)
+	}
+	payload, _ := json.Marshal(event)
+	out, failed := s.invoke(payload)
+	var resp events.APIGatewayV2HTTPResponse
+	if failed || json.Unmarshal(out, &resp) != nil || resp.StatusCode == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write(out)
+		return
+	}
+	for name, value := range resp.Headers {
+		w.Header().Set(name, value)
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.WriteString(w, resp.Body)
+}
+
+// Calls LambdaHandler with a context like the one the Lambda runtime passes. Returns the
+// encoded response and whether it is a function error.
+func (s *invokeServer) invoke(payload []byte) ([]byte, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	requestID := newRunID()
+	start := time.Now()
+	ctx, cancel := context.WithDeadline(context.Background(), start.Add(s.timeout))
+	defer cancel()
+	ctx = lambdacontext.NewContext(ctx, &lambdacontext.LambdaContext{
+		AwsRequestID:       requestID,
+		InvokedFunctionArn: fmt.Sprintf("arn:aws:lambda:%s:000000000000:function:%s", s.region, s.functionName),
+	})
+
+	log.Printf("START RequestId: %s", requestID)
+	var out []byte
+	var failed bool
+	resp, err := LambdaHandler(ctx, payload)
+	if err != nil {
+		failed = true
+		invokeErr, ok := err.(messages.InvokeResponse_Error)
+		if !ok {
+			invokeErr = messages.InvokeResponse_Error{Type: errorType(err), Message: err.Error()}
+		}
+		out, _ = json.Marshal(invokeErr)
+	} else {
+		out, err = json.Marshal(resp)
+		if err != nil {
+			failed = true
+			out, _ = json.Marshal(messages.InvokeResponse_Error{Type: ErrorTypeInternal, Message: err.Error()})
+		}
+	}
+	log.Printf("END RequestId: %s", requestID)
+	log.Printf("REPORT RequestId: %s\tDuration: %.2f ms", requestID, float64(time.Since(start).Microseconds())/1000)
+	return out, failed
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda/messages"
+)
+
+func TestInvokeServer(t *testing.T) {
+	useRunDatabase(t)
+	setenv(t, "CLOUDQUERY_API_TOKENS", "token")
+	invoked := make(chan struct{}, 1)
+	registerTestTask(t, "test-echo", func(ctx context.Context, req interface{}, resp *Response) error {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("the invocation has no deadline")
+		}
+		resp.RunID = req.(*Request).RunID
+		return nil
+	})
+	registerTestTask(t, "test-async", func(ctx context.Context, req interface{}, resp *Response) error {
+		invoked <- struct{}{}
+		return nil
+	})
+	registerTestTask(t, "test-panic", func(ctx context.Context, req interface{}, resp *Response) error {
+		panic("nil map")
+	})
+	dispatchedRun(t, "run-panic")
+	server := httptest.NewServer(&invokeServer{functionName: "function", region: "us-east-1", timeout: time.Minute})
+	defer server.Close()
+
+	tests := []struct {
+		name          string
+		method        string
+		path          string
+		body          string
+		headers       map[string]string
+		wantStatus    int
+		wantErrorType string
+		wantBody      string
+	}{
+		{
+			name:       "invocation",
+			method:     http.MethodPost,
+			path:       "/2015-03-31/functions/function/invocations",
+			body:       `{"taskName": "test-echo", "runId": "run-1"}`,
+			wantStatus: http.StatusOK,
+			wantBody:   `"runId":"run-1"`,
+		},
+		{
+			name:       "any function name",
+			method:     http.MethodPost,
+			path:       "/2015-03-31/functions/cloudquery-worker/invocations",
+			body:       `{"taskName": "test-echo"}`,
+			wantStatus: http.StatusOK,
+			wantBody:   `"status":"succeeded"`,
+		},
+		{
+			name:          "unknown task",
+			method:        http.MethodPost,
+			path:          "/2015-03-31/functions/function/invocations",
+			body:          `{"taskName": "missing"}`,
+			wantStatus:    http.StatusOK,
+			wantErrorType: ErrorTypeUnknownTask,
+		},
+		{
+			name:          "empty payload",
+			method:        http.MethodPost,
+			path:          "/2015-03-31/functions/function/invocations",
+			wantStatus:    http.StatusOK,
+			wantErrorType: ErrorTypeUnknownTask,
+		},
+		{
+			name:          "panic",
+			method:        http.MethodPost,
+			path:          "/2015-03-31/functions/function/invocations",
+			body:          `{"taskName": "test-panic", "runId": "run-panic"}`,
+			wantStatus:    http.StatusOK,
+			wantErrorType: ErrorTypePanic,
+		},
+		{
+			name:       "asynchronous invocation",
+			method:     http.MethodPost,
+			path:       "/2015-03-31/functions/function/invocations",
+			body:       `{"taskName": "test-async"}`,
+			headers:    map[string]string{"X-Amz-Invocation-Type": "Event"},
+			wantStatus: http.StatusAccepted,
+		},
+		{
+			name:       "method not allowed",
+			method:     http.MethodGet,
+			path:       "/2015-03-31/functions/function/invocations",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "function url",
+			method:     http.MethodGet,
+			path:       "/runs/run-1",
+			headers:    map[string]string{"Authorization": "Bearer token"},
+			wantStatus: http.StatusOK,
+			wantBody:   `"runId":"run-1"`,
+		},
+		{
+			name:       "function url without a token",
+			method:     http.MethodGet,
+			path:       "/runs/run-1",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "function url without a route",
+			method:     http.MethodDelete,
+			path:       "/runs/run-1",
+			headers:    map[string]string{"Authorization": "Bearer token"},
+			wantStatus: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, server.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			body, err := ioutil.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != tt.wantStatus {
+				t.Fatalf("%s %s = %d %s, want %d", tt.method, tt.path, res.StatusCode, body, tt.wantStatus)
+			}
+			functionError := res.Header.Get("X-Amz-Function-Error")
+			if tt.wantErrorType != "" {
+				var invokeErr messages.InvokeResponse_Error
+				err = json.Unmarshal(body, &invokeErr)
+				if err != nil || functionError != "Unhandled" || invokeErr.Type != tt.wantErrorType {
+					t.Errorf("%s %s = %s %s, want an Unhandled %s function error", tt.method, tt.path, functionError, body, tt.wantErrorType)
+				}
+			} else if functionError != "" {
+				t.Errorf("%s %s = %s function error %s, want a response", tt.method, tt.path, functionError, body)
+			}
+			if !bytes.Contains(body, []byte(tt.wantBody)) {
+				t.Errorf("%s %s = %s, want %s", tt.method, tt.path, body, tt.wantBody)
+			}
+		})
+	}
+
+	select {
+	case <-invoked:
+	case <-time.After(5 * time.Second):
+		t.Error("the asynchronous invocation didn't run the task")
+	}
+	if run := readRun(t, "run-panic"); run.Status != StatusFailed {
+		t.Errorf("run of the panicking task = %q, want %q", run.Status, StatusFailed)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	awsprovider "github.com/cloudquery/cloudquery/providers/aws"
+	"github.com/mitchellh/mapstructure"
+)
+
+// Shard narrows a fetch to a single provider and, for aws, a single account, region and
+// group of resources. Resources of global aws services are planned once per account.
+type Shard struct {
+	Provider  string   `json:"provider"`
+	Account   string   `json:"account,omitempty"`
+	Region    string   `json:"region,omitempty"`
+	Resources []string `json:"resources,omitempty"`
+}
+
+func (s Shard) String() string {
+	parts := []string{s.Provider}
+	if s.Account != "" {
+		parts = append(parts, s.Account)
+	}
+	if s.Region != "" {
+		parts = append(parts, s.Region)
+	}
+	return fmt.Sprintf("%s[%s]", strings.Join(parts, "/"), strings.Join(s.Resources, ","))
+}
+
+// Parses a shard in the format of String, e.g. aws/123456789012/us-east-1[ec2.instances,ec2.vpcs].
+// The resources are optional.
+func parseShard(value string) (*Shard, error) {
+	shard := Shard{}
+	path := value
+	if i := strings.Index(value, "["); i >= 0 {
+		if !strings.HasSuffix(value, "]") {
+			return nil, fmt.Errorf("shard %s should be in format provider/account/region[resource,...]", value)
+		}
+		path = value[:i]
+		if resources := value[i+1 : len(value)-1]; resources != "" {
+			shard.Resources = strings.Split(resources, ",")
+		}
+	}
+	parts := strings.Split(path, "/")
+	if len(parts) > 3 || parts[0] == "" {
+		return nil, fmt.Errorf("shard %s should be in format provider/account/region[resource,...]", value)
+	}
+	shard.Provider = parts[0]
+	if len(parts) > 1 {
+		shard.Account = parts[1]
+	}
+	if len(parts) > 2 {
+		shard.Region = parts[2]
+	}
+	return &shard, nil
+}
+
+// Expands a config into shards. aws providers are split by account, region and service,
+// every other provider becomes a single shard.
+func planShards(config *Config) ([]Shard, error) {
+	var shards []Shard
+	for _, provider := range config.Providers {
+		if provider.Name != "aws" {
+			shards = append(shards, Shard{
+				Provider:  provider.Name,
+				Resources: configuredResources(provider.Rest),
+			})
+			continue
+		}
+		awsShards, err := planAWSShards(provider.Rest)
+		if err != nil {
+			return nil, err
+		}
+		shards = append(shards, awsShards...)
+	}
+	return shards, nil
+}
+
+func planAWSShards(rest map[string]interface{}) ([]Shard, error) {
+	var config awsprovider.Config
+	err := mapstructure.Decode(rest, &config)
+	if err != nil {
+		return nil, err
+	}
+	regions := config.Regions
+	if len(regions) == 0 {
+		regions = awsRegions()
+		sort.Strings(regions)
+	}
+	accounts := []string{"default"}
+	if len(config.Accounts) > 0 {
+		accounts = accounts[:0]
+		for _, account := range config.Accounts {
+			accounts = append(accounts, account.ID)
+		}
+	}
+
+	// group resources by service, keeping the order of the config
+	var globalResources []string
+	var services []string
+	regionalResources := map[string][]string{}
+	for _, resource := range config.Resources {
+		service := strings.Split(resource.Name, ".")[0]
+		if awsServices[service].global {
+			globalResources = append(globalResources, resource.Name)
+			continue
+		}
+		if regionalResources[service] == nil {
+			services = append(services, service)
+		}
+		regionalResources[service] = append(regionalResources[service], resource.Name)
+	}
+
+	var shards []Shard
+	for _, account := range accounts {
+		if len(globalResources) > 0 {
+			shards = append(shards, Shard{
+				Provider:  "aws",
+				Account:   account,
+				Region:    globalRegion(config.Regions),
+				Resources: globalResources,
+			})
+		}
+		for _, region := range regions {
+			for _, service := range services {
+				shards = append(shards, Shard{
+					Provider:  "aws",
+					Account:   account,
+					Region:    region,
+					Resources: regionalResources[service],
+				})
+			}
+		}
+	}
+	return shards, nil
+}
+
+// Region the global services are fetched from when no regions are configured. Unlike the
+// opt-in regions that sort before it, it is enabled in every account.
+const awsGlobalRegion = "us-east-1"
+
+// Returns the region of the shard with the global resources of an account: us-east-1 unless
+// the configured regions leave it out, then the first configured one
+func globalRegion(configured []string) string {
+	for _, region := range configured {
+		if region == awsGlobalRegion {
+			return region
+		}
+	}
+	if len(configured) > 0 {
+		return configured[0]
+	}
+	return awsGlobalRegion
+}
+
+// Returns a copy of the config that only contains the provider, account, region and
+// resources of the shard
+func narrowConfig(config *Config, shard *Shard) (*Config, error) {
+	for _, provider := range config.Providers {
+		if provider.Name != shard.Provider {
+			continue
+		}
+		rest := make(map[string]interface{}, len(provider.Rest))
+		for k, v := range provider.Rest {
+			rest[k] = v
+		}
+		if len(shard.Resources) > 0 {
+			rest["resources"] = filterResources(provider.Rest, shard.Resources)
+		}
+		if provider.Name == "aws" {
+			err := narrowAWSConfig(rest, shard)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return &Config{Providers: []ProviderConfig{{Name: provider.Name, Rest: rest}}}, nil
+	}
+	return nil, fmt.Errorf("shard provider %s is not in the config", shard.Provider)
+}
+
+func narrowAWSConfig(rest map[string]interface{}, shard *Shard) error {
+	if shard.Region != "" {
+		rest["regions"] = []interface{}{shard.Region}
+	}
+	if shard.Account == "" {
+		return nil
+	}
+	if shard.Account == "default" {
+		delete(rest, "accounts")
+		return nil
+	}
+	accounts, _ := rest["accounts"].([]interface{})
+	for _, item := range accounts {
+		account, ok := item.(map[string]interface{})
+		if ok && fmt.Sprintf("%v", account["id"]) == shard.Account {
+			rest["accounts"] = []interface{}{account}
+			return nil
+		}
+	}
+	return fmt.Errorf("shard account %s is not in the aws config", shard.Account)
+}
+
+// Returns the entries of the resources list whose name is in names
+func filterResources(rest map[string]interface{}, names []string) []interface{} {
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+	list, _ := rest["resources"].([]interface{})
+	filtered := make([]interface{}, 0, len(names))
+	for _, item := range list {
+		resource, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if name, ok := resource["name"].(string); ok && wanted[name] {
+			filtered = append(filtered, resource)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseShard(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    *Shard
+		wantErr bool
+	}{
+		{value: "gcp", want: &Shard{Provider: "gcp"}},
+		{value: "okta[okta.users]", want: &Shard{Provider: "okta", Resources: []string{"okta.users"}}},
+		{value: "aws/123456789012", want: &Shard{Provider: "aws", Account: "123456789012"}},
+		{
+			value: "aws/123456789012/us-east-1[ec2.instances,ec2.vpcs]",
+			want:  &Shard{Provider: "aws", Account: "123456789012", Region: "us-east-1", Resources: []string{"ec2.instances", "ec2.vpcs"}},
+		},
+		{value: "aws/default/us-east-1[]", want: &Shard{Provider: "aws", Account: "default", Region: "us-east-1"}},
+		{value: "", wantErr: true},
+		{value: "/123456789012", wantErr: true},
+		{value: "aws/1/us-east-1/extra", wantErr: true},
+		{value: "aws[ec2.instances", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseShard(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseShard() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseShard() = %+v, want %+v", got, tt.want)
+			}
+			if got != nil {
+				again, err := parseShard(got.String())
+				if err != nil || !reflect.DeepEqual(again, got) {
+					t.Errorf("parseShard(%q) = %+v, %v, want %+v", got.String(), again, err, got)
+				}
+			}
+		})
+	}
+}
+
+func resourceList(names ...string) []interface{} {
+	list := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		list = append(list, map[string]interface{}{"name": name})
+	}
+	return list
+}
+
+func TestPlanAWSShards(t *testing.T) {
+	tests := []struct {
+		name string
+		rest map[string]interface{}
+		want []Shard
+	}{
+		{
+			name: "regional services are split by region",
+			rest: map[string]interface{}{
+				"regions":   []interface{}{"us-east-1", "eu-west-1"},
+				"resources": resourceList("ec2.instances", "kms.keys", "ec2.vpcs"),
+			},
+			want: []Shard{
+				{Provider: "aws", Account: "default", Region: "us-east-1", Resources: []string{"ec2.instances", "ec2.vpcs"}},
+				{Provider: "aws", Account: "default", Region: "us-east-1", Resources: []string{"kms.keys"}},
+				{Provider: "aws", Account: "default", Region: "eu-west-1", Resources: []string{"ec2.instances", "ec2.vpcs"}},
+				{Provider: "aws", Account: "default", Region: "eu-west-1", Resources: []string{"kms.keys"}},
+			},
+		},
+		{
+			name: "global services once per account",
+			rest: map[string]interface{}{
+				"regions": []interface{}{"us-east-1", "eu-west-1"},
+				"accounts": []interface{}{
+					map[string]interface{}{"id": "111111111111", "role_arn": "arn:aws:iam::111111111111:role/cq"},
+					map[string]interface{}{"id": "222222222222", "role_arn": "arn:aws:iam::222222222222:role/cq"},
+				},
+				"resources": resourceList("iam.users", "s3.buckets"),
+			},
+			want: []Shard{
+				{Provider: "aws", Account: "111111111111", Region: "us-east-1", Resources: []string{"iam.users", "s3.buckets"}},
+				{Provider: "aws", Account: "222222222222", Region: "us-east-1", Resources: []string{"iam.users", "s3.buckets"}},
+			},
+		},
+		{
+			name: "global services prefer us-east-1 among the configured regions",
+			rest: map[string]interface{}{
+				"regions":   []interface{}{"eu-west-1", "us-east-1"},
+				"resources": resourceList("iam.users"),
+			},
+			want: []Shard{
+				{Provider: "aws", Account: "default", Region: "us-east-1", Resources: []string{"iam.users"}},
+			},
+		},
+		{
+			name: "global services without us-east-1 in the first configured region",
+			rest: map[string]interface{}{
+				"regions":   []interface{}{"eu-west-1", "eu-central-1"},
+				"resources": resourceList("iam.users"),
+			},
+			want: []Shard{
+				{Provider: "aws", Account: "default", Region: "eu-west-1", Resources: []string{"iam.users"}},
+			},
+		},
+		{
+			name: "global services without configured regions in us-east-1",
+			rest: map[string]interface{}{"resources": resourceList("iam.users", "s3.buckets")},
+			want: []Shard{
+				{Provider: "aws", Account: "default", Region: "us-east-1", Resources: []string{"iam.users", "s3.buckets"}},
+			},
+		},
+		{
+			name: "no resources",
+			rest: map[string]interface{}{"regions": []interface{}{"us-east-1"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := planAWSShards(tt.rest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("planAWSShards() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	shards, err := planAWSShards(map[string]interface{}{"resources": resourceList("ec2.instances")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if regions := awsRegions(); len(shards) != len(regions) {
+		t.Errorf("planAWSShards() without regions = %d shards, want one for each of the %d regions", len(shards), len(regions))
+	}
+}
+
+func TestNarrowConfig(t *testing.T) {
+	account := map[string]interface{}{"id": "111111111111", "role_arn": "arn:aws:iam::111111111111:role/cq"}
+	config := &Config{Providers: []ProviderConfig{
+		{Name: "aws", Rest: map[string]interface{}{
+			"regions":     []interface{}{"us-east-1", "eu-west-1"},
+			"accounts":    []interface{}{account, map[string]interface{}{"id": "222222222222"}},
+			"max_retries": 5,
+			"resources":   resourceList("ec2.instances", "ec2.vpcs", "iam.users"),
+		}},
+		{Name: "okta", Rest: map[string]interface{}{"domain": "https://example.okta.com", "resources": resourceList("okta.users")}},
+	}}
+	tests := []struct {
+		name    string
+		shard   Shard
+		want    *Config
+		wantErr bool
+	}{
+		{
+			name:  "aws account and region",
+			shard: Shard{Provider: "aws", Account: "111111111111", Region: "eu-west-1", Resources: []string{"ec2.vpcs"}},
+			want: &Config{Providers: []ProviderConfig{{Name: "aws", Rest: map[string]interface{}{
+				"regions":     []interface{}{"eu-west-1"},
+				"accounts":    []interface{}{account},
+				"max_retries": 5,
+				"resources":   resourceList("ec2.vpcs"),
+			}}}},
+		},
+		{
+			name:  "aws default account",
+			shard: Shard{Provider: "aws", Account: "default", Region: "us-east-1", Resources: []string{"iam.users"}},
+			want: &Config{Providers: []ProviderConfig{{Name: "aws", Rest: map[string]interface{}{
+				"regions":     []interface{}{"us-east-1"},
+				"max_retries": 5,
+				"resources":   resourceList("iam.users"),
+			}}}},
+		},
+		{
+			name:  "other provider",
+			shard: Shard{Provider: "okta"},
+			want:  &Config{Providers: []ProviderConfig{config.Providers[1]}},
+		},
+		{name: "unknown account", shard: Shard{Provider: "aws", Account: "333333333333"}, wantErr: true},
+		{name: "unknown provider", shard: Shard{Provider: "gcp"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := narrowConfig(config, &tt.shard)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("narrowConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("narrowConfig() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+	if regions := config.Providers[0].Rest["regions"].([]interface{}); len(regions) != 2 {
+		t.Errorf("narrowConfig() modified the config")
+	}
+}
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// Fetches keep the rows of earlier fetches. Every row of a provider table is stamped with the
+// fetch that wrote it, the delete a collector runs before inserting is recorded as the scope the
+// fetch replaces, and when the fetch finishes the rows of those scopes written by earlier fetches
+// are marked as superseded by it. The <table>_latest views only show rows of finished fetches
+// that weren't superseded, so readers never see a table in the middle of a fetch.
+
+// Number of snapshots kept of every scope. Set by CLOUDQUERY_SNAPSHOT_RETENTION.
+const defaultSnapshotRetention = 2
+
+// Postgres truncates longer identifiers
+const maxIdentifierLength = 63
+
+// FetchRecord is a fetch of the provider tables. Its ID is the run ID of the fetch.
+type FetchRecord struct {
+	ID string `gorm:"primaryKey"`
+	// The shard of the fetch, empty for a fetch of the whole config
+	Shard string `gorm:"index"`
+	// The providers of the fetch, comma separated
+	Providers  string
+	Status     string
+	StartedAt  time.Time
+	FinishedAt *time.Time
+	// When the rows of the fetch that fell out of the retention were removed
+	PrunedAt *time.Time
+	// When the diff task published the changes of the fetch
+	DiffedAt *time.Time
+}
+
+func (FetchRecord) TableName() string {
+	return "cloudquery_fetches"
+}
+
+// FetchScope is a part of a table a fetch replaces, e.g. the rows of an account and region.
+// Condition is the WHERE clause of the delete the collector ran, with ? placeholders.
+type FetchScope struct {
+	ID         uint   `gorm:"primarykey"`
+	FetchID    string `gorm:"index"`
+	ScopeTable string
+	Condition  string
+	// The arguments of Condition as JSON
+	Vars string
+}
+
+func (FetchScope) TableName() string {
+	return "cloudquery_fetch_scopes"
+}
+
+// snapshotColumns are added to every provider table with a primary key
+type snapshotColumns struct {
+	FetchID      *string `gorm:"size:64"`
+	FetchedAt    *time.Time
+	SupersededBy *string `gorm:"size:64"`
+}
+
+func snapshotRetention() int {
+	if n := envInt("CLOUDQUERY_SNAPSHOT_RETENTION", defaultSnapshotRetention); n > 0 {
+		return n
+	}
+	return defaultSnapshotRetention
+}
+
+type fetchRunKey struct{}
+
+// Returns a session whose creates and deletes of snapshot tables are versioned by the run
+func (r *fetchRun) snapshotDB(db *gorm.DB) *gorm.DB {
+	return db.WithContext(context.WithValue(context.Background(), fetchRunKey{}, r))
+}
+
+func fetchRunOf(db *gorm.DB) *fetchRun {
+	if db.Statement.Context == nil {
+		return nil
+	}
+	run, _ := db.Statement.Context.Value(fetchRunKey{}).(*fetchRun)
+	return run
+}
+
+// The callbacks only act on sessions returned by snapshotDB
+func registerSnapshotCallbacks(db *gorm.DB) error {
+	err := db.Callback().Create().After("gorm:create").Register("cloudquery:stamp_snapshot", stampSnapshot)
+	if err != nil {
+		return err
+	}
+	deleteRows := db.Callback().Delete().Get("gorm:delete")
+	return db.Callback().Delete().Replace("gorm:delete", func(tx *gorm.DB) {
+		if !recordSnapshotScope(tx) {
+			deleteRows(tx)
+		}
+	})
+}
+
+// Stamps the created rows with the fetch that created them, and keeps their keys when the run is
+// exported
+func stampSnapshot(db *gorm.DB) {
+	run := fetchRunOf(db)
+	stmt := db.Statement
+	if run == nil || db.Error != nil || db.RowsAffected == 0 || stmt.Schema == nil || !run.isSnapshotTable(stmt.Table) {
+		return
+	}
+	_, keys := schema.GetIdentityFieldValuesMap(stmt.ReflectValue, stmt.Schema.PrimaryFields)
+	if len(keys) == 0 {
+		return
+	}
+	column, values := schema.ToQueryValues(stmt.Table, stmt.Schema.PrimaryFieldDBNames, keys)
+	err := db.Session(&gorm.Session{NewDB: true}).Table(stmt.Table).
+		Where(clause.IN{Column: column, Values: values}).
+		UpdateColumns(map[string]interface{}{"fetch_id": run.id, "fetched_at": time.Now().UTC()}).Error
+	if err == nil && run.export != nil && len(stmt.Schema.PrimaryFieldDBNames) == 1 {
+		run.lock.Lock()
+		run.written[stmt.Table] = append(run.written[stmt.Table], values...)
+		run.lock.Unlock()
+	}
+	db.AddError(err)
+}
+
+// Records the scope of a delete of a snapshot table instead of running it, along with the
+// scopes of its child tables. Reports false for deletes that should run.
+func recordSnapshotScope(db *gorm.DB) bool {
+	run := fetchRunOf(db)
+	stmt := db.Statement
+	if run == nil || db.Error != nil || stmt.Schema == nil || !run.isSnapshotTable(stmt.Table) {
+		return false
+	}
+	where, ok := stmt.Clauses["WHERE"].Expression.(clause.Where)
+	if !ok || len(where.Exprs) == 0 {
+		return false
+	}
+	var conditions []string
+	var vars []interface{}
+	for _, expr := range where.Exprs {
+		e, ok := expr.(clause.Expr)
+		if !ok {
+			return false
+		}
+		conditions = append(conditions, "("+e.SQL+")")
+		vars = append(vars, e.Vars...)
+	}
+	encoded, err := json.Marshal(vars)
+	if err != nil {
+		db.AddError(err)
+		return true
+	}
+	run.addScope(stmt, stmt.Schema, stmt.Table, strings.Join(conditions, " AND "), string(encoded), map[string]bool{})
+	return true
+}
+
+// Adds the scope of a table and, through its has-one and has-many relations, the rows of its
+// child tables that belong to the rows in scope
+func (r *fetchRun) addScope(stmt *gorm.Statement, s *schema.Schema, table, condition, vars string, seen map[string]bool) {
+	r.lock.Lock()
+	duplicate := false
+	for _, scope := range r.scopes[table] {
+		if scope.Condition == condition && scope.Vars == vars {
+			duplicate = true
+		}
+	}
+	if !duplicate {
+		r.scopes[table] = append(r.scopes[table], FetchScope{FetchID: r.id, ScopeTable: table, Condition: condition, Vars: vars})
+	}
+	r.lock.Unlock()
+
+	seen[table] = true
+	for _, rel := range s.Relationships.Relations {
+		child := rel.FieldSchema.Table
+		if (rel.Type != schema.HasOne && rel.Type != schema.HasMany) || seen[child] || !r.isSnapshotTable(child) {
+			continue
+		}
+		var foreignKeys, primaryKeys []string
+		for _, ref := range rel.References {
+			if ref.OwnPrimaryKey {
+				foreignKeys = append(foreignKeys, ref.ForeignKey.DBName)
+				primaryKeys = append(primaryKeys, ref.PrimaryKey.DBName)
+			}
+		}
+		if len(foreignKeys) != 1 {
+			continue
+		}
+		childCondition := fmt.Sprintf("%s IN (SELECT %s FROM %s WHERE %s)",
+			stmt.Quote(clause.Column{Name: foreignKeys[0]}), stmt.Quote(clause.Column{Name: primaryKeys[0]}),
+			stmt.Quote(clause.Table{Name: table}), condition)
+		r.addScope(stmt, rel.FieldSchema, child, childCondition, vars, seen)
+	}
+	delete(seen, table)
+}
+
+// Marks the tables of a provider as versioned by the run
+func (r *fetchRun) addSnapshotTables(provider string) error {
+	tables, err := providerSnapshotTables(provider)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, table := range tables {
+		r.tables[table] = true
+	}
+	return nil
+}
+
+func (r *fetchRun) isSnapshotTable(table string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.tables[table]
+}
+
+// Removes the recorded scopes and written keys of the tables of a unit. A unit without a resource
+// stands for every resource of its provider.
+func (r *fetchRun) takeScopes(unit fetchUnit) ([]FetchScope, map[string][]interface{}) {
+	var tables []string
+	var err error
+	if unit.Resource == "" {
+		tables, err = providerSnapshotTables(unit.Provider)
+	} else {
+		tables, err = snapshotTables(unit.Provider, unit.Resource)
+	}
+	if err != nil {
+		r.log.Error("Unable to find the tables of a resource", zap.String("provider", unit.Provider),
+			zap.String("resource", unit.Resource), zap.Error(err))
+		return nil, nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var scopes []FetchScope
+	written := map[string][]interface{}{}
+	for _, table := range tables {
+		scopes = append(scopes, r.scopes[table]...)
+		delete(r.scopes, table)
+		if keys := r.written[table]; len(keys) > 0 {
+			written[table] = keys
+			delete(r.written, table)
+		}
+	}
+	return scopes, written
+}
+
+// Stores the scopes a finished unit fetched, so they are superseded when the fetch finishes, and
+// exports the rows it wrote
+func (r *fetchRun) commitScopes(unit fetchUnit) {
+	if r == nil {
+		return
+	}
+	scopes, written := r.takeScopes(unit)
+	if len(scopes) > 0 {
+		err := r.db.Create(&scopes).Error
+		if err != nil {
+			r.log.Error("Unable to record the scopes of a snapshot", zap.String("run_id", r.id), zap.Error(err))
+		}
+	}
+	if r.export != nil && len(written) > 0 {
+		err := r.export.exportRows(r.db, r.id, written)
+		if err != nil {
+			r.log.Error("Unable to export the rows of a resource", zap.String("run_id", r.id), zap.Error(err))
+			r.export.fail(err)
+		}
+	}
+}
+
+// Removes the rows a failed unit wrote, so the scopes it didn't finish keep their earlier rows
+func (r *fetchRun) discardScopes(unit fetchUnit) {
+	if r == nil {
+		return
+	}
+	scopes, _ := r.takeScopes(unit)
+	// the condition of a child table contains the condition of its parent, so children go first
+	sort.SliceStable(scopes, func(i, j int) bool {
+		return len(scopes[i].Condition) > len(scopes[j].Condition)
+	})
+	for _, scope := range scopes {
+		vars, err := scope.args()
+		if err == nil {
+			args := append([]interface{}{clause.Table{Name: scope.ScopeTable}}, vars...)
+			err = r.db.Exec("DELETE FROM ? WHERE "+scope.Condition+" AND fetch_id = ?", append(args, r.id)...).Error
+		}
+		if err != nil {
+			r.log.Error("Unable to remove the rows of a failed resource", zap.String("run_id", r.id),
+				zap.String("table", scope.ScopeTable), zap.Error(err))
+		}
+	}
+}
+
+func (s FetchScope) args() ([]interface{}, error) {
+	var vars []interface{}
+	err := json.Unmarshal([]byte(s.Vars), &vars)
+	return vars, err
+}
+
+// Records the start of the fetch. A resumed fetch keeps its record.
+func (r *fetchRun) start(shard *Shard, providers []string) error {
+	record := FetchRecord{
+		ID:        r.id,
+		Providers: strings.Join(providers, ","),
+		Status:    StatusRunning,
+		StartedAt: time.Now().UTC(),
+	}
+	if shard != nil {
+		record.Shard = shard.String()
+	}
+	return r.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&record).Error
+}
+
+// Publishes the snapshot of a finished fetch: in one transaction the rows of the scopes it
+// fetched are superseded by its own and the fetch is marked as finished. The snapshots beyond
+// the retention are removed afterwards.
+func (r *fetchRun) finish(status string) error {
+	var scopes []FetchScope
+	err := r.db.Where("fetch_id = ?", r.id).Find(&scopes).Error
+	if err != nil {
+		return err
+	}
+	err = r.db.Transaction(func(tx *gorm.DB) error {
+		for _, scope := range scopes {
+			vars, err := scope.args()
+			if err != nil {
+				return err
+			}
+			args := append([]interface{}{clause.Table{Name: scope.ScopeTable}, r.id}, vars...)
+			err = tx.Exec("UPDATE ? SET superseded_by = ? WHERE "+scope.Condition+
+				" AND superseded_by IS NULL AND (fetch_id IS NULL OR fetch_id <> ?)", append(args, r.id)...).Error
+			if err != nil {
+				return fmt.Errorf("table %s: %w", scope.ScopeTable, err)
+			}
+		}
+		return tx.Model(&FetchRecord{}).Where("id = ?", r.id).
+			Updates(map[string]interface{}{"status": status, "finished_at": time.Now().UTC()}).Error
+	})
+	if err != nil {
+		return err
+	}
+	err = pruneSnapshots(r.db)
+	if err != nil {
+		r.log.Error("Unable to remove old snapshots", zap.Error(err))
+	}
+	return nil
+}
+
+// Removes the rows superseded by fetches that fell out of the retention of their shard, and the
+// rows of fetches that were abandoned before they finished
+func pruneSnapshots(db *gorm.DB) error {
+	retention := snapshotRetention()
+	var finished []FetchRecord
+	err := db.Where("finished_at IS NOT NULL AND pruned_at IS NULL").Order("finished_at DESC").Find(&finished).Error
+	if err != nil {
+		return err
+	}
+	// the rows a fetch superseded belong to the snapshot before it, so the newest
+	// retention - 1 fetches of a shard keep theirs
+	kept := map[string]int{}
+	for _, fetch := range finished {
+		kept[fetch.Shard]++
+		if kept[fetch.Shard] < retention {
+			continue
+		}
+		var scopeTables []string
+		err = db.Model(&FetchScope{}).Where("fetch_id = ?", fetch.ID).Pluck("scope_table", &scopeTables).Error
+		if err != nil {
+			return err
+		}
+		var tables []string
+		pruned := map[string]bool{}
+		for _, table := range scopeTables {
+			if !pruned[table] {
+				pruned[table] = true
+				tables = append(tables, table)
+			}
+		}
+		err = pruneFetch(db, fetch.ID, tables, "superseded_by")
+		if err != nil {
+			return err
+		}
+	}
+
+	var abandoned []FetchRecord
+	err = db.Where("finished_at IS NULL AND pruned_at IS NULL AND started_at < ?", time.Now().UTC().Add(-checkpointRetention)).
+		Find(&abandoned).Error
+	if err != nil {
+		return err
+	}
+	for _, fetch := range abandoned {
+		var tables []string
+		for _, provider := range strings.Split(fetch.Providers, ",") {
+			if resourceRegistry[provider] == nil {
+				continue
+			}
+			providerTables, err := providerSnapshotTables(provider)
+			if err != nil {
+				return err
+			}
+			for _, table := range providerTables {
+				if db.Migrator().HasTable(table) {
+					tables = append(tables, table)
+				}
+			}
+		}
+		err = pruneFetch(db, fetch.ID, tables, "fetch_id")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes the rows of the tables whose column is the fetch, then its scopes
+func pruneFetch(db *gorm.DB, id string, tables []string, column string) error {
+	for _, table := range tables {
+		err := db.Exec("DELETE FROM ? WHERE ? = ?", clause.Table{Name: table}, clause.Column{Name: column}, id).Error
+		if err != nil {
+			return fmt.Errorf("table %s: %w", table, err)
+		}
+	}
+	err := db.Where("fetch_id = ?", id).Delete(&FetchScope{}).Error
+	if err != nil {
+		return err
+	}
+	return db.Model(&FetchRecord{}).Where("id = ?", id).Update("pruned_at", time.Now().UTC()).Error
+}
+
+// Adds the snapshot columns, their indexes and the latest view to every versioned table of a
+// provider. The views are created again on every migration, as they select every column.
+func migrateSnapshotTables(db *gorm.DB, provider string) error {
+	tables, err := providerSnapshotTables(provider)
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		migrator := db.Table(table).Migrator()
+		for _, field := range []string{"FetchID", "FetchedAt", "SupersededBy"} {
+			if !migrator.HasColumn(&snapshotColumns{}, field) {
+				err = migrator.AddColumn(&snapshotColumns{}, field)
+				if err != nil {
+					return fmt.Errorf("table %s: %w", table, err)
+				}
+			}
+		}
+		for _, column := range []string{"fetch_id", "superseded_by"} {
+			index := identifier("idx_" + table + "_" + column)
+			if !migrator.HasIndex(&snapshotColumns{}, index) {
+				err = db.Exec("CREATE INDEX ? ON ? (?)", clause.Column{Name: index}, clause.Table{Name: table}, clause.Column{Name: column}).Error
+				if err != nil {
+					return fmt.Errorf("table %s: %w", table, err)
+				}
+			}
+		}
+		view := clause.Table{Name: latestView(table)}
+		err = db.Exec("DROP VIEW IF EXISTS ?", view).Error
+		if err == nil {
+			err = db.Exec("CREATE VIEW ? AS SELECT * FROM ? WHERE superseded_by IS NULL AND fetch_id IN "+
+				"(SELECT id FROM cloudquery_fetches WHERE finished_at IS NOT NULL)", view, clause.Table{Name: table}).Error
+		}
+		if err != nil {
+			return fmt.Errorf("view of table %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// Name of the view of the latest snapshot of a table
+func latestView(table string) string {
+	return identifier(table + "_latest")
+}
+
+// Runs fn in a read-only transaction that sees one snapshot of the database, so a fetch publishing
+// in the meantime either shows in every query of fn or in none. sqlite holds its read lock until
+// the transaction ends, which has the same effect.
+func snapshotTransaction(db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	var opts []*sql.TxOptions
+	// the Data API doesn't take transaction options, but Aurora MySQL is REPEATABLE READ by default
+	if db.Dialector.Name() == "mysql" && !isDataAPI(db) {
+		opts = append(opts, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if tx.Dialector.Name() == "postgres" {
+			// also applies over the Data API
+			err := tx.Exec("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ, READ ONLY").Error
+			if err != nil {
+				return err
+			}
+		}
+		return fn(tx)
+	}, opts...)
+}
+
+// Shortens a derived name to the length postgres allows, keeping it unique with a hash
+func identifier(name string) string {
+	if len(name) <= maxIdentifierLength {
+		return name
+	}
+	sum := fnv.New32a()
+	_, _ = sum.Write([]byte(name))
+	return fmt.Sprintf("%s_%08x", name[:maxIdentifierLength-9], sum.Sum32())
+}
+
+var (
+	resourceTableCache = map[string][]CatalogTable{}
+	resourceTableLock  sync.Mutex
+)
+
+// Returns the catalog tables of a resource, see resourceTables. They are looked up once per process.
+func cachedResourceTables(provider, resource string) ([]CatalogTable, error) {
+	key := provider + "/" + resource
+	resourceTableLock.Lock()
+	defer resourceTableLock.Unlock()
+	if tables, ok := resourceTableCache[key]; ok {
+		return tables, nil
+	}
+	migrate := resourceRegistry[provider][resource]
+	if migrate == nil {
+		return nil, fmt.Errorf("%s resource %s is not supported", provider, resource)
+	}
+	tables, err := resourceTables(migrate)
+	if err != nil {
+		return nil, err
+	}
+	resourceTableCache[key] = tables
+	return tables, nil
+}
+
+// Returns the versioned tables of a resource: the tables of its catalog entry with a primary key.
+// Tables without one, like azure_resources_group_tags, only follow the rows they reference.
+func snapshotTables(provider, resource string) ([]string, error) {
+	catalogTables, err := cachedResourceTables(provider, resource)
+	if err != nil {
+		return nil, err
+	}
+	tables := []string{}
+	for _, table := range catalogTables {
+		if table.versioned() {
+			tables = append(tables, table.Name)
+		}
+	}
+	return tables, nil
+}
+
+func (t CatalogTable) versioned() bool {
+	for _, column := range t.Columns {
+		if column.PrimaryKey {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the versioned tables of every provider
+func versionedTables() (map[string]bool, error) {
+	tables := map[string]bool{}
+	for provider := range resourceRegistry {
+		providerTables, err := providerSnapshotTables(provider)
+		if err != nil {
+			return nil, err
+		}
+		for _, table := range providerTables {
+			tables[table] = true
+		}
+	}
+	return tables, nil
+}
+
+func providerSnapshotTables(provider string) ([]string, error) {
+	var tables []string
+	for _, resource := range supportedResources(provider) {
+		resourceTables, err := snapshotTables(provider, resource)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, resourceTables...)
+	}
+	sort.Strings(tables)
+	return tables, nil
+}
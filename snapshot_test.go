@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/cloudquery/cloudquery/providers/aws/ec2"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// Creates the tables of aws ec2.instances with their snapshot columns
+func migrateTestInstances(t *testing.T, db *gorm.DB) {
+	err := ec2.MigrateInstances(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables, err := snapshotTables("aws", "ec2.instances")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range tables {
+		migrator := db.Table(table).Migrator()
+		for _, field := range []string{"FetchID", "FetchedAt", "SupersededBy"} {
+			err = migrator.AddColumn(&snapshotColumns{}, field)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// Returns instances tagged with their ID
+func testInstances(ids ...string) []ec2.Instance {
+	var instances []ec2.Instance
+	for _, id := range ids {
+		instances = append(instances, ec2.Instance{
+			InstanceId: aws.String(id),
+			Tags:       []*ec2.InstanceTag{{Key: aws.String("Name"), Value: aws.String(id)}},
+		})
+	}
+	return instances
+}
+
+// Runs the ec2.instances unit of a shard the way its collector does, replacing the instances of
+// the account and region. The fetch is left running unless finish is set.
+func fetchTestInstances(t *testing.T, db *gorm.DB, id string, shard *Shard, finish bool, instances ...ec2.Instance) *fetchRun {
+	run, err := newFetchRun(context.Background(), db, zap.NewNop(), id, "", shard, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = run.start(shard, []string{"aws"})
+	if err == nil {
+		err = run.addSnapshotTables("aws")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := run.snapshotDB(db)
+	err = session.Where("region = ?", shard.Region).Where("account_id = ?", shard.Account).Delete(&ec2.Instance{}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, instance := range instances {
+		instance.AccountID, instance.Region = shard.Account, shard.Region
+		err = session.Create(&instance).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	run.commitScopes(fetchUnit{Provider: "aws", Account: shard.Account, Region: shard.Region, Resource: "ec2.instances"})
+	if finish {
+		err = run.finish(StatusSucceeded)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return run
+}
+
+// Returns the number of rows of a table per fetch
+func countByFetch(t *testing.T, db *gorm.DB, table string) map[string]int {
+	var rows []struct {
+		FetchID string
+		Count   int
+	}
+	err := db.Table(table).Select("fetch_id, COUNT(*) AS count").Group("fetch_id").Scan(&rows).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int{}
+	for _, row := range rows {
+		counts[row.FetchID] = row.Count
+	}
+	return counts
+}
+
+func readFetch(t *testing.T, db *gorm.DB, id string) FetchRecord {
+	var fetch FetchRecord
+	err := db.Where("id = ?", id).Take(&fetch).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fetch
+}
+
+// With a retention of 2 the third fetch of a shard removes the rows the second one superseded,
+// while the fetches of another shard count on their own
+func TestPruneSnapshotsRetention(t *testing.T) {
+	setenv(t, "CLOUDQUERY_SNAPSHOT_RETENTION", "2")
+	db := openTestDB(t)
+	migrateTestInstances(t, db)
+	shard := &Shard{Provider: "aws", Account: "111111111111", Region: "us-east-1"}
+	other := &Shard{Provider: "aws", Account: "111111111111", Region: "eu-west-1"}
+
+	fetchTestInstances(t, db, "other-1", other, true, testInstances("i-9")...)
+	fetchTestInstances(t, db, "fetch-1", shard, true, testInstances("i-1", "i-2")...)
+	fetchTestInstances(t, db, "fetch-2", shard, true, testInstances("i-1", "i-3")...)
+	want := map[string]int{"other-1": 1, "fetch-1": 2, "fetch-2": 2}
+	for _, table := range []string{"aws_ec2_instances", "aws_ec2_instance_tags"} {
+		if got := countByFetch(t, db, table); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s rows after two fetches = %v, want %v", table, got, want)
+		}
+	}
+
+	fetchTestInstances(t, db, "other-2", other, true, testInstances("i-9")...)
+	fetchTestInstances(t, db, "fetch-3", shard, true, testInstances("i-1")...)
+	// fetch-2 superseded the rows of fetch-1, which are the third snapshot of the shard now
+	want = map[string]int{"other-1": 1, "other-2": 1, "fetch-2": 2, "fetch-3": 1}
+	for _, table := range []string{"aws_ec2_instances", "aws_ec2_instance_tags"} {
+		if got := countByFetch(t, db, table); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s rows after three fetches = %v, want %v", table, got, want)
+		}
+	}
+	for id, wantPruned := range map[string]bool{"fetch-1": true, "fetch-2": true, "fetch-3": false, "other-1": true, "other-2": false} {
+		if fetch := readFetch(t, db, id); (fetch.PrunedAt != nil) != wantPruned {
+			t.Errorf("fetch %s pruned at %v, want pruned %v", id, fetch.PrunedAt, wantPruned)
+		}
+	}
+	var scopes int64
+	db.Model(&FetchScope{}).Where("fetch_id = ?", "fetch-2").Count(&scopes)
+	if scopes != 0 {
+		t.Errorf("%d scopes of the pruned fetch-2 left, want none", scopes)
+	}
+	var live []ec2.Instance
+	db.Where("superseded_by IS NULL").Order("instance_id").Find(&live)
+	if len(live) != 2 || aws.StringValue(live[0].InstanceId) != "i-1" || aws.StringValue(live[1].InstanceId) != "i-9" {
+		t.Errorf("%d rows aren't superseded, want i-1 and i-9", len(live))
+	}
+}
+
+// The rows of a fetch that never finished are removed once it is older than its checkpoints,
+// those of a fetch that only stopped at its deadline are kept for the run that resumes it
+func TestPruneSnapshotsAbandoned(t *testing.T) {
+	db := openTestDB(t)
+	migrateTestInstances(t, db)
+	shard := &Shard{Provider: "aws", Account: "111111111111", Region: "us-east-1"}
+	fetchTestInstances(t, db, "finished", shard, true, testInstances("i-1")...)
+	fetchTestInstances(t, db, "abandoned", shard, false, testInstances("i-1", "i-2")...)
+	err := db.Model(&FetchRecord{}).Where("id = ?", "abandoned").
+		Update("started_at", time.Now().UTC().Add(-checkpointRetention-time.Hour)).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped := &Shard{Provider: "aws", Account: "111111111111", Region: "eu-west-1"}
+	fetchTestInstances(t, db, "stopped", stopped, false, testInstances("i-3")...)
+
+	err = pruneSnapshots(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"finished": 1, "stopped": 1}
+	for _, table := range []string{"aws_ec2_instances", "aws_ec2_instance_tags"} {
+		if got := countByFetch(t, db, table); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s rows = %v, want %v", table, got, want)
+		}
+	}
+	if fetch := readFetch(t, db, "abandoned"); fetch.PrunedAt == nil || fetch.FinishedAt != nil {
+		t.Errorf("abandoned fetch = %+v, want it pruned and unfinished", fetch)
+	}
+	if fetch := readFetch(t, db, "stopped"); fetch.PrunedAt != nil {
+		t.Errorf("stopped fetch pruned at %v, want it kept", fetch.PrunedAt)
+	}
+	var scopes int64
+	db.Model(&FetchScope{}).Where("fetch_id = ?", "abandoned").Count(&scopes)
+	if scopes != 0 {
+		t.Errorf("%d scopes of the abandoned fetch left, want none", scopes)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"gorm.io/gorm"
+)
+
+// Without a database server the fetch writes to a sqlite file in /tmp, which is vacuumed and
+// uploaded to S3 after every fetch and policy run as
+// <prefix>/<yyyy>/<mm>/<dd>/cloudquery-<time>-<run id>.db.gz. <prefix>/latest.json points at the
+// newest upload. Fetches and policy runs download it when the local file is missing or older, so
+// any function instance continues from the latest snapshot. latest.json is only moved off the
+// upload the local file was restored from, so of two overlapping runs the one that uploads last
+// doesn't replace the snapshot of the other. Its upload is kept under its dated key.
+
+// Name of the pointer to the newest upload under the prefix
+const sqliteSnapshotPointer = "latest.json"
+
+// sqliteSnapshot is the content of latest.json
+type sqliteSnapshot struct {
+	Key string `json:"key"`
+	// The fetch or policy run that uploaded it
+	RunID      string    `json:"runId"`
+	UploadedAt time.Time `json:"uploadedAt"`
+}
+
+var (
+	// the upload each local database file was last synced with
+	localSQLiteSnapshots     = map[string]string{}
+	localSQLiteSnapshotsLock sync.Mutex
+)
+
+// Returns the location of the uploads, s3://bucket/prefix. Set by CLOUDQUERY_SQLITE_SNAPSHOT.
+func sqliteSnapshotLocation() string {
+	return os.Getenv("CLOUDQUERY_SQLITE_SNAPSHOT")
+}
+
+// Returns the driver and database string of a task: the sqlite database of the snapshots when
+// they are enabled, else driver and dsn as they are
+func taskDatabase(driver, dsn string) (string, string, error) {
+	if sqliteSnapshotLocation() == "" {
+		return driver, dsn, nil
+	}
+	return sqliteSnapshotDatabase(driver, dsn)
+}
+
+// Returns the driver and database string of a task when the sqlite snapshots are enabled. The
+// database defaults to a file in /tmp.
+func sqliteSnapshotDatabase(driver, dsn string) (string, string, error) {
+	if driver == "" {
+		return "sqlite", scratchDSN, nil
+	}
+	if driver != "sqlite" {
+		return "", "", fmt.Errorf("CLOUDQUERY_SQLITE_SNAPSHOT needs the sqlite driver, not %s", driver)
+	}
+	if dsn == "" || dsn == ":memory:" || strings.Contains(dsn, "mode=memory") {
+		return "", "", fmt.Errorf("CLOUDQUERY_SQLITE_SNAPSHOT needs a sqlite database file")
+	}
+	return driver, dsn, nil
+}
+
+// Returns the path of the file of a sqlite database string, e.g. file:/tmp/cloudquery.db?_busy_timeout=5000
+func sqlitePath(dsn string) string {
+	path := strings.TrimPrefix(dsn, "file:")
+	if i := strings.Index(path, "?"); i >= 0 {
+		path = path[:i]
+	}
+	return path
+}
+
+type sqliteSnapshotStore struct {
+	bucket string
+	prefix string
+	client *s3.S3
+}
+
+// CLOUDQUERY_S3_ENDPOINT points the client at an S3 compatible endpoint
+func newSQLiteSnapshotStore(location string) (*sqliteSnapshotStore, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("CLOUDQUERY_SQLITE_SNAPSHOT should be in format s3://bucket/prefix")
+	}
+	sess, err := sharedAWSSession()
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteSnapshotStore{bucket: u.Host, prefix: strings.Trim(u.Path, "/"), client: s3.New(sess, awsServiceConfig("s3"))}, nil
+}
+
+func (s *sqliteSnapshotStore) key(name string) string {
+	if s.prefix == "" {
+		return name
+	}
+	return s.prefix + "/" + name
+}
+
+// Returns the newest upload with the ETag of latest.json, or nil when nothing was uploaded yet
+func (s *sqliteSnapshotStore) latest() (*sqliteSnapshot, string, error) {
+	output, err := s.client.GetObject(&s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(s.key(sqliteSnapshotPointer))})
+	if err != nil {
+		if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusNotFound {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+	defer output.Body.Close()
+	var snapshot sqliteSnapshot
+	err = json.NewDecoder(output.Body).Decode(&snapshot)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid %s: %w", sqliteSnapshotPointer, err)
+	}
+	return &snapshot, aws.StringValue(output.ETag), nil
+}
+
+// Points latest.json at an upload if it still has the ETag it was read with, or doesn't exist
+// yet when etag is empty. S3 refuses the write with 412 when another run moved it in between.
+func (s *sqliteSnapshotStore) movePointer(snapshot sqliteSnapshot, etag string) error {
+	pointer, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	req, _ := s.client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(s.key(sqliteSnapshotPointer)),
+		Body:        bytes.NewReader(pointer),
+		ContentType: aws.String("application/json"),
+	})
+	if etag == "" {
+		req.HTTPRequest.Header.Set("If-None-Match", "*")
+	} else {
+		req.HTTPRequest.Header.Set("If-Match", etag)
+	}
+	err = req.Send()
+	if reqErr, ok := err.(awserr.RequestFailure); ok &&
+		(reqErr.StatusCode() == http.StatusPreconditionFailed || reqErr.StatusCode() == http.StatusConflict) {
+		return fmt.Errorf("%s was moved by another run", sqliteSnapshotPointer)
+	}
+	return err
+}
+
+// Replaces the local database with the newest upload, unless the local file is already that
+// upload. The connections to the old file are closed first.
+func restoreSQLiteSnapshot(location, dsn string) error {
+	store, err := newSQLiteSnapshotStore(location)
+	if err != nil {
+		return err
+	}
+	snapshot, _, err := store.latest()
+	if err != nil || snapshot == nil {
+		return err
+	}
+	path := sqlitePath(dsn)
+	localSQLiteSnapshotsLock.Lock()
+	defer localSQLiteSnapshotsLock.Unlock()
+	if _, err := os.Stat(path); err == nil && localSQLiteSnapshots[path] == snapshot.Key {
+		return nil
+	}
+	output, err := store.client.GetObject(&s3.GetObjectInput{Bucket: aws.String(store.bucket), Key: aws.String(snapshot.Key)})
+	if err != nil {
+		return fmt.Errorf("unable to download %s: %w", snapshot.Key, err)
+	}
+	defer output.Body.Close()
+	reader, err := gzip.NewReader(output.Body)
+	if err != nil {
+		return fmt.Errorf("unable to decompress %s: %w", snapshot.Key, err)
+	}
+	download := path + ".download"
+	f, err := os.Create(download)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, reader)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(download)
+		return fmt.Errorf("unable to download %s: %w", snapshot.Key, err)
+	}
+	forgetDB("sqlite", dsn)
+	os.Remove(path + "-journal")
+	os.Remove(path + "-wal")
+	os.Remove(path + "-shm")
+	err = os.Rename(download, path)
+	if err != nil {
+		return err
+	}
+	localSQLiteSnapshots[path] = snapshot.Key
+	return nil
+}
+
+// Vacuums the database and uploads it, then points latest.json at the upload. Fails without
+// moving latest.json when it points at another upload than the one the database was restored
+// from, as that upload is newer than the database.
+func uploadSQLiteSnapshot(db *gorm.DB, location, dsn, runID string) (string, error) {
+	store, err := newSQLiteSnapshotStore(location)
+	if err != nil {
+		return "", err
+	}
+	err = db.Exec("VACUUM").Error
+	if err != nil {
+		return "", fmt.Errorf("unable to vacuum the database: %w", err)
+	}
+	path := sqlitePath(dsn)
+	localSQLiteSnapshotsLock.Lock()
+	defer localSQLiteSnapshotsLock.Unlock()
+	compressed, err := gzipFile(path)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(compressed)
+	f, err := os.Open(compressed)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	now := time.Now().UTC()
+	snapshot := sqliteSnapshot{
+		Key:        store.key(fmt.Sprintf("%s/cloudquery-%s-%s.db.gz", now.Format("2006/01/02"), now.Format("20060102T150405Z"), runID)),
+		RunID:      runID,
+		UploadedAt: now,
+	}
+	_, err = store.client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(store.bucket),
+		Key:         aws.String(snapshot.Key),
+		Body:        f,
+		ContentType: aws.String("application/gzip"),
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to upload %s: %w", snapshot.Key, err)
+	}
+	latest, etag, err := store.latest()
+	if err == nil && latest != nil && latest.Key != localSQLiteSnapshots[path] {
+		err = fmt.Errorf("%s points at %s of run %s, which is newer than this database", sqliteSnapshotPointer, latest.Key, latest.RunID)
+	}
+	if err == nil {
+		err = store.movePointer(snapshot, etag)
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to update %s, the upload is kept as %s: %w", sqliteSnapshotPointer, snapshot.Key, err)
+	}
+	localSQLiteSnapshots[path] = snapshot.Key
+	return "s3://" + store.bucket + "/" + snapshot.Key, nil
+}
+
+// Compresses a file into a temporary file and returns its path
+func gzipFile(path string) (string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := ioutil.TempFile("", "cloudquery-*.db.gz")
+	if err != nil {
+		return "", err
+	}
+	w := gzip.NewWriter(out)
+	_, err = io.Copy(w, in)
+	if err == nil {
+		err = w.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
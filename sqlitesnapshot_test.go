@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func TestSQLiteSnapshotDatabase(t *testing.T) {
+	tests := []struct {
+		driver, dsn         string
+		wantDriver, wantDSN string
+		wantErr             bool
+	}{
+		{driver: "", dsn: "", wantDriver: "sqlite", wantDSN: scratchDSN},
+		{driver: "sqlite", dsn: "file:/tmp/inventory.db?_busy_timeout=5000", wantDriver: "sqlite", wantDSN: "file:/tmp/inventory.db?_busy_timeout=5000"},
+		{driver: "postgresql", dsn: "host=localhost", wantErr: true},
+		{driver: "sqlite", dsn: ":memory:", wantErr: true},
+		{driver: "sqlite", dsn: "file:inventory?mode=memory", wantErr: true},
+	}
+	for _, tt := range tests {
+		driver, dsn, err := sqliteSnapshotDatabase(tt.driver, tt.dsn)
+		if (err != nil) != tt.wantErr || driver != tt.wantDriver || dsn != tt.wantDSN {
+			t.Errorf("sqliteSnapshotDatabase(%q, %q) = %q, %q, %v, want %q, %q, error %v",
+				tt.driver, tt.dsn, driver, dsn, err, tt.wantDriver, tt.wantDSN, tt.wantErr)
+		}
+	}
+
+	setenv(t, "CLOUDQUERY_SQLITE_SNAPSHOT", "")
+	driver, dsn, err := taskDatabase("postgresql", "host=localhost")
+	if err != nil || driver != "postgresql" || dsn != "host=localhost" {
+		t.Errorf("taskDatabase() = %q, %q, %v without the snapshots, want the database as it is", driver, dsn, err)
+	}
+	setenv(t, "CLOUDQUERY_SQLITE_SNAPSHOT", "s3://inventory/cloudquery")
+	driver, dsn, err = taskDatabase("", "")
+	if err != nil || driver != "sqlite" || dsn != scratchDSN {
+		t.Errorf("taskDatabase() = %q, %q, %v with the snapshots, want the sqlite file in /tmp", driver, dsn, err)
+	}
+}
+
+// Starts an S3 stub storing its objects in dir and points the S3 client at it
+func startS3Stub(t *testing.T, dir string) {
+	store, err := newS3StubStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(store)
+	t.Cleanup(server.Close)
+	setenv(t, "CLOUDQUERY_S3_ENDPOINT", server.URL+"/s3")
+	setenv(t, "AWS_REGION", "us-east-1")
+	setenv(t, "AWS_ACCESS_KEY_ID", "test")
+	setenv(t, "AWS_SECRET_ACCESS_KEY", "test")
+}
+
+// Reads the pointer to the newest upload from the objects of the S3 stub
+func readSnapshotPointer(t *testing.T, dir string) sqliteSnapshot {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "inventory", "cloudquery", sqliteSnapshotPointer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshot sqliteSnapshot
+	err = json.Unmarshal(data, &snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snapshot
+}
+
+func TestSQLiteSnapshotUploadAndRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlitesnapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s3Dir := filepath.Join(dir, "s3")
+	startS3Stub(t, s3Dir)
+	location := "s3://inventory/cloudquery"
+
+	source := filepath.Join(dir, "source.db")
+	defer forgetDB("sqlite", source)
+	// nothing was uploaded yet, so the local database is kept
+	err = restoreSQLiteSnapshot(location, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openDB("sqlite", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Exec("CREATE TABLE widgets (name text)").Error
+	if err == nil {
+		err = db.Exec("INSERT INTO widgets (name) VALUES ('gear')").Error
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploaded, err := uploadSQLiteSnapshot(db, location, source, "run-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := readSnapshotPointer(t, s3Dir)
+	if snapshot.RunID != "run-1" || uploaded != "s3://inventory/"+snapshot.Key ||
+		!strings.HasPrefix(snapshot.Key, "cloudquery/") || !strings.HasSuffix(snapshot.Key, "-run-1.db.gz") {
+		t.Errorf("uploaded %s with the pointer %+v", uploaded, snapshot)
+	}
+
+	restored := filepath.Join(dir, "restored.db")
+	defer forgetDB("sqlite", restored)
+	err = restoreSQLiteSnapshot(location, restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = openDB("sqlite", restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	err = db.Raw("SELECT name FROM widgets").Scan(&names).Error
+	if err != nil || len(names) != 1 || names[0] != "gear" {
+		t.Errorf("restored widgets = %v, %v, want [gear]", names, err)
+	}
+
+	// a database that has the newest upload isn't downloaded again
+	err = os.Remove(filepath.Join(s3Dir, "inventory", filepath.FromSlash(snapshot.Key)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = restoreSQLiteSnapshot(location, restored)
+	if err != nil {
+		t.Errorf("restoreSQLiteSnapshot() downloaded the snapshot the database has: %s", err)
+	}
+	forgetDB("sqlite", restored)
+	os.Remove(restored)
+	err = restoreSQLiteSnapshot(location, restored)
+	if err == nil {
+		t.Errorf("restoreSQLiteSnapshot() kept a missing database instead of downloading it")
+	}
+}
+
+// Opens a restored copy of the snapshots and adds a widget to it
+func restoreAndAddWidget(t *testing.T, location, dsn, name string) *gorm.DB {
+	err := restoreSQLiteSnapshot(location, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openDB("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Exec("INSERT INTO widgets (name) VALUES (?)", name).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// Of two runs that restored the same snapshot only the first upload moves latest.json, the
+// later one would replace the data of the first with its stale copy
+func TestSQLiteSnapshotPointerRace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlitesnapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s3Dir := filepath.Join(dir, "s3")
+	startS3Stub(t, s3Dir)
+	location := "s3://inventory/cloudquery"
+	seed := filepath.Join(dir, "seed.db")
+	defer forgetDB("sqlite", seed)
+	db, err := openDB("sqlite", seed)
+	if err == nil {
+		err = db.Exec("CREATE TABLE widgets (name text)").Error
+	}
+	if err == nil {
+		_, err = uploadSQLiteSnapshot(db, location, seed, "run-0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a fetch and a policy run on two instances upload at the same time
+	fetch, policy := filepath.Join(dir, "fetch.db"), filepath.Join(dir, "policy.db")
+	defer forgetDB("sqlite", fetch)
+	defer forgetDB("sqlite", policy)
+	runs := map[string]*gorm.DB{
+		"run-fetch":  restoreAndAddWidget(t, location, fetch, "gear"),
+		"run-policy": restoreAndAddWidget(t, location, policy, "spring"),
+	}
+	dsns := map[string]string{"run-fetch": fetch, "run-policy": policy}
+	errs := make(chan error, len(runs))
+	for runID, db := range runs {
+		go func(runID string, db *gorm.DB) {
+			_, err := uploadSQLiteSnapshot(db, location, dsns[runID], runID)
+			errs <- err
+		}(runID, db)
+	}
+	var failed int
+	for range runs {
+		if err := <-errs; err != nil {
+			failed++
+			if !strings.Contains(err.Error(), "is newer than this database") || !strings.Contains(err.Error(), "the upload is kept") {
+				t.Errorf("uploadSQLiteSnapshot() error = %v, want the conflict", err)
+			}
+		}
+	}
+	if failed != 1 {
+		t.Fatalf("%d of the overlapping uploads failed, want 1", failed)
+	}
+
+	// the run that lost continues from the snapshot of the other one
+	winner := readSnapshotPointer(t, s3Dir)
+	loser := "run-fetch"
+	if winner.RunID == loser {
+		loser = "run-policy"
+	}
+	db = restoreAndAddWidget(t, location, dsns[loser], "lever")
+	_, err = uploadSQLiteSnapshot(db, location, dsns[loser], loser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	err = db.Raw("SELECT name FROM widgets ORDER BY name").Scan(&names).Error
+	want := map[string][]string{"run-fetch": {"gear", "lever"}, "run-policy": {"lever", "spring"}}[winner.RunID]
+	if err != nil || !reflect.DeepEqual(names, want) {
+		t.Errorf("widgets after the retry = %v, %v, want %v", names, err, want)
+	}
+
+	// latest.json moved between reading it and writing it
+	store, err := newSQLiteSnapshotStore(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest, etag, err := store.latest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = uploadSQLiteSnapshot(db, location, dsns[loser], "run-3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.movePointer(*latest, etag); err == nil || !strings.Contains(err.Error(), "moved by another run") {
+		t.Errorf("movePointer() with a stale ETag error = %v, want it refused", err)
+	}
+	if err = store.movePointer(*latest, ""); err == nil {
+		t.Error("movePointer() without an ETag replaced an existing latest.json")
+	}
+	if snapshot := readSnapshotPointer(t, s3Dir); snapshot.RunID != "run-3" {
+		t.Errorf("latest.json points at %s, want run-3", snapshot.RunID)
+	}
+}
+
+// The findings of a policy run and the record of the run end up in the sqlite database of the
+// snapshots, and the findings are uploaded
+func TestPolicySQLiteSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlitesnapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s3Dir := filepath.Join(dir, "s3")
+	startS3Stub(t, s3Dir)
+	setenv(t, "CLOUDQUERY_SQLITE_SNAPSHOT", "s3://inventory/cloudquery")
+
+	local := filepath.Join(dir, "local.db")
+	defer forgetDB("sqlite", local)
+	db, err := openDB("sqlite", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Exec("CREATE TABLE widgets (name text, broken numeric)").Error
+	if err == nil {
+		err = db.Exec("INSERT INTO widgets (name, broken) VALUES ('gear', 1), ('spring', 0)").Error
+	}
+	if err == nil {
+		err = db.AutoMigrate(&RunRecord{})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := filepath.Join(dir, "policy.yml")
+	err = ioutil.WriteFile(policy, []byte("queries:\n  - name: broken widgets\n    query: SELECT name FROM widgets WHERE broken = 1\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &Request{TaskName: "policy", RunID: "run-1", PolicyPath: policy}
+	resp := newResponse("policy")
+	err = Policy("sqlite", local, req, false, resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := readSnapshotPointer(t, s3Dir)
+	if resp.SQLiteSnapshot != "s3://inventory/"+snapshot.Key || snapshot.RunID != "run-1" {
+		t.Errorf("the policy run uploaded %q, latest.json points at %+v", resp.SQLiteSnapshot, snapshot)
+	}
+
+	driver, dsn := DRIVER, DSN
+	DRIVER, DSN = "sqlite", local
+	defer func() { DRIVER, DSN = driver, dsn }()
+	trackRun(req, resp)
+
+	restored := filepath.Join(dir, "restored.db")
+	defer forgetDB("sqlite", restored)
+	err = restoreSQLiteSnapshot("s3://inventory/cloudquery", restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = openDB("sqlite", restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var findings []PolicyFinding
+	err = db.Where("run_id = ?", "run-1").Find(&findings).Error
+	if err != nil || len(findings) != 1 || findings[0].Count != 1 || findings[0].Passed {
+		t.Errorf("uploaded findings = %+v, %v, want one failed query with one row", findings, err)
+	}
+
+	db, err = openDB("sqlite", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var runs []RunRecord
+	err = db.Where("id = ?", "run-1").Find(&runs).Error
+	if err != nil || len(runs) != 1 || runs[0].Status != resp.Status {
+		t.Errorf("run records = %+v, %v, want run-1 with status %s", runs, err, resp.Status)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Task is a named unit of work that can be invoked through the Lambda handler or the command line
+type Task struct {
+	Description string
+	// Returns a pointer to the request schema of the task. The invocation payload is decoded into it
+	// and passed to Run.
+	NewRequest func() interface{}
+	Run        func(ctx context.Context, req interface{}, resp *Response) error
+}
+
+var taskRegistry = map[string]Task{}
+
+// Registers a task under the given name. Tasks register themselves from an init function.
+func RegisterTask(name string, task Task) {
+	if _, ok := taskRegistry[name]; ok {
+		panic(fmt.Sprintf("task %s is already registered", name))
+	}
+	taskRegistry[name] = task
+}
+
+// Returns the names of all registered tasks in alphabetical order
+func taskNames() []string {
+	names := make([]string, 0, len(taskRegistry))
+	for name := range taskRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Looks up a task and decodes the payload into its request schema
+func lookupTask(name string, payload []byte) (Task, interface{}, error) {
+	task, ok := taskRegistry[name]
+	if !ok {
+		return Task{}, nil, newTaskError(ErrorTypeUnknownTask,
+			fmt.Errorf("unknown task %q. valid tasks are: %s", name, strings.Join(taskNames(), ", ")))
+	}
+	req := task.NewRequest()
+	if len(payload) > 0 {
+		err := json.Unmarshal(payload, req)
+		if err != nil {
+			return Task{}, nil, newTaskError(ErrorTypeInvalidRequest, fmt.Errorf("invalid request for task %s: %w", name, err))
+		}
+	}
+	return task, req, nil
+}
@@ -3,6 +3,8 @@ resource "aws_rds_cluster" "cloudquery" {
   engine                     = "aurora-mysql"
   engine_version             =  "5.7.mysql_aurora.2.07.1"
   engine_mode                = "serverless"
+  # lets the function use the rds-data-api driver without a VPC
+  enable_http_endpoint       = true
 
   scaling_configuration {
     auto_pause               = true
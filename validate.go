@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	awsprovider "github.com/cloudquery/cloudquery/providers/aws"
+	"github.com/cloudquery/cloudquery/providers/azure"
+	"github.com/cloudquery/cloudquery/providers/gcp"
+	"github.com/cloudquery/cloudquery/providers/k8s"
+	"github.com/cloudquery/cloudquery/providers/okta"
+	"github.com/mitchellh/mapstructure"
+	"gopkg.in/yaml.v3"
+)
+
+func init() {
+	RegisterTask("validate", Task{
+		Description: "Checks config.yml against the supported providers and resources without fetching anything",
+		NewRequest:  func() interface{} { return &Request{} },
+		Run: func(ctx context.Context, req interface{}, resp *Response) error {
+			return Validate(req.(*Request), resp)
+		},
+	})
+}
+
+// The structs each provider decodes its config block into
+var providerConfigs = map[string]func() interface{}{
+	"aws":   func() interface{} { return &awsprovider.Config{} },
+	"gcp":   func() interface{} { return &gcp.Config{} },
+	"azure": func() interface{} { return &azure.Config{} },
+	"okta":  func() interface{} { return &okta.Config{} },
+	"k8s":   func() interface{} { return &k8s.Config{} },
+}
+
+type ConfigProblem struct {
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+type ValidationResult struct {
+	Path     string          `json:"path"`
+	Valid    bool            `json:"valid"`
+	Problems []ConfigProblem `json:"problems,omitempty"`
+}
+
+// Validates the providers of the request, or the local config file at the location of the
+// request. Remote locations are rejected, as validating must not need network access or
+// credentials. Invalid configs are reported in resp.Validation and don't fail the task.
+func Validate(req *Request, resp *Response) error {
+	inline := len(req.Providers) > 0 && (req.ProvidersMode == "" || req.ProvidersMode == ProvidersModeOverride)
+	location := configLocation(req)
+	if !inline && isRemoteSource(location) {
+		return newTaskError(ErrorTypeConfig, fmt.Errorf("validate only reads local config files, %s is remote. download it and validate the file, or pass its providers in the request", location))
+	}
+	if len(req.Providers) == 0 {
+		data, err := readSource(location)
+		if err != nil {
+			return newTaskError(ErrorTypeConfig, err)
+		}
+		problems := validateConfig(data)
+		resp.Validation = &ValidationResult{Path: location, Valid: len(problems) == 0, Problems: problems}
+		return nil
+	}
+
+	config, err := resolveConfig(req)
+	if err != nil {
+		return newTaskError(ErrorTypeConfig, err)
+	}
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return newTaskError(ErrorTypeConfig, err)
+	}
+	problems := validateConfig(data)
+	// the lines would refer to the providers encoded as YAML rather than to the request
+	for i := range problems {
+		problems[i].Line, problems[i].Column = 0, 0
+	}
+	path := "providers"
+	if !inline {
+		path = location
+	}
+	resp.Validation = &ValidationResult{Path: path, Valid: len(problems) == 0, Problems: problems}
+	return nil
+}
+
+var yamlLinePattern = regexp.MustCompile(`line (\d+)`)
+
+// Parses a config and returns every problem that would make a fetch fail, with its line number
+func validateConfig(data []byte) []ConfigProblem {
+	var doc yaml.Node
+	err := yaml.Unmarshal(data, &doc)
+	if err != nil {
+		problem := ConfigProblem{Message: err.Error()}
+		if match := yamlLinePattern.FindStringSubmatch(err.Error()); match != nil {
+			problem.Line, _ = strconv.Atoi(match[1])
+		}
+		return []ConfigProblem{problem}
+	}
+	v := configValidator{}
+	if len(doc.Content) == 0 {
+		v.addf(&doc, "config is empty")
+		return v.problems
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		v.addf(root, "config should be a mapping with a providers key")
+		return v.problems
+	}
+	var providers *yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "providers" {
+			providers = root.Content[i+1]
+		} else {
+			v.addf(root.Content[i], "unknown key %s", root.Content[i].Value)
+		}
+	}
+	switch {
+	case providers == nil:
+		v.addf(root, "config must contain key: providers")
+	case providers.Kind != yaml.SequenceNode:
+		v.addf(providers, "providers should be a list")
+	default:
+		for _, provider := range providers.Content {
+			v.validateProvider(provider)
+		}
+	}
+	sort.SliceStable(v.problems, func(i, j int) bool {
+		return v.problems[i].Line < v.problems[j].Line
+	})
+	return v.problems
+}
+
+type configValidator struct {
+	problems []ConfigProblem
+}
+
+func (v *configValidator) addf(node *yaml.Node, format string, args ...interface{}) {
+	v.problems = append(v.problems, ConfigProblem{
+		Line:    node.Line,
+		Column:  node.Column,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *configValidator) validateProvider(node *yaml.Node) {
+	if node.Kind != yaml.MappingNode {
+		v.addf(node, "provider should be a mapping")
+		return
+	}
+	nameKey, nameNode := mappingEntry(node, "name")
+	if nameNode == nil {
+		v.addf(node, "provider must contain key: name")
+		return
+	}
+	name := nameNode.Value
+	if providerMap[name] == nil {
+		v.addf(nameNode, "unknown provider %s. valid providers are: %s", name, strings.Join(providerNames(), ", "))
+		return
+	}
+	var rest map[string]interface{}
+	err := node.Decode(&rest)
+	if err != nil {
+		v.addf(node, "%s", err)
+		return
+	}
+	delete(rest, "name")
+
+	// decode with the provider's own struct, the same way Run does
+	config := providerConfigs[name]()
+	var metadata mapstructure.Metadata
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{Result: config, Metadata: &metadata})
+	if err != nil {
+		v.addf(node, "%s", err)
+		return
+	}
+	err = decoder.Decode(rest)
+	var decodeErr *mapstructure.Error
+	if errors.As(err, &decodeErr) {
+		for _, message := range decodeErr.Errors {
+			v.addf(nodeForMessage(node, message), "%s", message)
+		}
+	} else if err != nil {
+		v.addf(node, "%s", err)
+	}
+	sort.Strings(metadata.Unused)
+	for _, key := range metadata.Unused {
+		if name == "aws" && strings.EqualFold(key, "region") {
+			// older configs use region, which the provider ignores and fetches every region
+			v.addf(nodeAtPath(node, key), "unknown key %s for provider aws, every region is fetched. did you mean regions?", key)
+			continue
+		}
+		v.addf(nodeAtPath(node, key), "unknown key %s for provider %s", key, name)
+	}
+
+	_, resources := mappingEntry(node, "resources")
+	switch {
+	case resources == nil || len(resources.Content) == 0:
+		v.addf(nameKey, "please specify at least 1 resource for provider %s", name)
+	case resources.Kind != yaml.SequenceNode:
+		v.addf(resources, "resources should be a list")
+	default:
+		for _, resource := range resources.Content {
+			v.validateResource(name, resource)
+		}
+	}
+
+	switch config := config.(type) {
+	case *awsprovider.Config:
+		v.validateAWS(node, config)
+	case *okta.Config:
+		if config.Domain == "" {
+			v.addf(nameKey, "please set your okta \"domain\"")
+		}
+	}
+}
+
+func (v *configValidator) validateResource(provider string, node *yaml.Node) {
+	_, nameNode := mappingEntry(node, "name")
+	if nameNode == nil {
+		v.addf(node, "resource must contain key: name")
+		return
+	}
+	if isSupportedResource(provider, nameNode.Value) {
+		return
+	}
+	if suggestion := suggestResource(provider, nameNode.Value); suggestion != "" {
+		v.addf(nameNode, "unknown %s resource %s. did you mean %s?", provider, nameNode.Value, suggestion)
+	} else {
+		v.addf(nameNode, "unknown %s resource %s", provider, nameNode.Value)
+	}
+}
+
+func (v *configValidator) validateAWS(node *yaml.Node, config *awsprovider.Config) {
+	if config.LogLevel != nil && !awsLogLevels[*config.LogLevel] {
+		v.addf(nodeAtPath(node, "log_level"), "unknown log_level %s", *config.LogLevel)
+	}
+
+	known := map[string]bool{}
+	for _, partition := range endpoints.DefaultResolver().(endpoints.EnumPartitions).Partitions() {
+		for id := range partition.Regions() {
+			known[id] = true
+		}
+	}
+	for i, region := range config.Regions {
+		if !known[region] {
+			v.addf(nodeAtPath(node, fmt.Sprintf("regions[%d]", i)), "unknown aws region %s", region)
+		}
+	}
+
+	for i, account := range config.Accounts {
+		path := fmt.Sprintf("accounts[%d]", i)
+		switch {
+		case account.ID == "":
+			v.addf(nodeAtPath(node, path), "account must contain key: id")
+		case account.ID != "default" && account.RoleARN == "":
+			v.addf(nodeAtPath(node, path), "account %s must contain key: role_arn", account.ID)
+		}
+	}
+}
+
+// Returns the key and value nodes of a mapping entry. Keys are matched case insensitively like
+// mapstructure does.
+func mappingEntry(node *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if strings.EqualFold(node.Content[i].Value, key) {
+			return node.Content[i], node.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+// Resolves a mapstructure path such as accounts[0].role_arn to the closest node that exists
+func nodeAtPath(node *yaml.Node, path string) *yaml.Node {
+	current := node
+	for _, segment := range strings.Split(path, ".") {
+		key, index := segment, -1
+		if i := strings.Index(segment, "["); i >= 0 && strings.HasSuffix(segment, "]") {
+			key = segment[:i]
+			index, _ = strconv.Atoi(segment[i+1 : len(segment)-1])
+		}
+		keyNode, value := mappingEntry(current, key)
+		if value == nil {
+			return current
+		}
+		if index < 0 {
+			current = keyNode
+			if value.Kind == yaml.MappingNode {
+				current = value
+			}
+			continue
+		}
+		if value.Kind != yaml.SequenceNode || index >= len(value.Content) {
+			return keyNode
+		}
+		current = value.Content[index]
+	}
+	return current
+}
+
+var mapstructurePathPattern = regexp.MustCompile(`^'([^']*)'`)
+
+// Finds the node a mapstructure error message refers to, e.g. 'max_retries' expected type 'int'
+func nodeForMessage(node *yaml.Node, message string) *yaml.Node {
+	match := mapstructurePathPattern.FindStringSubmatch(message)
+	if match == nil || match[1] == "" {
+		return node
+	}
+	return nodeAtPath(node, match[1])
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yml")
+	err = ioutil.WriteFile(path, []byte("providers:\n  - name: aws\n    region: us-east-1\n    resources:\n      - name: ec2.instnaces\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	awsProviders := func(rest map[string]interface{}) []ProviderConfig {
+		return []ProviderConfig{{Name: "aws", Rest: rest}}
+	}
+
+	tests := []struct {
+		name    string
+		req     Request
+		want    *ValidationResult
+		wantErr bool
+	}{
+		{
+			name: "local file",
+			req:  Request{ConfigPath: path},
+			want: &ValidationResult{Path: path, Problems: []ConfigProblem{
+				{Line: 3, Column: 5, Message: "unknown key region for provider aws, every region is fetched. did you mean regions?"},
+				{Line: 5, Column: 15, Message: "unknown aws resource ec2.instnaces. did you mean ec2.instances?"},
+			}},
+		},
+		{
+			name: "inline providers",
+			req: Request{ConfigPath: "s3://bucket/config.yml", Providers: awsProviders(map[string]interface{}{
+				"regions":   []interface{}{"us-east-1"},
+				"resources": resourceList("ec2.instances"),
+			})},
+			want: &ValidationResult{Path: "providers", Valid: true},
+		},
+		{
+			name: "inline providers with problems",
+			req: Request{Providers: awsProviders(map[string]interface{}{
+				"regions":   []interface{}{"us-east-42"},
+				"resources": resourceList("ec2.instances"),
+			})},
+			want: &ValidationResult{Path: "providers", Problems: []ConfigProblem{
+				{Message: "unknown aws region us-east-42"},
+			}},
+		},
+		{
+			name: "providers merged onto the local file",
+			req: Request{ConfigPath: path, ProvidersMode: ProvidersModeMerge, Providers: awsProviders(map[string]interface{}{
+				"resources": resourceList("ec2.instances"),
+			})},
+			want: &ValidationResult{Path: path, Problems: []ConfigProblem{
+				{Message: "unknown key region for provider aws, every region is fetched. did you mean regions?"},
+			}},
+		},
+		{name: "s3", req: Request{ConfigPath: "s3://bucket/config.yml"}, wantErr: true},
+		{name: "ssm", req: Request{ConfigPath: "ssm:/cloudquery/config"}, wantErr: true},
+		{name: "https", req: Request{ConfigPath: "https://example.com/config.yml"}, wantErr: true},
+		{
+			name:    "providers merged onto a remote config",
+			req:     Request{ConfigPath: "https://example.com/config.yml", ProvidersMode: ProvidersModeMerge, Providers: awsProviders(map[string]interface{}{})},
+			wantErr: true,
+		},
+		{name: "missing file", req: Request{ConfigPath: filepath.Join(dir, "missing.yml")}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := Response{}
+			err := Validate(&tt.req, &resp)
+			if tt.wantErr {
+				var taskErr *TaskError
+				if !errors.As(err, &taskErr) || taskErr.Type != ErrorTypeConfig {
+					t.Fatalf("Validate() error = %v, want a %s", err, ErrorTypeConfig)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(resp.Validation, tt.want) {
+				t.Errorf("Validate() = %+v, want %+v", resp.Validation, tt.want)
+			}
+		})
+	}
+}